@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultListen  = "/run/ndproxyd.sock"
+	defaultEtcdTTL = 10
+)
+
+// Config is the file ndproxyd loads, YAML unless its name ends in .toml
+type Config struct {
+	// Listen is the status endpoint, a path for a unix socket
+	Listen string `yaml:"listen" toml:"listen"`
+	// Interfaces the prefixes are proxied on, addresses are answered on all
+	Interfaces []string `yaml:"interfaces" toml:"interfaces"`
+	// Addresses are local addresses, Prefixes are routed to the node
+	Addresses []string    `yaml:"addresses" toml:"addresses"`
+	Prefixes  []string    `yaml:"prefixes" toml:"prefixes"`
+	Etcd      *EtcdConfig `yaml:"etcd" toml:"etcd"`
+}
+
+// EtcdConfig adds the targets stored below Prefix, every value a JSON string
+// holding an address or a prefix
+type EtcdConfig struct {
+	Endpoints []string `yaml:"endpoints" toml:"endpoints"`
+	Namespace string   `yaml:"namespace" toml:"namespace"`
+	Prefix    string   `yaml:"prefix" toml:"prefix"`
+	TTL       int64    `yaml:"ttl" toml:"ttl"`
+}
+
+func loadConfig(path string) (c *Config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	c = new(Config)
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = decodeTOML(data, c)
+	} else {
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Listen == "" {
+		c.Listen = defaultListen
+	}
+	if c.Etcd != nil && c.Etcd.TTL <= 0 {
+		c.Etcd.TTL = defaultEtcdTTL
+	}
+	if err = c.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+// decodeTOML rejects keys c has no field for, like yaml.UnmarshalStrict
+func decodeTOML(data []byte, c *Config) error {
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		return err
+	}
+	if keys := md.Undecoded(); len(keys) != 0 {
+		return fmt.Errorf("unknown keys %v", keys)
+	}
+	return nil
+}
+
+func (c *Config) check() error {
+	for _, a := range c.Addresses {
+		if t, err := parseTarget(a); err != nil || t.prefix {
+			return fmt.Errorf("%s is not an address", a)
+		}
+	}
+	for _, p := range c.Prefixes {
+		if t, err := parseTarget(p); err != nil || !t.prefix {
+			return fmt.Errorf("%s is not a prefix", p)
+		}
+	}
+	if len(c.Prefixes) != 0 && len(c.Interfaces) == 0 {
+		return fmt.Errorf("prefixes need interfaces")
+	}
+	if c.Etcd != nil && (len(c.Etcd.Endpoints) == 0 || c.Etcd.Prefix == "") {
+		return fmt.Errorf("etcd needs endpoints and a prefix")
+	}
+	return nil
+}
+
+// target is a normalized address or prefix
+type target struct {
+	value  string
+	prefix bool
+}
+
+func parseTarget(s string) (t target, err error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil || network.IP.To4() != nil {
+			return t, fmt.Errorf("invalid IPv6 prefix %q", s)
+		}
+		return target{value: network.String(), prefix: true}, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return t, fmt.Errorf("invalid IPv6 address %q", s)
+	}
+	return target{value: ip.String()}, nil
+}
+
+// desired merges the targets of the config and of etcd, invalid remote
+// values are skipped
+func desired(c *Config, remote map[string]string) map[target]bool {
+	want := make(map[target]bool)
+	for _, s := range append(append([]string(nil), c.Addresses...), c.Prefixes...) {
+		if t, err := parseTarget(s); err == nil {
+			want[t] = true
+		}
+	}
+	for _, s := range remote {
+		if t, err := parseTarget(s); err == nil {
+			want[t] = true
+		}
+	}
+	return want
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndproxyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := map[string]string{
+		"ndproxyd.yaml": "interfaces: [eth0]\naddresses: [fd00::200]\nprefixes: [fd00:1::/64]\n" +
+			"etcd:\n  endpoints: [127.0.0.1:2379]\n  prefix: /ndproxy/\n",
+		"ndproxyd.toml": "interfaces = [\"eth0\"]\naddresses = [\"fd00::200\"]\nprefixes = [\"fd00:1::/64\"]\n" +
+			"[etcd]\nendpoints = [\"127.0.0.1:2379\"]\nprefix = \"/ndproxy/\"\n",
+	}
+	for name, content := range configs {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if c.Listen != defaultListen || c.Etcd.TTL != defaultEtcdTTL || len(c.Prefixes) != 1 {
+			t.Fatalf("%s: %+v", name, c)
+		}
+	}
+
+	invalid := map[string]string{
+		"prefix as address":     "addresses: [fd00::/64]\n",
+		"IPv4 address":          "addresses: [10.0.0.1]\n",
+		"prefix w/o interfaces": "prefixes: [fd00:1::/64]\n",
+		"etcd without prefix":   "etcd:\n  endpoints: [127.0.0.1:2379]\n",
+	}
+	invalid["unknown TOML field"] = "adresses = [\"fd00::200\"]\n"
+	for name, content := range invalid {
+		path := filepath.Join(dir, "invalid.yaml")
+		if strings.HasPrefix(name, "unknown TOML") {
+			path = filepath.Join(dir, "invalid.toml")
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestDesired(t *testing.T) {
+	c := &Config{
+		Addresses: []string{"fd00:0::200"},
+		Prefixes:  []string{"fd00:1::1/64"},
+	}
+	remote := map[string]string{
+		"/ndproxy/a": "fd00::200",
+		"/ndproxy/b": "fd00:2::/64",
+		"/ndproxy/c": "fd00::201",
+	}
+
+	want := map[target]bool{
+		{value: "fd00::200"}:                 true,
+		{value: "fd00::201"}:                 true,
+		{value: "fd00:1::/64", prefix: true}: true,
+		{value: "fd00:2::/64", prefix: true}: true,
+	}
+	got := desired(c, remote)
+	if len(got) != len(want) {
+		t.Fatalf("desired %v, want %v", got, want)
+	}
+	for k := range want {
+		if !got[k] {
+			t.Fatalf("desired %v, want %v", got, want)
+		}
+	}
+}
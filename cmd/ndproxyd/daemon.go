@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adoyee/go-utils/etcd"
+	"github.com/adoyee/go-utils/net/ndproxy"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// relistDelay spaces the attempts to list the etcd prefix again
+const relistDelay = time.Second
+
+type prefixKey struct {
+	cidr   string
+	ifName string
+}
+
+// daemon proxies the targets of the config and etcd, keeping what it
+// applied so changes only touch the difference
+type daemon struct {
+	path string
+
+	lock      sync.Mutex
+	cfg       *Config
+	remote    map[string]string
+	addresses map[string]bool
+	prefixes  map[prefixKey]bool
+}
+
+func newDaemon(path string) *daemon {
+	return &daemon{
+		path:      path,
+		remote:    make(map[string]string),
+		addresses: make(map[string]bool),
+		prefixes:  make(map[prefixKey]bool),
+	}
+}
+
+func (d *daemon) reload() (err error) {
+	cfg, err := loadConfig(d.path)
+	if err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.cfg != nil {
+		if d.cfg.Listen != cfg.Listen {
+			log.Printf("listen %s kept, changing it needs a restart", d.cfg.Listen)
+			cfg.Listen = d.cfg.Listen
+		}
+		if !sameEtcd(d.cfg.Etcd, cfg.Etcd) {
+			log.Println("etcd settings kept, changing them needs a restart")
+			cfg.Etcd = d.cfg.Etcd
+		}
+	}
+	d.cfg = cfg
+	return d.apply()
+}
+
+func sameEtcd(a, b *EtcdConfig) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// apply attempts every target, the first error is returned
+func (d *daemon) apply() (err error) {
+	keep := func(e error) {
+		if e == nil {
+			return
+		}
+		log.Println(e)
+		if err == nil {
+			err = e
+		}
+	}
+
+	addresses := make(map[string]bool)
+	prefixes := make(map[prefixKey]bool)
+	for t := range desired(d.cfg, d.remote) {
+		if !t.prefix {
+			addresses[t.value] = true
+			continue
+		}
+		for _, name := range d.cfg.Interfaces {
+			prefixes[prefixKey{cidr: t.value, ifName: name}] = true
+		}
+	}
+
+	for address := range d.addresses {
+		if !addresses[address] {
+			ndproxy.DelAddress(address)
+			delete(d.addresses, address)
+		}
+	}
+	for k := range d.prefixes {
+		if !prefixes[k] {
+			ndproxy.DelPrefix(k.cidr, k.ifName)
+			delete(d.prefixes, k)
+		}
+	}
+
+	for address := range addresses {
+		if d.addresses[address] {
+			continue
+		}
+		if e := ndproxy.AddAddress(address); e != nil {
+			keep(e)
+			continue
+		}
+		d.addresses[address] = true
+	}
+	for k := range prefixes {
+		if d.prefixes[k] {
+			continue
+		}
+		if e := ndproxy.AddPrefix(k.cidr, k.ifName); e != nil {
+			keep(e)
+			continue
+		}
+		d.prefixes[k] = true
+	}
+	return
+}
+
+// watch follows the etcd prefix until ctx is done, listing it again
+// whenever the watch breaks, e.g. on compaction
+func (d *daemon) watch(ctx context.Context, prefix string) {
+	for ctx.Err() == nil {
+		resp, err := etcd.GetWithPrefix(ctx, prefix)
+		if err != nil {
+			log.Println("etcd ", err)
+			time.Sleep(relistDelay)
+			continue
+		}
+
+		remote := make(map[string]string)
+		for _, kv := range resp.Kvs {
+			if t, ok := remoteTarget(kv.Value); ok {
+				remote[string(kv.Key)] = t
+			}
+		}
+		d.setRemote(func(m map[string]string) {
+			for k := range m {
+				delete(m, k)
+			}
+			for k, v := range remote {
+				d.putRemote(k, v)
+			}
+		})
+
+		wctx, cancel := context.WithCancel(ctx)
+		for wresp := range etcd.Watch(wctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1)) {
+			if err := wresp.Err(); err != nil {
+				log.Println("etcd watch ", err)
+				break
+			}
+			d.setRemote(func(m map[string]string) {
+				for _, ev := range wresp.Events {
+					key := string(ev.Kv.Key)
+					if ev.Type == mvccpb.DELETE {
+						delete(m, key)
+						continue
+					}
+					if t, ok := remoteTarget(ev.Kv.Value); ok {
+						d.putRemote(key, t)
+					} else {
+						delete(m, key)
+					}
+				}
+			})
+		}
+		cancel()
+		time.Sleep(relistDelay)
+	}
+}
+
+func remoteTarget(value []byte) (t string, ok bool) {
+	if err := json.Unmarshal(value, &t); err != nil {
+		log.Printf("etcd value %q: %v", value, err)
+		return "", false
+	}
+	if _, err := parseTarget(t); err != nil {
+		log.Println("etcd ", err)
+		return "", false
+	}
+	return t, true
+}
+
+// putRemote sets the target of an etcd key, d.lock is held. Prefixes are
+// only proxied on the configured interfaces, without any they are dropped.
+func (d *daemon) putRemote(key, t string) {
+	if strings.Contains(t, "/") && len(d.cfg.Interfaces) == 0 {
+		log.Printf("etcd %s: prefix %s not proxied, no interfaces configured", key, t)
+	}
+	d.remote[key] = t
+}
+
+func (d *daemon) setRemote(update func(map[string]string)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	update(d.remote)
+	_ = d.apply()
+}
+
+// status lists the proxied targets, sorted
+func (d *daemon) status() []ndproxy.Target {
+	targets := ndproxy.Targets()
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Address != targets[j].Address {
+			return targets[i].Address < targets[j].Address
+		}
+		return targets[i].Interface < targets[j].Interface
+	})
+	return targets
+}
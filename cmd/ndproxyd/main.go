@@ -0,0 +1,90 @@
+// ndproxyd answers neighbor solicitations for the addresses and prefixes of
+// a config file and of an etcd prefix, and serves their counters.
+//
+//	ndproxyd -config /etc/ndproxyd.yaml
+//	curl --unix-socket /run/ndproxyd.sock http://ndproxyd/v1/status
+//
+// SIGHUP reloads the config.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/adoyee/go-utils/etcd"
+	"github.com/adoyee/go-utils/net/ndproxy"
+)
+
+// Status is what the status endpoint serves
+type Status struct {
+	Targets []ndproxy.Target `json:"targets"`
+}
+
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") {
+		_ = os.Remove(address)
+		return net.Listen("unix", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+func (d *daemon) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Status{Targets: d.status()})
+}
+
+func main() {
+	path := flag.String("config", "/etc/ndproxyd.yaml", "config file, .yaml or .toml")
+	flag.Parse()
+
+	d := newDaemon(*path)
+	if err := d.reload(); err != nil && d.cfg == nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c := d.cfg.Etcd; c != nil {
+		if err := etcd.InitEnv(ctx, c.Endpoints, c.Namespace, c.TTL); err != nil {
+			log.Fatal(err)
+		}
+		go d.watch(ctx, c.Prefix)
+	}
+
+	l, err := listen(d.cfg.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", d.serveStatus)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := d.reload(); err != nil {
+			log.Println("reload ", err)
+		}
+	}
+	_ = srv.Close()
+}
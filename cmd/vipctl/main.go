@@ -0,0 +1,168 @@
+// vipctl talks to the control API of vipd.
+//
+//	vipctl list
+//	vipctl add [-disabled] ADDRESS
+//	vipctl remove ADDRESS
+//	vipctl enable ADDRESS
+//	vipctl disable ADDRESS
+//	vipctl reload
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type client struct {
+	http *http.Client
+	base string
+}
+
+// newClient reaches vipd on a unix socket path or a host:port
+func newClient(address string) *client {
+	if !strings.HasPrefix(address, "/") {
+		return &client{http: http.DefaultClient, base: "http://" + address}
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", address)
+	}
+	return &client{
+		http: &http.Client{Transport: &http.Transport{DialContext: dial}},
+		base: "http://vipd",
+	}
+}
+
+func (c *client) do(method, path string, body, result interface{}) error {
+	var in io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+type vipStatus struct {
+	Address    string `json:"address"`
+	State      string `json:"state"`
+	Configured bool   `json:"configured"`
+	Stats      struct {
+		Replies     uint64
+		Denied      uint64
+		RateLimited uint64
+	} `json:"stats"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: vipctl [-s address] list | add [-disabled] ADDRESS | remove ADDRESS | enable ADDRESS | disable ADDRESS | reload\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	server := flag.String("s", "/run/vipd.sock", "vipd control API, a unix socket path or host:port")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	c := newClient(*server)
+
+	args := flag.Args()
+	address := func() string {
+		if len(args) != 2 {
+			usage()
+		}
+		return url.PathEscape(args[1])
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		var list []vipStatus
+		if err = c.do(http.MethodGet, "/v1/vips", nil, &list); err != nil {
+			break
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDRESS\tSTATE\tSOURCE\tREPLIES\tDENIED\tRATE LIMITED")
+		for _, v := range list {
+			source := "api"
+			if v.Configured {
+				source = "config"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", v.Address, v.State, source,
+				v.Stats.Replies, v.Stats.Denied, v.Stats.RateLimited)
+		}
+		err = w.Flush()
+	case "add":
+		fs := flag.NewFlagSet("add", flag.ExitOnError)
+		disabled := fs.Bool("disabled", false, "bind without announcing")
+		_ = fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		body := map[string]interface{}{"address": fs.Arg(0), "enabled": !*disabled}
+		err = c.do(http.MethodPost, "/v1/vips", body, nil)
+	case "remove":
+		err = c.do(http.MethodDelete, "/v1/vips/"+address(), nil, nil)
+	case "enable", "disable":
+		err = c.do(http.MethodPost, "/v1/vips/"+address()+"/"+args[0], nil, nil)
+	case "reload":
+		var result map[string][]string
+		if err = c.do(http.MethodPost, "/v1/reload", nil, &result); err != nil {
+			break
+		}
+		for _, change := range []string{"Added", "Adopted", "Removed", "Enabled", "Disabled"} {
+			if len(result[change]) != 0 {
+				fmt.Printf("%s: %s\n", strings.ToLower(change), strings.Join(result[change], " "))
+			}
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "vipctl:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adoyee/go-utils/net/vip"
+)
+
+// VIPStatus is what the API lists for a VIP
+type VIPStatus struct {
+	Address    string       `json:"address"`
+	State      string       `json:"state"`
+	Configured bool         `json:"configured"`
+	Stats      vip.Counters `json:"stats"`
+}
+
+// AddRequest adds a VIP over the API, it lasts until removed or the daemon
+// exits
+type AddRequest struct {
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+}
+
+// vipOps are the VIP operations of the API
+type vipOps interface {
+	List() []string
+	GetState(address string) (vip.State, error)
+	ReplyStats(address string) (vip.Counters, error)
+	Add(address string) error
+	Enable(address string) error
+	Disable(address string) error
+	Remove(address string) error
+}
+
+// packageVIPs are the VIPs of the process
+type packageVIPs struct{}
+
+func (packageVIPs) List() []string                                  { return vip.List() }
+func (packageVIPs) GetState(address string) (vip.State, error)      { return vip.GetState(address) }
+func (packageVIPs) ReplyStats(address string) (vip.Counters, error) { return vip.ReplyStats(address) }
+func (packageVIPs) Add(address string) error                        { return vip.Add(address) }
+func (packageVIPs) Enable(address string) error                     { return vip.Enable(address) }
+func (packageVIPs) Disable(address string) error                    { return vip.Disable(address) }
+func (packageVIPs) Remove(address string) error                     { return vip.Remove(address) }
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// handler serves the control API:
+//
+//	GET    /v1/vips                   list VIPs
+//	POST   /v1/vips                   add a VIP, body AddRequest
+//	DELETE /v1/vips/{address}         remove a VIP added over the API
+//	POST   /v1/vips/{address}/enable  announce a VIP added over the API
+//	POST   /v1/vips/{address}/disable withdraw the API's announcement
+//
+// The API's Enable of a VIP is a claim of its own, the config's and health
+// checks' stay as they are.
+//
+//	POST   /v1/reload                 reload the config
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/vips", d.serveVIPs)
+	mux.HandleFunc("/v1/vips/", d.serveVIP)
+	mux.HandleFunc("/v1/reload", d.serveReload)
+	return mux
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func replyError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *vip.StateError:
+		status = http.StatusConflict
+	case *requestError:
+		status = http.StatusBadRequest
+	}
+	if err == vip.ErrNotAdded {
+		status = http.StatusNotFound
+	}
+	reply(w, status, apiError{Error: err.Error()})
+}
+
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func (d *daemon) serveVIPs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]VIPStatus, 0)
+		for _, address := range d.vips.List() {
+			state, err := d.vips.GetState(address)
+			if err != nil {
+				continue
+			}
+			stats, _ := d.vips.ReplyStats(address)
+			list = append(list, VIPStatus{
+				Address:    address,
+				State:      state.String(),
+				Configured: d.configured(address),
+				Stats:      stats,
+			})
+		}
+		reply(w, http.StatusOK, list)
+	case http.MethodPost:
+		var req AddRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			replyError(w, &requestError{msg: err.Error()})
+			return
+		}
+		if err := d.add(req); err != nil {
+			replyError(w, err)
+			return
+		}
+		reply(w, http.StatusCreated, struct{}{})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *daemon) add(req AddRequest) (err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.added[req.Address]; ok {
+		return &requestError{msg: fmt.Sprintf("vip %s already added", req.Address)}
+	}
+
+	if err = d.vips.Add(req.Address); err != nil {
+		return
+	}
+	if req.Enabled {
+		if err = d.vips.Enable(req.Address); err != nil {
+			_ = d.vips.Remove(req.Address)
+			return
+		}
+	}
+	d.added[req.Address] = req.Enabled
+	return
+}
+
+// apiAdded fails for VIPs not added over the API, d.lock is held
+func (d *daemon) apiAdded(address string) (enabled bool, err error) {
+	enabled, ok := d.added[address]
+	if !ok {
+		err = &requestError{msg: fmt.Sprintf("vip %s not added over the API", address)}
+	}
+	return
+}
+
+func (d *daemon) remove(address string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	enabled, err := d.apiAdded(address)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		if err = d.vips.Disable(address); err != nil {
+			return err
+		}
+		d.added[address] = false
+	}
+	if err = d.vips.Remove(address); err != nil {
+		return err
+	}
+	delete(d.added, address)
+	return nil
+}
+
+// enable claims an Enable of the VIP once, however often it is called
+func (d *daemon) enable(address string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	enabled, err := d.apiAdded(address)
+	if err != nil || enabled {
+		return err
+	}
+	if err = d.vips.Enable(address); err != nil {
+		return err
+	}
+	d.added[address] = true
+	return nil
+}
+
+// disable drops the Enable claimed by enable
+func (d *daemon) disable(address string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	enabled, err := d.apiAdded(address)
+	if err != nil || !enabled {
+		return err
+	}
+	if err = d.vips.Disable(address); err != nil {
+		return err
+	}
+	d.added[address] = false
+	return nil
+}
+
+func (d *daemon) serveVIP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/vips/"), "/")
+	address := parts[0]
+
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		err = d.remove(address)
+	case len(parts) == 2 && parts[1] == "enable" && r.Method == http.MethodPost:
+		err = d.enable(address)
+	case len(parts) == 2 && parts[1] == "disable" && r.Method == http.MethodPost:
+		err = d.disable(address)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	reply(w, http.StatusOK, struct{}{})
+}
+
+func (d *daemon) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := d.reload()
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	reply(w, http.StatusOK, result)
+}
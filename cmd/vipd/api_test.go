@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adoyee/go-utils/net/vip"
+)
+
+// fakeVIPs counts the Adds and Enables of each VIP like a vip.Manager, fail
+// replaces the result of every operation
+type fakeVIPs struct {
+	refs    map[string]int
+	enables map[string]int
+	fail    error
+}
+
+func newFakeVIPs() *fakeVIPs {
+	return &fakeVIPs{refs: make(map[string]int), enables: make(map[string]int)}
+}
+
+func (f *fakeVIPs) List() (list []string) {
+	for address := range f.refs {
+		list = append(list, address)
+	}
+	return
+}
+
+func (f *fakeVIPs) GetState(address string) (vip.State, error) {
+	switch {
+	case f.refs[address] == 0:
+		return 0, vip.ErrNotAdded
+	case f.enables[address] == 0:
+		return vip.StateBound, nil
+	}
+	return vip.StateAnnounced, nil
+}
+
+func (f *fakeVIPs) ReplyStats(address string) (vip.Counters, error) {
+	return vip.Counters{}, nil
+}
+
+func (f *fakeVIPs) Add(address string) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	f.refs[address]++
+	return nil
+}
+
+func (f *fakeVIPs) Enable(address string) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	if f.refs[address] == 0 {
+		return vip.ErrNotAdded
+	}
+	f.enables[address]++
+	return nil
+}
+
+func (f *fakeVIPs) Disable(address string) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	if f.enables[address] == 0 {
+		return &vip.StateError{Address: address, Op: "disable", State: vip.StateBound}
+	}
+	f.enables[address]--
+	return nil
+}
+
+func (f *fakeVIPs) Remove(address string) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	if f.refs[address] == 0 {
+		return vip.ErrNotAdded
+	}
+	if f.refs[address]--; f.refs[address] == 0 {
+		delete(f.refs, address)
+	}
+	return nil
+}
+
+func TestAPI(t *testing.T) {
+	d := newDaemon("testdata/missing.yaml")
+	vips := newFakeVIPs()
+	d.vips = vips
+	// a VIP of the config, enabled by it
+	vips.refs["10.0.0.200"], vips.enables["10.0.0.200"] = 1, 1
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		fail   error
+		status int
+	}{
+		{"add", "POST", "/v1/vips", `{"address": "10.0.0.100"}`, nil, 201},
+		{"add twice", "POST", "/v1/vips", `{"address": "10.0.0.100"}`, nil, 400},
+		{"add bad JSON", "POST", "/v1/vips", `{"address":`, nil, 400},
+		{"add fails", "POST", "/v1/vips", `{"address": "10.0.0.101"}`, errors.New("no permission"), 500},
+		{"list", "GET", "/v1/vips", "", nil, 200},
+		{"list method", "PUT", "/v1/vips", "", nil, 405},
+		{"enable", "POST", "/v1/vips/10.0.0.100/enable", "", nil, 200},
+		{"enable twice", "POST", "/v1/vips/10.0.0.100/enable", "", nil, 200},
+		{"disable", "POST", "/v1/vips/10.0.0.100/disable", "", nil, 200},
+		{"disable twice", "POST", "/v1/vips/10.0.0.100/disable", "", nil, 200},
+		{"enable the config's", "POST", "/v1/vips/10.0.0.200/enable", "", nil, 400},
+		{"disable the config's", "POST", "/v1/vips/10.0.0.200/disable", "", nil, 400},
+		{"remove the config's", "DELETE", "/v1/vips/10.0.0.200", "", nil, 400},
+		{"enable conflicts", "POST", "/v1/vips/10.0.0.100/enable", "",
+			&vip.StateError{Address: "10.0.0.100", Op: "enable", State: vip.StateWithdrawn}, 409},
+		{"enable gone", "POST", "/v1/vips/10.0.0.100/enable", "", vip.ErrNotAdded, 404},
+		{"unknown op", "POST", "/v1/vips/10.0.0.100/flap", "", nil, 404},
+		{"remove", "DELETE", "/v1/vips/10.0.0.100", "", nil, 200},
+		{"remove twice", "DELETE", "/v1/vips/10.0.0.100", "", nil, 400},
+		{"reload fails", "POST", "/v1/reload", "", nil, 500},
+		{"reload method", "GET", "/v1/reload", "", nil, 405},
+	}
+
+	h := d.handler()
+	for _, c := range cases {
+		vips.fail = c.fail
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Fatalf("%s: status %d, want %d: %s", c.name, w.Code, c.status, w.Body)
+		}
+	}
+
+	// the config's VIP kept its Enable, the API's are gone
+	if vips.refs["10.0.0.200"] != 1 || vips.enables["10.0.0.200"] != 1 {
+		t.Fatalf("config's VIP %d refs, %d enables", vips.refs["10.0.0.200"], vips.enables["10.0.0.200"])
+	}
+	if vips.refs["10.0.0.100"] != 0 || vips.enables["10.0.0.100"] != 0 || len(d.added) != 0 {
+		t.Fatalf("API's VIP left %d refs, %d enables, added %v", vips.refs["10.0.0.100"], vips.enables["10.0.0.100"], d.added)
+	}
+}
+
+func TestAPIRemoveEnabled(t *testing.T) {
+	d := newDaemon("")
+	vips := newFakeVIPs()
+	d.vips = vips
+	h := d.handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/vips", strings.NewReader(`{"address": "fd00::100", "enabled": true}`)))
+	if w.Code != http.StatusCreated || vips.enables["fd00::100"] != 1 {
+		t.Fatalf("add: status %d, %d enables", w.Code, vips.enables["fd00::100"])
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/vips/fd00::100", nil))
+	if w.Code != http.StatusOK || vips.enables["fd00::100"] != 0 || vips.refs["fd00::100"] != 0 {
+		t.Fatalf("remove: status %d, %d enables, %d refs", w.Code, vips.enables["fd00::100"], vips.refs["fd00::100"])
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/adoyee/go-utils/net/vip"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultListen = "/run/vipd.sock"
+	// defaultHTTPStatus is the status http health checks expect
+	defaultHTTPStatus = 200
+)
+
+// Config is the file vipd loads, YAML unless its name ends in .toml
+type Config struct {
+	// Listen is the control API address, a path for a unix socket
+	Listen string `yaml:"listen" toml:"listen"`
+	// Interfaces ARP/NDP are answered on, all of them when empty
+	Interfaces    []string `yaml:"interfaces" toml:"interfaces"`
+	FilterTargets bool     `yaml:"filter_targets" toml:"filter_targets"`
+	// FlushNeighbors drops the neighbor entries of a VIP on takeover
+	FlushNeighbors bool `yaml:"flush_neighbors" toml:"flush_neighbors"`
+	// Sysctls is warn, manage or ignore, see vip.SysctlMode
+	Sysctls string `yaml:"sysctls" toml:"sysctls"`
+	// PurgeLeftovers removes VIP addresses an earlier vipd left behind and
+	// the config lacks, the ones it has are taken over either way
+	PurgeLeftovers bool `yaml:"purge_leftovers" toml:"purge_leftovers"`
+	// ReplyRate limits the replies of all VIPs per second, 0 is unlimited
+	ReplyRate  float64 `yaml:"reply_rate" toml:"reply_rate"`
+	ReplyBurst int     `yaml:"reply_burst" toml:"reply_burst"`
+
+	// Routes installs a route per enabled VIP for a routing daemon
+	Routes *RoutesConfig `yaml:"routes" toml:"routes"`
+
+	VIPs    []VIPConfig    `yaml:"vips" toml:"vips"`
+	Subnets []SubnetConfig `yaml:"subnets" toml:"subnets"`
+}
+
+// RoutesConfig is a vip.RouteAnnouncer
+type RoutesConfig struct {
+	Table    int    `yaml:"table" toml:"table"`
+	Device   string `yaml:"device" toml:"device"`
+	Protocol int    `yaml:"protocol" toml:"protocol"`
+	Metric   int    `yaml:"metric" toml:"metric"`
+}
+
+type VIPConfig struct {
+	Address string `yaml:"address" toml:"address"`
+	// Disabled VIPs are bound but not announced
+	Disabled   bool              `yaml:"disabled" toml:"disabled"`
+	VirtualMAC *VirtualMACConfig `yaml:"virtual_mac" toml:"virtual_mac"`
+	Policy     *PolicyConfig     `yaml:"policy" toml:"policy"`
+	Balance    *BalanceConfig    `yaml:"balance" toml:"balance"`
+	Health     *HealthConfig     `yaml:"health" toml:"health"`
+	Binding    *BindingConfig    `yaml:"binding" toml:"binding"`
+}
+
+type VirtualMACConfig struct {
+	VRID uint8 `yaml:"vrid" toml:"vrid"`
+	// Mode is macvlan or spoof
+	Mode string `yaml:"mode" toml:"mode"`
+}
+
+type BindingConfig struct {
+	// Mode is lo, dummy, interface or none
+	Mode      string `yaml:"mode" toml:"mode"`
+	Device    string `yaml:"device" toml:"device"`
+	PrefixLen int    `yaml:"prefix_len" toml:"prefix_len"`
+}
+
+type PolicyConfig struct {
+	Allow       []string `yaml:"allow" toml:"allow"`
+	Deny        []string `yaml:"deny" toml:"deny"`
+	SourceRate  float64  `yaml:"source_rate" toml:"source_rate"`
+	SourceBurst int      `yaml:"source_burst" toml:"source_burst"`
+}
+
+type BalanceConfig struct {
+	Self    string   `yaml:"self" toml:"self"`
+	Members []string `yaml:"members" toml:"members"`
+}
+
+// HealthConfig is one of TCP, HTTP or Exec
+type HealthConfig struct {
+	TCP  string `yaml:"tcp" toml:"tcp"`
+	HTTP string `yaml:"http" toml:"http"`
+	// HTTPStatus is the status HTTP expects, 200 by default
+	HTTPStatus int      `yaml:"http_status" toml:"http_status"`
+	Exec       []string `yaml:"exec" toml:"exec"`
+	Interval   Duration `yaml:"interval" toml:"interval"`
+	Timeout    Duration `yaml:"timeout" toml:"timeout"`
+	Rise       int      `yaml:"rise" toml:"rise"`
+	Fall       int      `yaml:"fall" toml:"fall"`
+}
+
+type SubnetConfig struct {
+	CIDR    string   `yaml:"cidr" toml:"cidr"`
+	Exclude []string `yaml:"exclude" toml:"exclude"`
+}
+
+// Duration reads "2s" style durations in both formats
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+func loadConfig(path string) (c *Config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	c = new(Config)
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = decodeTOML(data, c)
+	} else {
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Listen == "" {
+		c.Listen = defaultListen
+	}
+	for _, v := range c.VIPs {
+		if v.Health != nil && v.Health.HTTP != "" && v.Health.HTTPStatus == 0 {
+			v.Health.HTTPStatus = defaultHTTPStatus
+		}
+	}
+	if err = c.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+// decodeTOML rejects keys c has no field for, like yaml.UnmarshalStrict
+func decodeTOML(data []byte, c *Config) error {
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		return err
+	}
+	if keys := md.Undecoded(); len(keys) != 0 {
+		return fmt.Errorf("unknown keys %v", keys)
+	}
+	return nil
+}
+
+func (c *Config) check() error {
+	if _, err := c.sysctlMode(); err != nil {
+		return err
+	}
+	if c.Routes != nil && c.Routes.Table <= 0 {
+		return fmt.Errorf("routes need a table")
+	}
+	seen := make(map[string]bool)
+	for _, v := range c.VIPs {
+		if v.Address == "" {
+			return fmt.Errorf("vip without address")
+		}
+		if seen[v.Address] {
+			return fmt.Errorf("vip %s listed twice", v.Address)
+		}
+		seen[v.Address] = true
+
+		if v.VirtualMAC != nil {
+			if _, err := v.VirtualMAC.mode(); err != nil {
+				return fmt.Errorf("vip %s: %v", v.Address, err)
+			}
+		}
+		if v.Binding != nil {
+			if _, err := v.Binding.binding(); err != nil {
+				return fmt.Errorf("vip %s: %v", v.Address, err)
+			}
+		}
+		if v.Health != nil {
+			if _, err := v.Health.checker(); err != nil {
+				return fmt.Errorf("vip %s: %v", v.Address, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) sysctlMode() (vip.SysctlMode, error) {
+	switch c.Sysctls {
+	case "", "warn":
+		return vip.SysctlWarn, nil
+	case "manage":
+		return vip.SysctlManage, nil
+	case "ignore":
+		return vip.SysctlIgnore, nil
+	}
+	return 0, fmt.Errorf("unknown sysctls mode %q", c.Sysctls)
+}
+
+func (c *VirtualMACConfig) mode() (vip.VirtualMACMode, error) {
+	switch c.Mode {
+	case "", "macvlan":
+		return vip.VirtualMACMacvlan, nil
+	case "spoof":
+		return vip.VirtualMACSpoof, nil
+	}
+	return 0, fmt.Errorf("unknown virtual mac mode %q", c.Mode)
+}
+
+func (c *BindingConfig) binding() (b vip.Binding, err error) {
+	b = vip.Binding{Device: c.Device, PrefixLen: c.PrefixLen}
+	switch c.Mode {
+	case "", "lo":
+		b.Mode = vip.BindLoopback
+	case "dummy":
+		b.Mode = vip.BindDummy
+	case "interface":
+		b.Mode = vip.BindInterface
+	case "none":
+		b.Mode = vip.BindNone
+	default:
+		err = fmt.Errorf("unknown binding mode %q", c.Mode)
+	}
+	return
+}
+
+func (c *RoutesConfig) announcer() *vip.RouteAnnouncer {
+	r := vip.NewRouteAnnouncer(c.Table)
+	r.Device, r.Protocol, r.Metric = c.Device, c.Protocol, c.Metric
+	return r
+}
+
+func (c *PolicyConfig) policy() vip.Policy {
+	return vip.Policy{
+		Allow:       c.Allow,
+		Deny:        c.Deny,
+		SourceRate:  c.SourceRate,
+		SourceBurst: c.SourceBurst,
+	}
+}
+
+func (c *HealthConfig) checker() (vip.Checker, error) {
+	set := 0
+	for _, ok := range []bool{c.TCP != "", c.HTTP != "", len(c.Exec) != 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("health needs exactly one of tcp, http and exec")
+	}
+
+	switch {
+	case c.TCP != "":
+		return vip.TCPCheck(c.TCP), nil
+	case c.HTTP != "":
+		return vip.HTTPCheck(c.HTTP, c.HTTPStatus), nil
+	}
+	return vip.ExecCheck(c.Exec[0], c.Exec[1:]...), nil
+}
+
+func (c *HealthConfig) healthCheck() (hc vip.HealthCheck, err error) {
+	checker, err := c.checker()
+	if err != nil {
+		return
+	}
+	return vip.HealthCheck{
+		Checker:  checker,
+		Interval: c.Interval.Duration,
+		Timeout:  c.Timeout.Duration,
+		Rise:     c.Rise,
+		Fall:     c.Fall,
+	}, nil
+}
+
+// options are the settings fixed when the VIP is added
+func (c *VIPConfig) options() (opts []vip.Option) {
+	if c.VirtualMAC != nil {
+		mode, _ := c.VirtualMAC.mode()
+		opts = append(opts, vip.WithVirtualMAC(c.VirtualMAC.VRID, mode))
+	}
+	if c.Policy != nil {
+		opts = append(opts, vip.WithPolicy(c.Policy.policy()))
+	}
+	if c.Balance != nil {
+		opts = append(opts, vip.WithBalance(c.Balance.Self, c.Balance.Members))
+	}
+	if c.Binding != nil {
+		b, _ := c.Binding.binding()
+		opts = append(opts, vip.WithBinding(b))
+	}
+	return
+}
+
+// specs are what Reconcile holds, VIPs with a health check are only bound,
+// the check announces them
+func (c *Config) specs() (specs []vip.VIPSpec) {
+	for i := range c.VIPs {
+		v := &c.VIPs[i]
+		specs = append(specs, vip.VIPSpec{
+			Address: v.Address,
+			Enabled: !v.Disabled && v.Health == nil,
+			Options: v.options(),
+		})
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const yamlConfig = `
+listen: 127.0.0.1:9180
+interfaces: [eth0]
+reply_rate: 1000
+vips:
+  - address: 10.0.0.100
+    virtual_mac: {vrid: 5, mode: spoof}
+    policy:
+      deny: [10.0.0.0/24]
+  - address: fd00::100
+    disabled: true
+    binding: {mode: dummy, device: vip1}
+  - address: 10.0.0.101
+    balance: {self: a, members: [a, b]}
+    health:
+      tcp: 127.0.0.1:80
+      interval: 500ms
+      rise: 2
+subnets:
+  - cidr: 10.1.0.0/24
+    exclude: [10.1.0.1]
+`
+
+const tomlConfig = `
+interfaces = ["eth0"]
+
+[[vips]]
+address = "10.0.0.100"
+
+[vips.virtual_mac]
+vrid = 5
+mode = "spoof"
+
+[vips.policy]
+deny = ["10.0.0.0/24"]
+
+[[vips]]
+address = "fd00::100"
+disabled = true
+
+[vips.binding]
+mode = "dummy"
+device = "vip1"
+
+[[vips]]
+address = "10.0.0.101"
+
+[vips.balance]
+self = "a"
+members = ["a", "b"]
+
+[vips.health]
+tcp = "127.0.0.1:80"
+interval = "500ms"
+rise = 2
+`
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"vipd.yaml": yamlConfig, "vipd.toml": tomlConfig} {
+		t.Run(name, func(t *testing.T) {
+			c, err := loadConfig(writeConfig(t, dir, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.VIPs) != 3 || len(c.Interfaces) != 1 {
+				t.Fatalf("config %+v", c)
+			}
+			if c.VIPs[0].VirtualMAC.VRID != 5 || c.VIPs[0].Policy.Deny[0] != "10.0.0.0/24" {
+				t.Fatalf("vip %+v", c.VIPs[0])
+			}
+			if hc := c.VIPs[2].Health; hc.Interval.Duration != 500*time.Millisecond || hc.Rise != 2 {
+				t.Fatalf("health %+v", hc)
+			}
+
+			// only the VIP without a check or disabled is enabled by Reconcile
+			specs := c.specs()
+			if len(specs) != 3 || !specs[0].Enabled || specs[1].Enabled || specs[2].Enabled {
+				t.Fatalf("specs %+v", specs)
+			}
+			if len(specs[0].Options) != 2 || len(specs[1].Options) != 1 || len(specs[2].Options) != 1 {
+				t.Fatalf("options %d, %d and %d", len(specs[0].Options), len(specs[1].Options), len(specs[2].Options))
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"unknown field":    "vips:\n  - address: 10.0.0.1\n    enable: true\n",
+		"twice":            "vips:\n  - address: 10.0.0.1\n  - address: 10.0.0.1\n",
+		"no address":       "vips:\n  - disabled: true\n",
+		"mode":             "vips:\n  - address: 10.0.0.1\n    virtual_mac: {vrid: 1, mode: bridge}\n",
+		"two checks":       "vips:\n  - address: 10.0.0.1\n    health: {tcp: ':80', exec: [true]}\n",
+		"invalid duration": "vips:\n  - address: 10.0.0.1\n    health: {tcp: ':80', interval: soon}\n",
+		"sysctls":          "sysctls: fix\n",
+		"binding":          "vips:\n  - address: 10.0.0.1\n    binding: {mode: nic}\n",
+		"routes":           "routes: {device: lo}\n",
+	}
+	for name, content := range cases {
+		if _, err := loadConfig(writeConfig(t, dir, "vipd.yaml", content)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, err := loadConfig(writeConfig(t, dir, "vipd.toml", "[[vips]]\naddress = \"10.0.0.1\"\nenable = true\n")); err == nil {
+		t.Error("unknown TOML field: loaded")
+	}
+}
+
+func TestLoadConfigHTTPStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const content = `
+vips:
+  - address: 10.0.0.100
+    health: {http: "http://127.0.0.1/health"}
+  - address: 10.0.0.101
+    health: {http: "http://127.0.0.1/health", http_status: 204}
+  - address: 10.0.0.102
+    health: {tcp: 127.0.0.1:80}
+`
+	c, err := loadConfig(writeConfig(t, dir, "vipd.yaml", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{defaultHTTPStatus, 204, 0} {
+		if got := c.VIPs[i].Health.HTTPStatus; got != want {
+			t.Errorf("%s: http status %d, want %d", c.VIPs[i].Address, got, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/adoyee/go-utils/net/vip"
+)
+
+// daemon applies configs to the VIPs of the process and keeps what it
+// applied, so a reload only touches what changed
+type daemon struct {
+	path string
+
+	lock       sync.Mutex
+	cfg        *Config
+	interfaces map[string]bool
+	health     map[string]HealthConfig
+	subnets    map[string]SubnetConfig
+	routes     *vip.RouteAnnouncer
+	// added are the VIPs added over the API, held apart from the config,
+	// and whether the API enabled them
+	added map[string]bool
+	// vips are what the API acts on, tests replace them
+	vips vipOps
+}
+
+func newDaemon(path string) *daemon {
+	return &daemon{
+		path:       path,
+		interfaces: make(map[string]bool),
+		health:     make(map[string]HealthConfig),
+		subnets:    make(map[string]SubnetConfig),
+		added:      make(map[string]bool),
+		vips:       packageVIPs{},
+	}
+}
+
+// reload reads the config file again and applies it
+func (d *daemon) reload() (result *vip.ReconcileResult, err error) {
+	cfg, err := loadConfig(d.path)
+	if err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.cfg != nil && d.cfg.Listen != cfg.Listen {
+		log.Printf("listen %s kept, changing it needs a restart", d.cfg.Listen)
+		cfg.Listen = d.cfg.Listen
+	}
+	result, err = d.apply(cfg)
+	d.cfg = cfg
+	return
+}
+
+// apply attempts every setting, the first error is returned
+func (d *daemon) apply(cfg *Config) (result *vip.ReconcileResult, err error) {
+	keep := func(e error) {
+		if e == nil {
+			return
+		}
+		log.Println(e)
+		if err == nil {
+			err = e
+		}
+	}
+
+	want := make(map[string]bool)
+	for _, name := range cfg.Interfaces {
+		want[name] = true
+		if !d.interfaces[name] {
+			if e := vip.VipInterface(name); e != nil {
+				keep(e)
+				continue
+			}
+			d.interfaces[name] = true
+		}
+	}
+	for name := range d.interfaces {
+		if !want[name] {
+			log.Printf("interface %s kept, removing it needs a restart", name)
+		}
+	}
+	keep(vip.FilterTargets(cfg.FilterTargets))
+	vip.FlushNeighbors(cfg.FlushNeighbors)
+	mode, _ := cfg.sysctlMode()
+	keep(vip.SetSysctlMode(mode))
+	vip.SetReplyRate(cfg.ReplyRate, cfg.ReplyBurst)
+	keep(d.applyRoutes(cfg.Routes))
+
+	// a changed check starts over, the old one gives up its Enable first
+	health := make(map[string]HealthConfig)
+	for _, v := range cfg.VIPs {
+		if v.Health != nil && !v.Disabled {
+			health[v.Address] = *v.Health
+		}
+	}
+	for address, hc := range d.health {
+		if cur, ok := health[address]; !ok || !reflect.DeepEqual(cur, hc) {
+			keep(vip.DetachHealthCheck(address))
+			delete(d.health, address)
+		}
+	}
+
+	result, e := vip.Reconcile(cfg.specs(), vip.ReconcileOptions{PurgeLeftovers: cfg.PurgeLeftovers})
+	keep(e)
+
+	for _, v := range cfg.VIPs {
+		if _, e := vip.GetState(v.Address); e != nil {
+			continue
+		}
+		// options only apply when a VIP is added, these follow the config
+		var p vip.Policy
+		if v.Policy != nil {
+			p = v.Policy.policy()
+		}
+		keep(vip.SetPolicy(v.Address, p))
+		var b BalanceConfig
+		if v.Balance != nil {
+			b = *v.Balance
+		}
+		keep(vip.SetBalance(v.Address, b.Self, b.Members))
+
+		hc, ok := health[v.Address]
+		if _, attached := d.health[v.Address]; !ok || attached {
+			continue
+		}
+		check, e := hc.healthCheck()
+		if e == nil {
+			e = vip.AttachHealthCheck(v.Address, check)
+		}
+		if e != nil {
+			keep(e)
+			continue
+		}
+		d.health[v.Address] = hc
+	}
+
+	subnets := make(map[string]SubnetConfig)
+	for _, s := range cfg.Subnets {
+		subnets[s.CIDR] = s
+	}
+	for cidr, s := range d.subnets {
+		if cur, ok := subnets[cidr]; !ok || !reflect.DeepEqual(cur, s) {
+			keep(vip.DisableSubnet(cidr))
+			delete(d.subnets, cidr)
+		}
+	}
+	for cidr, s := range subnets {
+		if _, ok := d.subnets[cidr]; ok {
+			continue
+		}
+		if e := vip.EnableSubnet(cidr, s.Exclude...); e != nil {
+			keep(e)
+			continue
+		}
+		d.subnets[cidr] = s
+	}
+	return
+}
+
+// configured tells whether the config holds the VIP
+func (d *daemon) configured(address string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.cfg == nil {
+		return false
+	}
+	for _, v := range d.cfg.VIPs {
+		if v.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRoutes replaces the route announcer when its settings change
+func (d *daemon) applyRoutes(c *RoutesConfig) (err error) {
+	var want *vip.RouteAnnouncer
+	if c != nil {
+		want = c.announcer()
+	}
+	if reflect.DeepEqual(want, d.routes) {
+		return
+	}
+
+	if d.routes != nil {
+		if err = vip.RemoveAnnouncer(d.routes); err != nil {
+			return
+		}
+		d.routes = nil
+	}
+	if want != nil {
+		// added even if announcing some VIP failed
+		err = vip.AddAnnouncer(want)
+		d.routes = want
+	}
+	return
+}
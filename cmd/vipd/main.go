@@ -0,0 +1,74 @@
+// vipd holds the VIPs of a config file and serves a control API for vipctl.
+//
+//	vipd -config /etc/vipd.yaml
+//
+// SIGHUP reloads the config, SIGINT and SIGTERM exit, leaving the VIPs bound
+// for the next vipd to adopt.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/adoyee/go-utils/net/vip"
+)
+
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") {
+		_ = os.Remove(address)
+		return net.Listen("unix", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+func main() {
+	path := flag.String("config", "/etc/vipd.yaml", "config file, .yaml or .toml")
+	flag.Parse()
+
+	d := newDaemon(*path)
+	if _, err := d.reload(); err != nil {
+		// a partly applied config is still served, fix it and reload
+		if d.cfg == nil {
+			log.Fatal(err)
+		}
+	}
+
+	go func() {
+		events, _ := vip.HealthEvents()
+		for e := range events {
+			log.Printf("vip %s healthy %v %v", e.Address, e.Healthy, e.Err)
+		}
+	}()
+
+	l, err := listen(d.cfg.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: d.handler()}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		result, err := d.reload()
+		if err != nil {
+			log.Println("reload ", err)
+			continue
+		}
+		log.Printf("reloaded %+v", *result)
+	}
+	_ = srv.Close()
+}
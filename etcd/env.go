@@ -6,22 +6,51 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/concurrency"
 	nm "github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 )
 
+// regrantDelay spaces the attempts to get a new lease after losing one
+const regrantDelay = time.Second
+
 var (
 	defaultEnv  *Env
 	KeyNotExist = errors.New("key not exists")
 )
 
 type Env struct {
-	cli     *clientv3.Client
-	lease   clientv3.Lease
+	cli   *clientv3.Client
+	lease clientv3.Lease
+	ctx   context.Context
+	ttl   int64
+	// writes go to the client, session opens a session on a lease, tests
+	// replace both
+	writes  writer
+	session func(clientv3.LeaseID) (*concurrency.Session, error)
+
+	// writeLock serializes PutWithLease, Delete and each put of regrant,
+	// so putting the keys again cannot bring back a deleted or older value
+	writeLock sync.Mutex
+	// lock guards the lease, the session and what depends on them
+	lock    sync.Mutex
 	leaseID clientv3.LeaseID
 	sess    *concurrency.Session
+	// owned are the values of PutWithLease, put again on a new lease
+	owned map[string]string
+	// regranted are the owned keys put on the new lease while regranting,
+	// PutWithLease drops its key from it
+	regranted map[string]bool
+	// lost is closed when the current lease is lost
+	lost        chan struct{}
+	onLost      []func()
+	onRecovered []func(clientv3.LeaseID)
+	// done is closed when ctx is done and no lease is kept anymore
+	done chan struct{}
 }
 
 func newEnv(ctx context.Context, ep []string, namespace string, ttl int64) (env *Env, err error) {
@@ -29,8 +58,6 @@ func newEnv(ctx context.Context, ep []string, namespace string, ttl int64) (env
 		config clientv3.Config
 		cli    *clientv3.Client
 		lease  clientv3.Lease
-		resp   *clientv3.LeaseGrantResponse
-		sess   *concurrency.Session
 	)
 
 	config.Endpoints = ep
@@ -45,40 +72,207 @@ func newEnv(ctx context.Context, ep []string, namespace string, ttl int64) (env
 	cli.Watcher = nm.NewWatcher(cli.Watcher, namespace)
 
 	lease = clientv3.NewLease(cli)
-	resp, err = lease.Grant(ctx, ttl)
+	e := &Env{
+		cli:    cli,
+		lease:  lease,
+		ctx:    ctx,
+		ttl:    ttl,
+		writes: clientWriter{kv: cli.KV},
+		session: func(id clientv3.LeaseID) (*concurrency.Session, error) {
+			return concurrency.NewSession(cli, concurrency.WithLease(id))
+		},
+		owned: make(map[string]string),
+		lost:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	resp, sess, ch, err := e.grant()
 	if err != nil {
 		_ = lease.Close()
 		return
 	}
+	e.leaseID, e.sess = resp.ID, sess
+	env = e
 
-	sess, err = concurrency.NewSession(cli, concurrency.WithLease(resp.ID))
-	if err != nil {
-		_ = lease.Close()
+	go env.keepAlive(ch)
+
+	return
+}
+
+// writer writes the keys of an Env
+type writer interface {
+	put(ctx context.Context, key, value string, lease clientv3.LeaseID) error
+	delete(ctx context.Context, key string, opts ...clientv3.OpOption) error
+}
+
+type clientWriter struct {
+	kv clientv3.KV
+}
+
+func (w clientWriter) put(ctx context.Context, key, value string, lease clientv3.LeaseID) (err error) {
+	_, err = w.kv.Put(ctx, key, value, clientv3.WithLease(lease))
+	return
+}
+
+func (w clientWriter) delete(ctx context.Context, key string, opts ...clientv3.OpOption) (err error) {
+	_, err = w.kv.Delete(ctx, key, opts...)
+	return
+}
+
+// grant gets a lease with a session on it and keeps it alive
+func (env *Env) grant() (
+	resp *clientv3.LeaseGrantResponse, sess *concurrency.Session, ch <-chan *clientv3.LeaseKeepAliveResponse, err error) {
+	if resp, err = env.lease.Grant(env.ctx, env.ttl); err != nil {
 		return
 	}
 
-	ch, err := lease.KeepAlive(ctx, resp.ID)
-	if err != nil {
-		_ = lease.Close()
+	if sess, err = env.session(resp.ID); err != nil {
 		return
 	}
 
-	env = &Env{
-		cli:     cli,
-		lease:   lease,
-		leaseID: resp.ID,
-		sess:    sess,
+	if ch, err = env.lease.KeepAlive(env.ctx, resp.ID); err != nil {
+		orphan(sess)
+		return
 	}
+	return
+}
+
+// orphan stops keeping sess alive, the lease goes on
+func orphan(sess *concurrency.Session) {
+	if sess != nil {
+		sess.Orphan()
+	}
+}
+
+// keepAlive drains the keep alive responses, the channel is closed when the
+// lease expires, e.g. after losing the connection for its TTL, or when ctx
+// is done
+func (env *Env) keepAlive(ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer close(env.done)
+	for {
+		for range ch {
+		}
+		if env.ctx.Err() != nil {
+			return
+		}
+
+		env.leaseLost()
+		if ch = env.regrant(); ch == nil {
+			return
+		}
+	}
+}
+
+func (env *Env) leaseLost() {
+	env.lock.Lock()
+	log.Printf("etcd lease %x lost", env.leaseID)
+	close(env.lost)
+	// the session's keys went with the lease, revoking it is pointless
+	orphan(env.sess)
+	callbacks := env.onLost
+	env.lock.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+}
 
-	go func() {
-		for {
-			_ = <-ch
+// regrant retries until it has a new lease and session, the keys of
+// PutWithLease are put again on it. It returns nil once ctx is done.
+func (env *Env) regrant() <-chan *clientv3.LeaseKeepAliveResponse {
+	for {
+		resp, sess, ch, err := env.grant()
+		if err == nil {
+			if err = env.putOwned(resp.ID, sess); err == nil {
+				log.Printf("etcd lease %x granted", resp.ID)
+				env.lock.Lock()
+				callbacks := env.onRecovered
+				env.lock.Unlock()
+				for _, fn := range callbacks {
+					fn(resp.ID)
+				}
+				return ch
+			}
+			// lost again before the keys were back
+			orphan(sess)
 		}
+
+		log.Println("etcd grant ", err)
+		if !env.wait(regrantDelay) {
+			return nil
+		}
+	}
+}
+
+// putOwned puts the keys of PutWithLease on the lease, retrying until they
+// are all put, and switches to it. It fails when ctx is done or the lease is
+// gone. Writers only wait for the put in flight, keys they change meanwhile
+// are put again.
+func (env *Env) putOwned(id clientv3.LeaseID, sess *concurrency.Session) error {
+	env.lock.Lock()
+	env.regranted = make(map[string]bool)
+	env.lock.Unlock()
+	defer func() {
+		env.lock.Lock()
+		env.regranted = nil
+		env.lock.Unlock()
 	}()
 
+	for {
+		env.writeLock.Lock()
+		k, v, ok := env.nextOwned()
+		if !ok {
+			// all keys are on the lease, writers use it from now on
+			env.lock.Lock()
+			env.leaseID, env.sess = id, sess
+			env.lost = make(chan struct{})
+			env.lock.Unlock()
+			env.writeLock.Unlock()
+			return nil
+		}
+		err := env.writes.put(env.ctx, k, v, id)
+		if err == nil {
+			env.lock.Lock()
+			env.regranted[k] = true
+			env.lock.Unlock()
+		}
+		env.writeLock.Unlock()
+
+		if err == nil {
+			continue
+		}
+		if err == rpctypes.ErrLeaseNotFound {
+			return err
+		}
+		log.Printf("etcd put %s again: %v", k, err)
+		if !env.wait(regrantDelay) {
+			return env.ctx.Err()
+		}
+	}
+}
+
+// nextOwned returns an owned key not put on the new lease yet, writeLock is
+// held
+func (env *Env) nextOwned() (key, value string, ok bool) {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	for k, v := range env.owned {
+		if !env.regranted[k] {
+			return k, v, true
+		}
+	}
 	return
 }
 
+// wait sleeps for d, false tells ctx is done
+func (env *Env) wait(d time.Duration) bool {
+	select {
+	case <-env.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 func Client() *clientv3.Client {
 	return defaultEnv.Client()
 }
@@ -124,19 +318,78 @@ func (env *Env) Put(ctx context.Context, prefix string, v interface{}) (err erro
 	return
 }
 
+// PutWithLease puts a key which goes with the lease, it is put again on
+// the new lease after the lease is lost, until Delete
 func (env *Env) PutWithLease(ctx context.Context, prefix string, v interface{}) (err error) {
 	var buff []byte
 	buff, err = json.Marshal(v)
 	if err != nil {
 		return
 	}
-	_, err = env.cli.Put(ctx, prefix, string(buff), clientv3.WithLease(env.leaseID))
-	return
+
+	env.writeLock.Lock()
+	defer env.writeLock.Unlock()
+
+	env.lock.Lock()
+	env.owned[prefix] = string(buff)
+	// a regrant in progress puts it on the new lease as well
+	delete(env.regranted, prefix)
+	leaseID := env.leaseID
+	env.lock.Unlock()
+
+	return env.writes.put(ctx, prefix, string(buff), leaseID)
 }
 
 func (env *Env) Delete(ctx context.Context, prefix string, opts ...clientv3.OpOption) (err error) {
-	_, err = env.cli.Delete(ctx, prefix, opts...)
-	return
+	env.writeLock.Lock()
+	defer env.writeLock.Unlock()
+
+	env.disown(prefix, opts...)
+	return env.writes.delete(ctx, prefix, opts...)
+}
+
+// disown forgets the PutWithLease keys a Delete covers
+func (env *Env) disown(key string, opts ...clientv3.OpOption) {
+	end := string(clientv3.OpDelete(key, opts...).RangeBytes())
+
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	for k := range env.owned {
+		// an end of "\x00" is every key from key on
+		if k == key || (end != "" && k >= key && (end == "\x00" || k < end)) {
+			delete(env.owned, k)
+		}
+	}
+}
+
+// LeaseLost returns a channel closed when the current lease is lost, the
+// Env gets a new one meanwhile, LeaseLost has to be called again for it
+func (env *Env) LeaseLost() <-chan struct{} {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	return env.lost
+}
+
+// Done returns a channel closed when the Env's context is done, the lease
+// is not kept alive anymore then
+func (env *Env) Done() <-chan struct{} {
+	return env.done
+}
+
+// OnLeaseLost calls fn whenever the lease is lost, locks of Lock are gone
+// then
+func (env *Env) OnLeaseLost(fn func()) {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	env.onLost = append(env.onLost, fn)
+}
+
+// OnLeaseRecovered calls fn with the new lease once the keys of
+// PutWithLease are put again on it
+func (env *Env) OnLeaseRecovered(fn func(clientv3.LeaseID)) {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	env.onRecovered = append(env.onRecovered, fn)
 }
 
 func (env *Env) Exist(ctx context.Context, prefix string) (exist bool, err error) {
@@ -150,7 +403,10 @@ func (env *Env) Exist(ctx context.Context, prefix string) (exist bool, err error
 
 func (env *Env) Lock(ctx context.Context, prefix, check string) (key string, ok bool) {
 	var err error
-	mutex := concurrency.NewMutex(env.sess, prefix)
+	env.lock.Lock()
+	sess := env.sess
+	env.lock.Unlock()
+	mutex := concurrency.NewMutex(sess, prefix)
 	if err = mutex.Lock(ctx); err != nil {
 		return
 	}
@@ -236,3 +492,19 @@ func CountPrefix(ctx context.Context, prefix string, opts ...clientv3.OpOption)
 func Watch(ctx context.Context, prefix string, opts ...clientv3.OpOption) clientv3.WatchChan {
 	return defaultEnv.Watch(ctx, prefix, opts...)
 }
+
+func LeaseLost() <-chan struct{} {
+	return defaultEnv.LeaseLost()
+}
+
+func Done() <-chan struct{} {
+	return defaultEnv.Done()
+}
+
+func OnLeaseLost(fn func()) {
+	defaultEnv.OnLeaseLost(fn)
+}
+
+func OnLeaseRecovered(fn func(clientv3.LeaseID)) {
+	defaultEnv.OnLeaseRecovered(fn)
+}
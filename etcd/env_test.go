@@ -0,0 +1,284 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+func TestDisown(t *testing.T) {
+	cases := []struct {
+		name string
+		key  string
+		opts []clientv3.OpOption
+		want []string
+	}{
+		{"key", "a/1", nil, []string{"a/2", "a/3", "b/1"}},
+		{"missing key", "a", nil, []string{"a/1", "a/2", "a/3", "b/1"}},
+		{"prefix", "a/", []clientv3.OpOption{clientv3.WithPrefix()}, []string{"b/1"}},
+		{"from key", "a/2", []clientv3.OpOption{clientv3.WithFromKey()}, []string{"a/1"}},
+		{"range", "a/1", []clientv3.OpOption{clientv3.WithRange("a/3")}, []string{"a/3", "b/1"}},
+	}
+
+	for _, c := range cases {
+		env := &Env{owned: map[string]string{"a/1": "", "a/2": "", "a/3": "", "b/1": ""}}
+		env.disown(c.key, c.opts...)
+		var got []string
+		for k := range env.owned {
+			got = append(got, k)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: owned %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// fakeLease grants leases numbered from 1, expire ends the keep alive of one
+type fakeLease struct {
+	clientv3.Lease
+
+	lock   sync.Mutex
+	last   clientv3.LeaseID
+	alives map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse
+}
+
+func (l *fakeLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.last++
+	return &clientv3.LeaseGrantResponse{ID: l.last, TTL: ttl}, nil
+}
+
+func (l *fakeLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
+	l.alives[id] = ch
+	go func() {
+		<-ctx.Done()
+		l.expire(id)
+	}()
+	return ch, nil
+}
+
+func (l *fakeLease) expire(id clientv3.LeaseID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if ch, ok := l.alives[id]; ok {
+		close(ch)
+		delete(l.alives, id)
+	}
+}
+
+// fakeWriter records writes as "put key=value@lease" and "delete key",
+// puts on gone leases fail, puts on blocked ones tell waiting and wait for
+// the channel
+type fakeWriter struct {
+	lock    sync.Mutex
+	writes  []string
+	fails   int
+	gone    map[clientv3.LeaseID]bool
+	blocked map[clientv3.LeaseID]chan struct{}
+	waiting chan struct{}
+}
+
+func (w *fakeWriter) put(ctx context.Context, key, value string, lease clientv3.LeaseID) error {
+	w.lock.Lock()
+	block := w.blocked[lease]
+	w.lock.Unlock()
+	if block != nil {
+		w.waiting <- struct{}{}
+		<-block
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	switch {
+	case w.gone[lease]:
+		return rpctypes.ErrLeaseNotFound
+	case w.fails > 0:
+		w.fails--
+		return rpctypes.ErrTimeout
+	}
+	w.writes = append(w.writes, fmt.Sprintf("put %s=%s@%d", key, value, lease))
+	return nil
+}
+
+func (w *fakeWriter) delete(ctx context.Context, key string, opts ...clientv3.OpOption) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes = append(w.writes, "delete "+key)
+	return nil
+}
+
+func (w *fakeWriter) recorded() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.writes...)
+}
+
+// newFakeEnv returns an Env on a fake lease and writer, its sessions are nil
+func newFakeEnv(t *testing.T) (*Env, *fakeLease, *fakeWriter, chan clientv3.LeaseID) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lease := &fakeLease{alives: make(map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse)}
+	writes := &fakeWriter{
+		gone:    make(map[clientv3.LeaseID]bool),
+		blocked: make(map[clientv3.LeaseID]chan struct{}),
+		waiting: make(chan struct{}, 1),
+	}
+	env := &Env{
+		lease:   lease,
+		ctx:     ctx,
+		ttl:     1,
+		writes:  writes,
+		session: func(clientv3.LeaseID) (*concurrency.Session, error) { return nil, nil },
+		owned:   make(map[string]string),
+		lost:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	resp, _, ch, err := env.grant()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.leaseID = resp.ID
+	go env.keepAlive(ch)
+	t.Cleanup(func() {
+		cancel()
+		<-env.Done()
+	})
+
+	recovered := make(chan clientv3.LeaseID, 4)
+	env.OnLeaseRecovered(func(id clientv3.LeaseID) { recovered <- id })
+	return env, lease, writes, recovered
+}
+
+func nextLease(t *testing.T, recovered <-chan clientv3.LeaseID) clientv3.LeaseID {
+	t.Helper()
+	select {
+	case id := <-recovered:
+		return id
+	case <-time.After(5 * regrantDelay):
+		t.Fatal("lease not recovered")
+	}
+	return 0
+}
+
+func TestLeaseRecovered(t *testing.T) {
+	env, lease, writes, recovered := newFakeEnv(t)
+	lostCalls := make(chan struct{}, 4)
+	env.OnLeaseLost(func() { lostCalls <- struct{}{} })
+	if err := env.PutWithLease(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed put is retried on the new lease
+	lost := env.LeaseLost()
+	writes.lock.Lock()
+	writes.fails = 1
+	writes.lock.Unlock()
+	lease.expire(1)
+	<-lost
+	if id := nextLease(t, recovered); id != 2 {
+		t.Fatalf("recovered lease %d, want 2", id)
+	}
+
+	// a lease gone before the keys are back is replaced
+	writes.lock.Lock()
+	writes.gone[3] = true
+	writes.lock.Unlock()
+	lease.expire(2)
+	if id := nextLease(t, recovered); id != 4 {
+		t.Fatalf("recovered lease %d, want 4", id)
+	}
+
+	want := []string{`put k="v"@1`, `put k="v"@2`, `put k="v"@4`}
+	if got := writes.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("writes %v, want %v", got, want)
+	}
+	if n := len(lostCalls); n != 2 {
+		t.Fatalf("lost %d times, want 2", n)
+	}
+	select {
+	case <-env.LeaseLost():
+		t.Fatal("lease lost after recovering")
+	default:
+	}
+}
+
+func TestDeleteDuringRegrant(t *testing.T) {
+	env, lease, writes, recovered := newFakeEnv(t)
+	if err := env.PutWithLease(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the put on the new lease hangs until release
+	release := make(chan struct{})
+	writes.lock.Lock()
+	writes.blocked[2] = release
+	writes.lock.Unlock()
+	lease.expire(1)
+	<-writes.waiting
+
+	deleted := make(chan error)
+	go func() { deleted <- env.Delete(context.Background(), "k") }()
+	select {
+	case <-deleted:
+		t.Fatal("deleted while the key is put again")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	nextLease(t, recovered)
+
+	want := []string{`put k="v"@1`, `put k="v"@2`, "delete k"}
+	if got := writes.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("writes %v, want %v", got, want)
+	}
+}
+
+func TestDeleteDuringRetry(t *testing.T) {
+	env, lease, writes, recovered := newFakeEnv(t)
+	if err := env.PutWithLease(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the put on the new lease fails and is retried after regrantDelay
+	release := make(chan struct{})
+	writes.lock.Lock()
+	writes.blocked[2] = release
+	writes.fails = 1
+	writes.lock.Unlock()
+	lease.expire(1)
+	<-writes.waiting
+	close(release)
+
+	// writers wait for the put, not for the retry
+	start := time.Now()
+	if err := env.Delete(context.Background(), "k"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= regrantDelay/2 {
+		t.Fatalf("delete took %s", d)
+	}
+	if err := env.PutWithLease(context.Background(), "k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	nextLease(t, recovered)
+
+	// k2 went on the lost lease first, it is put again on the new one
+	want := []string{`put k="v"@1`, "delete k", `put k2="v2"@1`, `put k2="v2"@2`}
+	if got := writes.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("writes %v, want %v", got, want)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/adoyee/go-utils
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/coreos/etcd v3.3.22+incompatible
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
@@ -10,5 +11,8 @@ require (
 	github.com/gogo/protobuf v1.3.1 // indirect
 	github.com/google/uuid v1.1.1 // indirect
 	go.uber.org/zap v1.15.0 // indirect
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 	google.golang.org/grpc v1.26.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -1 +1,127 @@
+// Package arp encodes and decodes ARP packets and the link-layer frames
+// carrying them, for any hardware address length and with 802.1Q/802.1ad
+// VLAN tags.
 package arp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	OperationRequest = 1
+	OperationReply   = 2
+
+	HardwareTypeEthernet   = 1
+	HardwareTypeIEEE802    = 6
+	HardwareTypeInfiniband = 32
+
+	ProtocolTypeIPv4 = 0x0800
+
+	headerSize = 8
+)
+
+var (
+	ErrInvalidHardwareAddr = errors.New("invalid hardware address")
+	ErrInvalidIP           = errors.New("invalid IPv4 address")
+	ErrShortPacket         = errors.New("arp packet too short")
+)
+
+// Packet is an ARP packet for IPv4 over any hardware type.
+type Packet struct {
+	HardwareType       uint16
+	ProtocolType       uint16
+	Operation          uint16
+	SenderHardwareAddr net.HardwareAddr
+	SenderIP           net.IP
+	TargetHardwareAddr net.HardwareAddr
+	TargetIP           net.IP
+}
+
+// NewPacket creates an IPv4 ARP packet, hardware addresses must share the same length.
+func NewPacket(op, hwType uint16, srcHW net.HardwareAddr, srcIP net.IP, dstHW net.HardwareAddr, dstIP net.IP) (p *Packet, err error) {
+	if len(srcHW) == 0 || len(srcHW) > 0xff || len(srcHW) != len(dstHW) {
+		return nil, ErrInvalidHardwareAddr
+	}
+
+	if srcIP = srcIP.To4(); srcIP == nil {
+		return nil, ErrInvalidIP
+	}
+	if dstIP = dstIP.To4(); dstIP == nil {
+		return nil, ErrInvalidIP
+	}
+
+	p = &Packet{
+		HardwareType:       hwType,
+		ProtocolType:       ProtocolTypeIPv4,
+		Operation:          op,
+		SenderHardwareAddr: srcHW,
+		SenderIP:           srcIP,
+		TargetHardwareAddr: dstHW,
+		TargetIP:           dstIP,
+	}
+	return
+}
+
+func (p *Packet) MarshalBinary() (data []byte, err error) {
+	hl := len(p.SenderHardwareAddr)
+	if hl == 0 || hl > 0xff || hl != len(p.TargetHardwareAddr) {
+		return nil, ErrInvalidHardwareAddr
+	}
+
+	srcIP, dstIP := p.SenderIP.To4(), p.TargetIP.To4()
+	if srcIP == nil || dstIP == nil {
+		return nil, ErrInvalidIP
+	}
+
+	data = make([]byte, headerSize+2*hl+2*net.IPv4len)
+	binary.BigEndian.PutUint16(data[0:2], p.HardwareType)
+	binary.BigEndian.PutUint16(data[2:4], p.ProtocolType)
+	data[4] = uint8(hl)
+	data[5] = net.IPv4len
+	binary.BigEndian.PutUint16(data[6:8], p.Operation)
+
+	n := headerSize
+	n += copy(data[n:], p.SenderHardwareAddr)
+	n += copy(data[n:], srcIP)
+	n += copy(data[n:], p.TargetHardwareAddr)
+	copy(data[n:], dstIP)
+	return
+}
+
+// UnmarshalBinary decodes an IPv4 ARP packet, trailing padding is ignored.
+func (p *Packet) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < headerSize {
+		return ErrShortPacket
+	}
+
+	hl, pl := int(data[4]), int(data[5])
+	if pl != net.IPv4len {
+		return ErrInvalidIP
+	}
+	if hl == 0 {
+		return ErrInvalidHardwareAddr
+	}
+	if len(data) < headerSize+2*hl+2*pl {
+		return ErrShortPacket
+	}
+
+	p.HardwareType = binary.BigEndian.Uint16(data[0:2])
+	p.ProtocolType = binary.BigEndian.Uint16(data[2:4])
+	p.Operation = binary.BigEndian.Uint16(data[6:8])
+
+	// copy out so the packet does not alias a reused receive buffer
+	b := make([]byte, 2*hl+2*pl)
+	copy(b, data[headerSize:])
+
+	n := 0
+	p.SenderHardwareAddr = net.HardwareAddr(b[n : n+hl])
+	n += hl
+	p.SenderIP = net.IP(b[n : n+pl])
+	n += pl
+	p.TargetHardwareAddr = net.HardwareAddr(b[n : n+hl])
+	n += hl
+	p.TargetIP = net.IP(b[n : n+pl])
+	return
+}
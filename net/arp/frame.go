@@ -0,0 +1,101 @@
+package arp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	EtherTypeARP         = 0x0806
+	EtherTypeVLAN        = 0x8100
+	EtherTypeServiceVLAN = 0x88a8
+	EtherTypeQinQ        = 0x9100
+
+	macSize      = 6
+	headerLength = 14
+	tagLength    = 4
+	minFrameSize = 60
+)
+
+var (
+	Broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	ErrShortFrame = errors.New("ethernet frame too short")
+)
+
+// VLAN is an 802.1Q or 802.1ad tag, TCI holds priority, DEI and VLAN ID.
+type VLAN struct {
+	TPID uint16
+	TCI  uint16
+}
+
+func (v VLAN) ID() uint16 {
+	return v.TCI & 0x0fff
+}
+
+// Frame is an Ethernet II frame, VLAN tags are ordered outermost first.
+type Frame struct {
+	Destination net.HardwareAddr
+	Source      net.HardwareAddr
+	VLANs       []VLAN
+	EtherType   uint16
+	Payload     []byte
+}
+
+func isTag(etherType uint16) bool {
+	return etherType == EtherTypeVLAN || etherType == EtherTypeServiceVLAN || etherType == EtherTypeQinQ
+}
+
+// MarshalBinary encodes the frame, padding it to the Ethernet minimum size.
+func (f *Frame) MarshalBinary() (data []byte, err error) {
+	if len(f.Destination) != macSize || len(f.Source) != macSize {
+		return nil, ErrInvalidHardwareAddr
+	}
+
+	size := headerLength + tagLength*len(f.VLANs) + len(f.Payload)
+	if size < minFrameSize {
+		size = minFrameSize
+	}
+
+	data = make([]byte, size)
+	n := copy(data, f.Destination)
+	n += copy(data[n:], f.Source)
+	for _, v := range f.VLANs {
+		binary.BigEndian.PutUint16(data[n:n+2], v.TPID)
+		binary.BigEndian.PutUint16(data[n+2:n+4], v.TCI)
+		n += tagLength
+	}
+	binary.BigEndian.PutUint16(data[n:n+2], f.EtherType)
+	copy(data[n+2:], f.Payload)
+	return
+}
+
+// UnmarshalBinary decodes a frame, Payload aliases data.
+func (f *Frame) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < headerLength {
+		return ErrShortFrame
+	}
+
+	f.Destination = net.HardwareAddr(data[0:macSize])
+	f.Source = net.HardwareAddr(data[macSize : 2*macSize])
+	f.VLANs = f.VLANs[:0]
+
+	n := 2 * macSize
+	et := binary.BigEndian.Uint16(data[n : n+2])
+	for isTag(et) {
+		if len(data) < n+tagLength+2 {
+			return ErrShortFrame
+		}
+		f.VLANs = append(f.VLANs, VLAN{
+			TPID: et,
+			TCI:  binary.BigEndian.Uint16(data[n+2 : n+4]),
+		})
+		n += tagLength
+		et = binary.BigEndian.Uint16(data[n : n+2])
+	}
+
+	f.EtherType = et
+	f.Payload = data[n+2:]
+	return
+}
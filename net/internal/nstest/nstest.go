@@ -0,0 +1,367 @@
+// Package nstest joins two network namespaces with a veth pair for
+// integration tests of the packet paths, and probes one side from the other.
+// Tests are skipped unless run as root with iproute2 installed.
+package nstest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/adoyee/go-utils/net/arp"
+	"github.com/adoyee/go-utils/net/netns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ipCommand = "/usr/sbin/ip"
+	etherIPv6 = 0x86dd
+
+	icmpNeighborSolicitation  = 135
+	icmpNeighborAdvertisement = 136
+	optSourceLinkLayerAddress = 1
+	optTargetLinkLayerAddress = 2
+)
+
+var pairs int32
+
+// Side is one end of a Pair
+type Side struct {
+	// Name of the namespace, usable with ip -n
+	Name string
+	NS   *netns.Namespace
+	// Link is the veth end inside the namespace
+	Link  string
+	Index int
+	MAC   net.HardwareAddr
+}
+
+// Pair is two namespaces joined by a veth pair, Local runs the code under
+// test and Peer the probes
+type Pair struct {
+	Local *Side
+	Peer  *Side
+}
+
+// NewPair creates the namespaces, removed when the test ends
+func NewPair(t testing.TB) *Pair {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	if _, err := os.Stat(ipCommand); err != nil {
+		t.Skip("iproute2 not installed")
+	}
+
+	n := atomic.AddInt32(&pairs, 1)
+	p := &Pair{
+		Local: &Side{Name: fmt.Sprintf("nst%d-%d-l", os.Getpid(), n), Link: "veth0"},
+		Peer:  &Side{Name: fmt.Sprintf("nst%d-%d-p", os.Getpid(), n), Link: "veth1"},
+	}
+
+	for _, s := range []*Side{p.Local, p.Peer} {
+		s := s
+		run(t, "netns", "add", s.Name)
+		t.Cleanup(func() {
+			_ = s.NS.Close()
+			_ = exec.Command(ipCommand, "netns", "del", s.Name).Run()
+		})
+
+		ns, err := netns.Open(filepath.Join("/var/run/netns", s.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.NS = ns
+	}
+
+	run(t, "link", "add", p.Local.Link, "netns", p.Local.Name, "type", "veth",
+		"peer", "name", p.Peer.Link, "netns", p.Peer.Name)
+
+	for _, s := range []*Side{p.Local, p.Peer} {
+		s.IP(t, "link", "set", "lo", "up")
+		s.IP(t, "link", "set", s.Link, "up")
+		// no router or DAD noise on the wire
+		s.Sysctl(t, "ipv6/conf/all/accept_dad", "0")
+		s.Sysctl(t, "ipv6/conf/"+s.Link+"/accept_dad", "0")
+
+		err := s.NS.Do(func() error {
+			ifc, err := net.InterfaceByName(s.Link)
+			if err != nil {
+				return err
+			}
+			s.Index, s.MAC = ifc.Index, ifc.HardwareAddr
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func run(t testing.TB, args ...string) {
+	t.Helper()
+	if out, err := exec.Command(ipCommand, args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+}
+
+// IP runs the ip command in the namespace
+func (s *Side) IP(t testing.TB, args ...string) {
+	t.Helper()
+	run(t, append([]string{"-n", s.Name}, args...)...)
+}
+
+// Sysctl writes a net sysctl of the namespace, key is the path below
+// /proc/sys/net, e.g. ipv4/conf/all/arp_ignore
+func (s *Side) Sysctl(t testing.TB, key, value string) {
+	t.Helper()
+	err := s.NS.Do(func() error {
+		return ioutil.WriteFile(filepath.Join("/proc/sys/net", key), []byte(value), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// packetSocket opens an AF_PACKET socket on the side's link, reads time out
+func (s *Side) packetSocket(t testing.TB, protocol uint16) (fd int) {
+	t.Helper()
+	err := s.NS.Do(func() (err error) {
+		fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(protocol)))
+		if err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+		err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(protocol), Ifindex: s.Index})
+		if err != nil {
+			_ = syscall.Close(fd)
+			return os.NewSyscallError("bind", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// recv reads a frame until the deadline, nil when it passed
+func recv(fd int, buff []byte, deadline time.Time) []byte {
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil
+		}
+		tv := syscall.NsecToTimeval(wait.Nanoseconds())
+		_ = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+		n, from, err := syscall.Recvfrom(fd, buff, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		return buff[:n]
+	}
+}
+
+// ARP asks for target from src on the link, it returns the MAC of the first
+// reply or nil if none came in time
+func (s *Side) ARP(t testing.TB, src, target net.IP, timeout time.Duration) net.HardwareAddr {
+	t.Helper()
+	return s.ARPTagged(t, src, target, nil, timeout)
+}
+
+// ARPTagged is ARP with the request sent on the VLANs, outermost first
+func (s *Side) ARPTagged(t testing.TB, src, target net.IP, vlans []arp.VLAN, timeout time.Duration) net.HardwareAddr {
+	t.Helper()
+	fd := s.packetSocket(t, syscall.ETH_P_ALL)
+	defer syscall.Close(fd)
+
+	p, err := arp.NewPacket(arp.OperationRequest, arp.HardwareTypeEthernet, s.MAC, src,
+		make(net.HardwareAddr, len(s.MAC)), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &arp.Frame{Destination: arp.Broadcast, Source: s.MAC, VLANs: vlans, EtherType: arp.EtherTypeARP, Payload: pb}
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := &syscall.SockaddrLinklayer{Ifindex: s.Index, Halen: 6}
+	copy(to.Addr[:], arp.Broadcast)
+	if err = syscall.Sendto(fd, fb, 0, to); err != nil {
+		t.Fatal(os.NewSyscallError("sendto", err))
+	}
+
+	buff := make([]byte, 2048)
+	deadline := time.Now().Add(timeout)
+	for {
+		data := recv(fd, buff, deadline)
+		if data == nil {
+			return nil
+		}
+		reply, ok := parseARP(data)
+		if ok && reply.Operation == arp.OperationReply && reply.SenderIP.Equal(target) {
+			return reply.SenderHardwareAddr
+		}
+	}
+}
+
+func parseARP(data []byte) (p *arp.Packet, ok bool) {
+	var f arp.Frame
+	if f.UnmarshalBinary(data) != nil || f.EtherType != arp.EtherTypeARP {
+		return nil, false
+	}
+	p = new(arp.Packet)
+	if p.UnmarshalBinary(f.Payload) != nil {
+		return nil, false
+	}
+	return p, true
+}
+
+// Solicit sends a neighbor solicitation for target from src, it returns the
+// target link-layer address of the first advertisement or nil if none came
+// in time
+func (s *Side) Solicit(t testing.TB, src, target net.IP, timeout time.Duration) net.HardwareAddr {
+	t.Helper()
+
+	var conn *icmp.PacketConn
+	err := s.NS.Do(func() (err error) {
+		conn, err = icmp.ListenPacket("ip6:ipv6-icmp", src.String())
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ifc := &net.Interface{Index: s.Index, Name: s.Link}
+	pc := conn.IPv6PacketConn()
+	if err = pc.SetMulticastInterface(ifc); err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.SetMulticastHopLimit(255); err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.SetHopLimit(255); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 24, 32)
+	msg[0] = icmpNeighborSolicitation
+	copy(msg[8:24], target.To16())
+	msg = append(msg, optSourceLinkLayerAddress, 1)
+	msg = append(msg, s.MAC...)
+
+	t16 := target.To16()
+	group := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, t16[13], t16[14], t16[15]}
+	if _, err = pc.WriteTo(msg, &ipv6.ControlMessage{IfIndex: s.Index}, &net.IPAddr{IP: group}); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buff := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buff)
+		if err != nil {
+			return nil
+		}
+		if mac, ok := parseAdvertisement(buff[:n], target); ok {
+			return mac
+		}
+	}
+}
+
+// parseAdvertisement returns the target link-layer address of an
+// advertisement for target
+func parseAdvertisement(msg []byte, target net.IP) (mac net.HardwareAddr, ok bool) {
+	if len(msg) < 24 || msg[0] != icmpNeighborAdvertisement || !net.IP(msg[8:24]).Equal(target) {
+		return nil, false
+	}
+	opts := msg[24:]
+	for len(opts) >= 2 && opts[1] != 0 && int(opts[1])*8 <= len(opts) {
+		size := int(opts[1]) * 8
+		if opts[0] == optTargetLinkLayerAddress {
+			return append(net.HardwareAddr(nil), opts[2:size]...), true
+		}
+		opts = opts[size:]
+	}
+	return nil, true
+}
+
+// Sniffer watches the frames arriving on a side's link
+type Sniffer struct {
+	fd   int
+	buff []byte
+}
+
+// Sniff starts watching the link, frames before the call are not seen
+func (s *Side) Sniff(t testing.TB) *Sniffer {
+	t.Helper()
+	sn := &Sniffer{fd: s.packetSocket(t, syscall.ETH_P_ALL), buff: make([]byte, 9216)}
+	t.Cleanup(func() { _ = syscall.Close(sn.fd) })
+	return sn
+}
+
+// GratuitousARP waits for an unsolicited ARP announcing ip, it returns the
+// announced MAC or nil if none came in time
+func (sn *Sniffer) GratuitousARP(ip net.IP, timeout time.Duration) net.HardwareAddr {
+	deadline := time.Now().Add(timeout)
+	for {
+		data := recv(sn.fd, sn.buff, deadline)
+		if data == nil {
+			return nil
+		}
+		p, ok := parseARP(data)
+		if ok && p.SenderIP.Equal(ip) && p.TargetIP.Equal(ip) {
+			return p.SenderHardwareAddr
+		}
+	}
+}
+
+// UnsolicitedNA waits for an advertisement of ip sent to a multicast group,
+// it returns the advertised MAC or nil if none came in time
+func (sn *Sniffer) UnsolicitedNA(ip net.IP, timeout time.Duration) net.HardwareAddr {
+	deadline := time.Now().Add(timeout)
+	for {
+		data := recv(sn.fd, sn.buff, deadline)
+		if data == nil {
+			return nil
+		}
+		// ethernet, then a fixed IPv6 header straight followed by ICMPv6
+		if len(data) < 14+40+24 || binary.BigEndian.Uint16(data[12:14]) != etherIPv6 {
+			continue
+		}
+		ip6 := data[14:]
+		if ip6[6] != syscall.IPPROTO_ICMPV6 || !net.IP(ip6[24:40]).IsMulticast() {
+			continue
+		}
+		if mac, ok := parseAdvertisement(ip6[40:], ip); ok {
+			return mac
+		}
+	}
+}
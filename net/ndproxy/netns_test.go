@@ -0,0 +1,56 @@
+package ndproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adoyee/go-utils/net/internal/nstest"
+)
+
+func TestNamespaceProxy(t *testing.T) {
+	p := nstest.NewPair(t)
+	p.Local.IP(t, "address", "add", "fd00::1/64", "dev", p.Local.Link, "nodad")
+	p.Peer.IP(t, "address", "add", "fd00::2/64", "dev", p.Peer.Link, "nodad")
+	// the proxy binds to the address, which lives elsewhere on the node
+	p.Local.IP(t, "address", "add", "fd00::200/128", "dev", "lo", "nodad")
+	src, target := net.ParseIP("fd00::2"), net.ParseIP("fd00::200")
+
+	proxy := New(p.Local.NS)
+	// cleanups run in reverse, the proxy goes before its namespace
+	t.Cleanup(func() { _ = proxy.Close() })
+	if err := proxy.AddAddress(target.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.DelAddress(target.String())
+
+	if mac := p.Peer.Solicit(t, src, target, time.Second); !bytes.Equal(mac, p.Local.MAC) {
+		t.Fatalf("advertisement of %s, want %s", mac, p.Local.MAC)
+	}
+}
+
+func TestNamespacePrefix(t *testing.T) {
+	p := nstest.NewPair(t)
+	p.Local.IP(t, "address", "add", "fd00::1/64", "dev", p.Local.Link, "nodad")
+	p.Peer.IP(t, "address", "add", "fd00::2/64", "dev", p.Peer.Link, "nodad")
+	src := net.ParseIP("fd00::2")
+
+	proxy := New(p.Local.NS)
+	t.Cleanup(func() { _ = proxy.Close() })
+	if err := proxy.AddPrefix("fd00::100/120", p.Local.Link); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.DelPrefix("fd00::100/120", p.Local.Link)
+
+	for _, target := range []string{"fd00::105", "fd00::1ff"} {
+		if mac := p.Peer.Solicit(t, src, net.ParseIP(target), time.Second); !bytes.Equal(mac, p.Local.MAC) {
+			t.Fatalf("advertisement of %s for %s, want %s", mac, target, p.Local.MAC)
+		}
+	}
+
+	targets := proxy.Targets()
+	if len(targets) != 1 || targets[0].Interface != p.Local.Link || targets[0].Advertisements != 2 {
+		t.Fatalf("targets %+v", targets)
+	}
+}
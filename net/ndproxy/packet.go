@@ -2,6 +2,7 @@ package ndproxy
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
 
 	"golang.org/x/net/ipv6"
@@ -9,9 +10,12 @@ import (
 
 const (
 	neighborAdvertisementFlags = 0x60000000
-	advertisementSize          = 32
+	advertisementHeaderSize    = 24
+	optTargetLinkLayerAddress  = 2
 )
 
+var errLinkLayerAddress = errors.New("link-layer address too long for neighbor discovery option")
+
 type advertisement struct {
 	Type                  uint8  // 1 byte
 	Code                  uint8  // 1 byte
@@ -19,8 +23,7 @@ type advertisement struct {
 	Flags                 uint32 // 4 bytes
 	TargetAddress         net.IP // 16 bytes
 	OptType               uint8  // 1 byte
-	OptLength             uint8  // 1 byte
-	OptLinkerLayerAddress []byte // 6 bytes
+	OptLinkerLayerAddress []byte // variable, option omitted when empty
 	src                   net.IP
 }
 
@@ -29,28 +32,39 @@ func newAdvertisement(src, target net.IP, mac []byte) (ad *advertisement) {
 		Type:                  uint8(ipv6.ICMPTypeNeighborAdvertisement),
 		Flags:                 neighborAdvertisementFlags,
 		TargetAddress:         target,
-		OptType:               2,
-		OptLength:             1,
+		OptType:               optTargetLinkLayerAddress,
 		OptLinkerLayerAddress: mac,
 		src:                   src,
 	}
 	return
 }
 
-func (ad *advertisement) marshal() (data []byte) {
-	payload := make([]byte, advertisementSize)
+func (ad *advertisement) marshal() (data []byte, err error) {
+	target := ad.TargetAddress.To16()
+	if target == nil {
+		return nil, net.InvalidAddrError(ad.TargetAddress.String())
+	}
+
+	// option length is counted in units of 8 octets, including type and length
+	optLength := 0
+	if len(ad.OptLinkerLayerAddress) != 0 {
+		optLength = (2 + len(ad.OptLinkerLayerAddress) + 7) / 8
+		if optLength > 0xff {
+			return nil, errLinkLayerAddress
+		}
+	}
+
+	payload := make([]byte, advertisementHeaderSize+optLength*8)
 	payload[0] = ad.Type
 	payload[1] = ad.Code
 	binary.BigEndian.PutUint16(payload[2:4], ad.CheckSum)
 	binary.BigEndian.PutUint32(payload[4:8], ad.Flags)
-	for i := 0; i < 16; i++ {
-		payload[8+i] = ad.TargetAddress[i]
-	}
+	copy(payload[8:24], target)
 
-	payload[24] = ad.OptType
-	payload[25] = ad.OptLength
-	for i := 0; i < 6; i++ {
-		payload[26+i] = ad.OptLinkerLayerAddress[i]
+	if optLength != 0 {
+		payload[24] = ad.OptType
+		payload[25] = uint8(optLength)
+		copy(payload[26:], ad.OptLinkerLayerAddress)
 	}
-	return payload
+	return payload, nil
 }
@@ -0,0 +1,371 @@
+package ndproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/adoyee/go-utils/net/pcap"
+	"github.com/adoyee/go-utils/net/preflight"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	etherHeaderSize = 14
+	ipv6HeaderSize  = 40
+	etherTypeIPv6   = 0x86dd
+	// solicitations start with the 24 bytes up to the target address
+	solicitationMinSize       = etherHeaderSize + ipv6HeaderSize + 24
+	optSourceLinkLayerAddress = 1
+)
+
+var (
+	errNotPrefix   = errors.New("not an IPv6 unicast prefix")
+	errNotEthernet = errors.New("prefixes are only proxied on ethernet links")
+)
+
+// solicitationFilter passes ICMPv6 neighbor solicitations without extension
+// headers, offsets are from the ethernet header
+var solicitationFilter = []syscall.SockFilter{
+	{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 12},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 5, K: etherTypeIPv6},
+	{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: etherHeaderSize + 6},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 3, K: ipProtocolICMP6},
+	{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: etherHeaderSize + ipv6HeaderSize},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 1, K: uint32(ipv6.ICMPTypeNeighborSolicitation)},
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0xffff},
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},
+}
+
+// Counters count the solicitations for a target and the advertisements
+// answering them, updated atomically
+type Counters struct {
+	Solicitations  uint64
+	Advertisements uint64
+}
+
+func (c *Counters) load() Counters {
+	return Counters{
+		Solicitations:  atomic.LoadUint64(&c.Solicitations),
+		Advertisements: atomic.LoadUint64(&c.Advertisements),
+	}
+}
+
+// Target is an address or prefix the proxy answers for
+type Target struct {
+	Address string
+	// Interface of a prefix, addresses are answered on every interface
+	Interface string
+	Counters
+}
+
+type proxiedPrefix struct {
+	// counters are first for atomic, as in ndService
+	counters Counters
+	network  *net.IPNet
+}
+
+// prefixService answers for every address of some prefixes on one link. The
+// targets are not local, so the solicitations to their groups only arrive
+// with the link in allmulti mode, on a packet socket.
+type prefixService struct {
+	p   *Proxy
+	ifc *net.Interface
+	f   *os.File
+	rc  syscall.RawConn
+
+	lock     sync.Mutex
+	prefixes map[string]*proxiedPrefix
+}
+
+func parsePrefix(cidr string) (network *net.IPNet, err error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return
+	}
+	if ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return nil, errNotPrefix
+	}
+	return
+}
+
+func AddPrefix(cidr, ifName string) (err error) {
+	return _proxy.AddPrefix(cidr, ifName)
+}
+
+// AddPrefix answers solicitations on ifName for every address of an IPv6
+// prefix, which has to be routed to the node. Solicitations during DAD are
+// left to the owner of the address.
+func (p *Proxy) AddPrefix(cidr, ifName string) (err error) {
+	network, err := parsePrefix(cidr)
+	if err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return errClosed
+	}
+
+	s := p.prefixes[ifName]
+	if s == nil {
+		err = p.ns.Do(func() (err error) {
+			s, err = newPrefixService(ifName)
+			return preflight.Explain("listen", err, preflight.CapNetRaw)
+		})
+		if err != nil {
+			return
+		}
+		s.p = p
+		p.prefixes[ifName] = s
+		p.listeners.Add(1)
+		go s.start()
+	}
+
+	s.lock.Lock()
+	if s.prefixes[network.String()] == nil {
+		s.prefixes[network.String()] = &proxiedPrefix{network: network}
+	}
+	s.lock.Unlock()
+	return
+}
+
+func DelPrefix(cidr, ifName string) {
+	_proxy.DelPrefix(cidr, ifName)
+}
+
+func (p *Proxy) DelPrefix(cidr, ifName string) {
+	network, err := parsePrefix(cidr)
+	if err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s := p.prefixes[ifName]
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	delete(s.prefixes, network.String())
+	empty := len(s.prefixes) == 0
+	s.lock.Unlock()
+
+	if empty {
+		delete(p.prefixes, ifName)
+		_ = s.f.Close()
+	}
+}
+
+func Targets() []Target {
+	return _proxy.Targets()
+}
+
+// Targets lists the addresses and prefixes proxied with their counters
+func (p *Proxy) Targets() (targets []Target) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for address, s := range p.services {
+		targets = append(targets, Target{Address: address, Counters: s.counters.load()})
+	}
+	for name, s := range p.prefixes {
+		s.lock.Lock()
+		for cidr, pp := range s.prefixes {
+			targets = append(targets, Target{Address: cidr, Interface: name, Counters: pp.counters.load()})
+		}
+		s.lock.Unlock()
+	}
+	return
+}
+
+func newPrefixService(ifName string) (s *prefixService, err error) {
+	ifc, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return
+	}
+	if len(ifc.HardwareAddr) != 6 {
+		return nil, errNotEthernet
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(etherTypeIPv6)))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	setup := func() error {
+		if err := syscall.AttachLsf(fd, solicitationFilter); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		sa := &syscall.SockaddrLinklayer{Protocol: htons(etherTypeIPv6), Ifindex: ifc.Index}
+		if err := syscall.Bind(fd, sa); err != nil {
+			return os.NewSyscallError("bind", err)
+		}
+		// the membership ends with the socket
+		mreq := &unix.PacketMreq{Ifindex: int32(ifc.Index), Type: unix.PACKET_MR_ALLMULTI}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		return syscall.SetNonblock(fd, true)
+	}
+	if err = setup(); err != nil {
+		_ = syscall.Close(fd)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "nd-prefix-socket")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+	return &prefixService{
+		ifc:      ifc,
+		f:        f,
+		rc:       rc,
+		prefixes: make(map[string]*proxiedPrefix),
+	}, nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func (s *prefixService) start() {
+	defer s.p.listeners.Done()
+
+	buff := make([]byte, 2048)
+	for {
+		var n int
+		var from syscall.Sockaddr
+		var err error
+		cerr := s.rc.Read(func(fd uintptr) bool {
+			n, from, err = syscall.Recvfrom(int(fd), buff, 0)
+			return err != syscall.EAGAIN
+		})
+		if cerr != nil {
+			// closed by DelPrefix
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+
+		sol, ok := parseSolicitation(buff[:n])
+		if !ok {
+			continue
+		}
+		pp := s.match(sol.target)
+		if pp == nil {
+			continue
+		}
+		atomic.AddUint64(&pp.counters.Solicitations, 1)
+		s.p.record(s.ifc.Index, sol.src, sol.dst, sol.target, sol.msg, false)
+
+		msg, frame, err := advertisementFrame(sol, s.ifc.HardwareAddr)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if err = s.send(frame, sol.srcMAC); err != nil {
+			log.Println(err)
+			continue
+		}
+		atomic.AddUint64(&pp.counters.Advertisements, 1)
+		s.p.record(s.ifc.Index, sol.target, sol.src, sol.target, msg, true)
+	}
+}
+
+func (s *prefixService) match(ip net.IP) *proxiedPrefix {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, pp := range s.prefixes {
+		if pp.network.Contains(ip) {
+			return pp
+		}
+	}
+	return nil
+}
+
+func (s *prefixService) send(frame []byte, dst net.HardwareAddr) (err error) {
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(etherTypeIPv6), Ifindex: s.ifc.Index, Halen: uint8(len(dst))}
+	copy(sa.Addr[:], dst)
+	cerr := s.rc.Write(func(fd uintptr) bool {
+		err = syscall.Sendto(int(fd), frame, 0, sa)
+		return err != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// solicitation is a neighbor solicitation received on a packet socket
+type solicitation struct {
+	srcMAC   net.HardwareAddr
+	src, dst net.IP
+	target   net.IP
+	msg      []byte
+}
+
+// parseSolicitation decodes an ethernet frame, solicitations from the
+// unspecified address are DAD and not answered
+func parseSolicitation(frame []byte) (sol *solicitation, ok bool) {
+	if len(frame) < solicitationMinSize || binary.BigEndian.Uint16(frame[12:14]) != etherTypeIPv6 {
+		return nil, false
+	}
+	src, dst, next, msg, err := pcap.ParseIPv6(frame[etherHeaderSize:])
+	if err != nil || next != ipProtocolICMP6 || len(msg) < 24 {
+		return nil, false
+	}
+	// hop limit 255 proves the solicitation was not routed
+	if frame[etherHeaderSize+7] != 255 || msg[0] != uint8(ipv6.ICMPTypeNeighborSolicitation) || msg[1] != 0 {
+		return nil, false
+	}
+	if src.IsUnspecified() {
+		return nil, false
+	}
+
+	sol = &solicitation{
+		srcMAC: net.HardwareAddr(append([]byte(nil), frame[6:12]...)),
+		src:    src,
+		dst:    dst,
+		target: append(net.IP(nil), msg[8:24]...),
+		msg:    append([]byte(nil), msg...),
+	}
+	// answer the link-layer address the solicitation asks to be answered at
+	for opts := msg[24:]; len(opts) >= 8 && opts[1] != 0 && int(opts[1])*8 <= len(opts); opts = opts[int(opts[1])*8:] {
+		if opts[0] == optSourceLinkLayerAddress && opts[1] == 1 {
+			sol.srcMAC = net.HardwareAddr(append([]byte(nil), opts[2:8]...))
+			break
+		}
+	}
+	return sol, true
+}
+
+// advertisementFrame answers sol from mac
+func advertisementFrame(sol *solicitation, mac net.HardwareAddr) (msg, frame []byte, err error) {
+	msg, err = newAdvertisement(sol.target, sol.target, mac).marshal()
+	if err != nil {
+		return
+	}
+	packet := pcap.ICMPv6(sol.target, sol.src, msg)
+
+	frame = make([]byte, etherHeaderSize+len(packet))
+	copy(frame[0:6], sol.srcMAC)
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+	copy(frame[etherHeaderSize:], packet)
+	return msg, frame, nil
+}
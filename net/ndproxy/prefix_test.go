@@ -0,0 +1,64 @@
+package ndproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/adoyee/go-utils/net/pcap"
+)
+
+func solicitationFrame(src, target net.IP, mac net.HardwareAddr, hopLimit uint8) []byte {
+	msg := make([]byte, 24, 32)
+	msg[0] = 135
+	copy(msg[8:24], target)
+	msg = append(msg, optSourceLinkLayerAddress, 1)
+	msg = append(msg, mac...)
+
+	packet := pcap.ICMPv6(src, net.ParseIP("ff02::1:ff00:5"), msg)
+	packet[7] = hopLimit
+	frame := append([]byte{0x33, 0x33, 0xff, 0, 0, 5}, mac...)
+	frame = append(frame, 0x86, 0xdd)
+	return append(frame, packet...)
+}
+
+func TestParseSolicitation(t *testing.T) {
+	src, target := net.ParseIP("fd00::2"), net.ParseIP("fd00:5::5")
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+
+	sol, ok := parseSolicitation(solicitationFrame(src, target, mac, 255))
+	if !ok {
+		t.Fatal("solicitation not parsed")
+	}
+	if !sol.src.Equal(src) || !sol.target.Equal(target) || !bytes.Equal(sol.srcMAC, mac) {
+		t.Fatalf("solicitation %+v", sol)
+	}
+
+	if _, ok := parseSolicitation(solicitationFrame(src, target, mac, 64)); ok {
+		t.Fatal("routed solicitation parsed")
+	}
+	if _, ok := parseSolicitation(solicitationFrame(net.IPv6unspecified, target, mac, 255)); ok {
+		t.Fatal("DAD parsed")
+	}
+
+	own := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	_, frame, err := advertisementFrame(sol, own)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame[0:6], mac) || !bytes.Equal(frame[6:12], own) {
+		t.Fatalf("frame %s -> %s", net.HardwareAddr(frame[6:12]), net.HardwareAddr(frame[0:6]))
+	}
+	s, d, _, msg, err := pcap.ParseIPv6(frame[etherHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Equal(target) || !d.Equal(src) {
+		t.Fatalf("advertisement %s -> %s", s, d)
+	}
+	want := "88" + "00" + hex.EncodeToString(msg[2:4]) + "60000000" + "fd000005000000000000000000000005" + "0201" + "020000000001"
+	if got := hex.EncodeToString(msg); got != want {
+		t.Fatalf("advertisement %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package ndproxy
+
+import (
+	"net"
+
+	"github.com/adoyee/go-utils/net/preflight"
+)
+
+// proxySysctls are the conf sysctls of the interfaces the proxy answers on
+var proxySysctls = []preflight.ConfSysctl{
+	{Family: "ipv6", Name: "proxy_ndp", OK: func(v int) bool { return v == 0 },
+		Why: "the kernel answers for its own proxy entries besides the proxy"},
+	{Family: "ipv6", Name: "accept_dad", OK: func(v int) bool { return v <= 0 },
+		Why: "addresses added without nodad cannot be proxied until DAD ends"},
+}
+
+func Preflight() *preflight.Report {
+	return _proxy.Preflight()
+}
+
+// Preflight checks what AddAddress and AddPrefix need in p's namespace,
+// without CAP_NET_RAW they fail with a *preflight.MissingError
+func (p *Proxy) Preflight() *preflight.Report {
+	r := new(preflight.Report)
+	err := p.ns.Do(func() error {
+		r.Add(preflight.CapabilityCheck(preflight.CapNetRaw, "ICMPv6 and packet sockets"))
+
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, ifc := range interfaces {
+			if ifc.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			for _, s := range proxySysctls {
+				r.Add(s.Check(ifc.Name))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.Add(preflight.Check{Name: "namespace " + p.ns.String(), Required: true, Detail: err.Error()})
+	}
+	return r
+}
@@ -1,11 +1,16 @@
 package ndproxy
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 
+	"github.com/adoyee/go-utils/net/netns"
+	"github.com/adoyee/go-utils/net/pcap"
+	"github.com/adoyee/go-utils/net/preflight"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv6"
 )
@@ -15,32 +20,66 @@ const (
 )
 
 var (
-	_proxy *ndProxy
+	_proxy = New(nil)
+
+	errClosed = errors.New("proxy closed")
 )
 
-type ndProxy struct {
+// Proxy answers neighbor solicitations in one network namespace, the package
+// level functions use the one of the process's namespace
+type Proxy struct {
+	ns       *netns.Namespace
 	services map[string]*ndService
+	// prefixes by interface name
+	prefixes map[string]*prefixService
 	lock     sync.Mutex
+	// closed is set by Close, listeners counts the goroutines answering
+	closed    bool
+	listeners sync.WaitGroup
+
+	// capture holds the *capture of StartCapture, nil when stopped
+	capture atomic.Value
+}
+
+// capture writes the solicitations and advertisements of some addresses, of
+// all when addresses is empty
+type capture struct {
+	w         *pcap.Writer
+	addresses map[string]bool
 }
 
-func init() {
-	_proxy = &ndProxy{
+// New returns a Proxy opening its sockets in ns, nil is the process's
+// namespace, ns has to stay open while addresses are added
+func New(ns *netns.Namespace) *Proxy {
+	return &Proxy{
+		ns:       ns,
 		services: make(map[string]*ndService),
+		prefixes: make(map[string]*prefixService),
 	}
 }
 
 type ndService struct {
-	conn    *ipv6.PacketConn
-	address string
-	closed  bool
+	// counters are first for the 64-bit alignment atomic needs on 32-bit
+	// platforms
+	counters Counters
+	p        *Proxy
+	ns       *netns.Namespace
+	conn     *ipv6.PacketConn
+	address  string
+	// closed is set by close, so start tells it from a failed read
+	closed int32
 }
 
 func (s *ndService) close() {
-	s.closed = true
+	atomic.StoreInt32(&s.closed, 1)
 	_ = s.conn.Close()
 }
 
 func AddAddress(address string) (err error) {
+	return _proxy.AddAddress(address)
+}
+
+func (p *Proxy) AddAddress(address string) (err error) {
 	addr, err := net.ResolveIPAddr("ip6", address)
 	if err != nil {
 		return
@@ -51,34 +90,117 @@ func AddAddress(address string) (err error) {
 	}
 
 	var exist bool
-	_proxy.lock.Lock()
-	_, exist = _proxy.services[addr.String()]
+	p.lock.Lock()
+	_, exist = p.services[addr.String()]
 	if exist {
-		_proxy.lock.Unlock()
+		p.lock.Unlock()
 		return
 	}
-	defer _proxy.lock.Unlock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return errClosed
+	}
 
-	s, err := newService(addr)
+	var s *ndService
+	err = p.ns.Do(func() (err error) {
+		s, err = newService(addr)
+		return preflight.Explain("listen", err, preflight.CapNetRaw)
+	})
 	if err != nil {
 		return
 	}
-	_proxy.services[addr.String()] = s
+	s.p = p
+	s.ns = p.ns
+	p.services[addr.String()] = s
+	p.listeners.Add(1)
 	go s.start()
 	return
 }
 
 func DelAddress(addr string) {
-	_proxy.lock.Lock()
-	defer _proxy.lock.Unlock()
+	_proxy.DelAddress(addr)
+}
+
+func (p *Proxy) DelAddress(addr string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	s, exist := _proxy.services[addr]
+	s, exist := p.services[addr]
 	if exist {
-		delete(_proxy.services, addr)
+		delete(p.services, addr)
 		s.close()
 	}
 }
 
+// Close stops answering for the addresses and prefixes of p and closes
+// their sockets. A Proxy has to be closed before its namespace.
+func (p *Proxy) Close() (err error) {
+	p.lock.Lock()
+	p.closed = true
+	services, prefixes := p.services, p.prefixes
+	p.services = make(map[string]*ndService)
+	p.prefixes = make(map[string]*prefixService)
+	p.lock.Unlock()
+
+	for _, s := range services {
+		s.close()
+	}
+	for _, s := range prefixes {
+		if e := s.f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.listeners.Wait()
+	return
+}
+
+func StartCapture(w *pcap.Writer, addrs ...string) error {
+	return _proxy.StartCapture(w, addrs...)
+}
+
+// StartCapture records the solicitations for addrs, all addresses when none
+// are given, and the advertisements answering them to w until StopCapture
+func (p *Proxy) StartCapture(w *pcap.Writer, addrs ...string) error {
+	c := &capture{
+		w:         w,
+		addresses: make(map[string]bool),
+	}
+	for _, address := range addrs {
+		addr, err := net.ResolveIPAddr("ip6", address)
+		if err != nil {
+			return err
+		}
+		c.addresses[addr.String()] = true
+	}
+	p.capture.Store(c)
+	return nil
+}
+
+func StopCapture() {
+	_proxy.StopCapture()
+}
+
+func (p *Proxy) StopCapture() {
+	p.capture.Store((*capture)(nil))
+}
+
+// record writes an ICMPv6 message about target with the IPv6 header the
+// socket does not see
+func (p *Proxy) record(ifIndex int, src, dst, target net.IP, msg []byte, outbound bool) {
+	c, _ := p.capture.Load().(*capture)
+	if c == nil || len(c.addresses) != 0 && !c.addresses[target.String()] {
+		return
+	}
+
+	info := pcap.PacketInfo{LinkType: pcap.LinkTypeRaw, Outbound: outbound}
+	if ifc, err := net.InterfaceByIndex(ifIndex); err == nil {
+		info.Interface = ifc.Name
+	}
+	if err := c.w.WritePacket(info, pcap.ICMPv6(src, dst, msg)); err != nil {
+		log.Println("capture ", err)
+	}
+}
+
 func newService(addr *net.IPAddr) (s *ndService, err error) {
 	var maddr net.IP
 
@@ -130,19 +252,32 @@ func newService(addr *net.IPAddr) (s *ndService, err error) {
 }
 
 func (s *ndService) start() {
-	for !s.closed {
-		buff := make([]byte, 2048)
-		_, cm, src, err := s.conn.ReadFrom(buff)
+	defer s.p.listeners.Done()
+
+	// replies look up interfaces, which has to happen in the namespace
+	if err := s.ns.Enter(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	buff := make([]byte, 2048)
+	for {
+		n, cm, src, err := s.conn.ReadFrom(buff)
+		if err != nil && atomic.LoadInt32(&s.closed) != 0 {
+			// closed by DelAddress or Close
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		if len(buff) < 24 {
+		data := buff[:n]
+		if len(data) < 24 {
 			continue
 		}
 
-		msg, err := icmp.ParseMessage(ipProtocolICMP6, buff)
+		msg, err := icmp.ParseMessage(ipProtocolICMP6, data)
 		if err != nil {
 			continue
 		}
@@ -152,17 +287,21 @@ func (s *ndService) start() {
 		}
 
 		var target net.IP
-		target = buff[8:24]
+		target = data[8:24]
 
 		if target.String() != s.address {
 			continue
 		}
 
-		sendNeighborAdvertisement(s.conn, cm, src, target)
+		atomic.AddUint64(&s.counters.Solicitations, 1)
+		if a, ok := src.(*net.IPAddr); ok {
+			s.p.record(cm.IfIndex, a.IP, cm.Dst, target, data, false)
+		}
+		s.sendNeighborAdvertisement(cm, src, target)
 	}
 }
 
-func sendNeighborAdvertisement(conn *ipv6.PacketConn, cm *ipv6.ControlMessage, src net.Addr, target net.IP) {
+func (s *ndService) sendNeighborAdvertisement(cm *ipv6.ControlMessage, src net.Addr, target net.IP) {
 	ifc, err := net.InterfaceByIndex(cm.IfIndex)
 	if err != nil {
 		log.Println(err)
@@ -170,9 +309,18 @@ func sendNeighborAdvertisement(conn *ipv6.PacketConn, cm *ipv6.ControlMessage, s
 	}
 
 	ad := newAdvertisement(cm.Src, target, ifc.HardwareAddr)
-	data := ad.marshal()
-	_, err = conn.WriteTo(data, nil, src)
+	data, err := ad.marshal()
 	if err != nil {
 		log.Println(err)
+		return
+	}
+	_, err = s.conn.WriteTo(data, nil, src)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	atomic.AddUint64(&s.counters.Advertisements, 1)
+	if a, ok := src.(*net.IPAddr); ok {
+		s.p.record(ifc.Index, target, a.IP, target, data, true)
 	}
 }
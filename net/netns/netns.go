@@ -0,0 +1,91 @@
+// Package netns runs code inside a network namespace
+package netns
+
+import (
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Namespace is an open network namespace, a nil one is the namespace the
+// process runs in
+type Namespace struct {
+	f *os.File
+}
+
+// Open opens a namespace by path, e.g. /var/run/netns/<name> or
+// /proc/<pid>/ns/net
+func Open(path string) (ns *Namespace, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	return &Namespace{f: f}, nil
+}
+
+// FromFd takes over an open namespace file descriptor, Close closes it
+func FromFd(fd uintptr) *Namespace {
+	return &Namespace{f: os.NewFile(fd, "netns")}
+}
+
+func (ns *Namespace) Close() error {
+	if ns == nil {
+		return nil
+	}
+	return ns.f.Close()
+}
+
+func (ns *Namespace) String() string {
+	if ns == nil {
+		return "current"
+	}
+	return ns.f.Name()
+}
+
+// Do runs fn on a thread inside the namespace. Sockets and commands fn
+// creates stay in the namespace, goroutines it starts do not.
+func (ns *Namespace) Do(fn func() error) (err error) {
+	if ns == nil {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return
+	}
+	defer orig.Close()
+
+	if err = setns(ns.f); err != nil {
+		runtime.UnlockOSThread()
+		return
+	}
+	defer func() {
+		// a thread stuck in the namespace must not run other goroutines,
+		// it is discarded with this one
+		if setns(orig) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return fn()
+}
+
+// Enter moves the calling goroutine into the namespace for good, its thread
+// is discarded when the goroutine exits
+func (ns *Namespace) Enter() (err error) {
+	if ns == nil {
+		return
+	}
+
+	runtime.LockOSThread()
+	return setns(ns.f)
+}
+
+func setns(f *os.File) error {
+	if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		return os.NewSyscallError("setns", err)
+	}
+	return nil
+}
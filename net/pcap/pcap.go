@@ -0,0 +1,432 @@
+// Package pcap writes and reads pcapng captures of the frames the VIP and ND
+// responders receive and send, readable by wireshark and tcpdump.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// LinkTypeEthernet frames start with an ethernet header, VLAN tags inline
+	LinkTypeEthernet = 1
+	// LinkTypeRaw frames start with an IP header
+	LinkTypeRaw = 101
+
+	blockSectionHeader   = 0x0a0d0d0a
+	blockInterface       = 0x00000001
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1a2b3c4d
+	optionEnd            = 0
+	optionInterfaceName  = 2
+	optionPacketFlags    = 2
+	flagInbound          = 1
+	flagOutbound         = 2
+	snapLength           = 0xffff
+	maxBlockLength       = 1 << 24
+	ipv6HeaderLength     = 40
+	ipProtocolICMPv6     = 58
+	defaultInterfaceName = "any"
+)
+
+var (
+	ErrNotPcapng = errors.New("not a pcapng capture")
+	ErrBadBlock  = errors.New("malformed pcapng block")
+	ErrNotIPv6   = errors.New("not an IPv6 packet")
+)
+
+// PacketInfo describes a captured packet
+type PacketInfo struct {
+	Time      time.Time
+	Interface string
+	LinkType  uint16
+	Outbound  bool
+}
+
+type interfaceKey struct {
+	name     string
+	linkType uint16
+}
+
+// Writer writes a pcapng capture, it is safe for concurrent use
+type Writer struct {
+	lock       sync.Mutex
+	out        io.Writer
+	written    int64
+	interfaces map[interfaceKey]uint32
+
+	// rotation of files opened by OpenFile
+	path    string
+	file    *os.File
+	maxSize int64
+	keep    int
+}
+
+// NewWriter starts a capture on w
+func NewWriter(w io.Writer) (cw *Writer, err error) {
+	cw = &Writer{out: w}
+	if err = cw.start(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// OpenFile starts a capture in a file, once it grows past maxSize it is
+// moved to path.1, path.1 to path.2 and so on, keeping keep old files. A zero
+// maxSize never rotates.
+func OpenFile(path string, maxSize int64, keep int) (cw *Writer, err error) {
+	cw = &Writer{path: path, maxSize: maxSize, keep: keep}
+	if err = cw.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (w *Writer) open() (err error) {
+	w.file, err = os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	w.out = w.file
+	return w.start()
+}
+
+func (w *Writer) start() error {
+	w.written = 0
+	w.interfaces = make(map[interfaceKey]uint32)
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint16(body[6:8], 0)
+	// section length unknown
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0))
+	return w.block(blockSectionHeader, body)
+}
+
+func (w *Writer) rotate() (err error) {
+	if err = w.file.Close(); err != nil {
+		return
+	}
+	for i := w.keep; i > 0; i-- {
+		src := w.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", w.path, i-1)
+		}
+		if err = os.Rename(src, fmt.Sprintf("%s.%d", w.path, i)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	if w.keep == 0 {
+		_ = os.Remove(w.path)
+	}
+	return w.open()
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// block writes a block around body, which has to be padded already
+func (w *Writer) block(typ uint32, body []byte) error {
+	b := make([]byte, 12+len(body))
+	binary.LittleEndian.PutUint32(b[0:4], typ)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(b)))
+
+	n, err := w.out.Write(b)
+	w.written += int64(n)
+	return err
+}
+
+func (w *Writer) interfaceID(name string, linkType uint16) (id uint32, err error) {
+	key := interfaceKey{name: name, linkType: linkType}
+	if id, ok := w.interfaces[key]; ok {
+		return id, nil
+	}
+
+	opt := option(optionInterfaceName, []byte(name))
+	body := make([]byte, 8, 8+len(opt)+4)
+	binary.LittleEndian.PutUint16(body[0:2], linkType)
+	binary.LittleEndian.PutUint32(body[4:8], snapLength)
+	body = append(body, opt...)
+	body = append(body, option(optionEnd, nil)...)
+	if err = w.block(blockInterface, body); err != nil {
+		return
+	}
+
+	id = uint32(len(w.interfaces))
+	w.interfaces[key] = id
+	return
+}
+
+func option(code uint16, value []byte) []byte {
+	b := make([]byte, 4+pad4(len(value)))
+	binary.LittleEndian.PutUint16(b[0:2], code)
+	binary.LittleEndian.PutUint16(b[2:4], uint16(len(value)))
+	copy(b[4:], value)
+	return b
+}
+
+// WritePacket appends a packet to the capture
+func (w *Writer) WritePacket(info PacketInfo, data []byte) (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file != nil && w.maxSize > 0 && w.written >= w.maxSize {
+		if err = w.rotate(); err != nil {
+			return
+		}
+	}
+
+	if info.Interface == "" {
+		info.Interface = defaultInterfaceName
+	}
+	if info.Time.IsZero() {
+		info.Time = time.Now()
+	}
+	id, err := w.interfaceID(info.Interface, info.LinkType)
+	if err != nil {
+		return
+	}
+
+	captured := data
+	if len(captured) > snapLength {
+		captured = captured[:snapLength]
+	}
+
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, flagInbound)
+	if info.Outbound {
+		binary.LittleEndian.PutUint32(flags, flagOutbound)
+	}
+
+	// timestamps in the default resolution of microseconds
+	ts := uint64(info.Time.UnixNano() / int64(time.Microsecond))
+	body := make([]byte, 20+pad4(len(captured)))
+	binary.LittleEndian.PutUint32(body[0:4], id)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	copy(body[20:], captured)
+	body = append(body, option(optionPacketFlags, flags)...)
+	body = append(body, option(optionEnd, nil)...)
+	return w.block(blockEnhancedPacket, body)
+}
+
+// Close closes a file opened by OpenFile, other writers are left open
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+type readInterface struct {
+	name     string
+	linkType uint16
+}
+
+// Reader reads a pcapng capture, of any byte order
+type Reader struct {
+	in         io.Reader
+	order      binary.ByteOrder
+	interfaces []readInterface
+}
+
+// NewReader reads the section header of a capture
+func NewReader(r io.Reader) (cr *Reader, err error) {
+	cr = &Reader{in: r}
+	typ, body, err := cr.block()
+	if err != nil {
+		return nil, err
+	}
+	if typ != blockSectionHeader {
+		return nil, ErrNotPcapng
+	}
+	if err = cr.section(body); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (r *Reader) section(body []byte) error {
+	if len(body) < 16 {
+		return ErrBadBlock
+	}
+	r.interfaces = r.interfaces[:0]
+	return nil
+}
+
+// block reads the next block, the byte order is learned from section headers
+func (r *Reader) block() (typ uint32, body []byte, err error) {
+	head := make([]byte, 12)
+	if _, err = io.ReadFull(r.in, head[:8]); err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint32(head[0:4]) == blockSectionHeader {
+		// the byte order magic follows the length
+		if _, err = io.ReadFull(r.in, head[8:12]); err != nil {
+			return 0, nil, unexpected(err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(head[8:12]) == byteOrderMagic:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(head[8:12]) == byteOrderMagic:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, ErrNotPcapng
+		}
+	} else if r.order == nil {
+		return 0, nil, ErrNotPcapng
+	}
+
+	typ = r.order.Uint32(head[0:4])
+	length := int(r.order.Uint32(head[4:8]))
+	if length < 12 || length%4 != 0 || length > maxBlockLength {
+		return 0, nil, ErrBadBlock
+	}
+
+	rest := make([]byte, length-8)
+	read := 0
+	if typ == blockSectionHeader {
+		read = copy(rest, head[8:12])
+	}
+	if _, err = io.ReadFull(r.in, rest[read:]); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	return typ, rest[:len(rest)-4], nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// options returns the value of option code, nil if missing
+func (r *Reader) options(opts []byte, code uint16) []byte {
+	for len(opts) >= 4 {
+		c, n := r.order.Uint16(opts[0:2]), int(r.order.Uint16(opts[2:4]))
+		if c == optionEnd || 4+n > len(opts) {
+			return nil
+		}
+		if c == code {
+			return opts[4 : 4+n]
+		}
+		opts = opts[4+pad4(n):]
+	}
+	return nil
+}
+
+// ReadPacket returns the next packet, io.EOF at the end of the capture
+func (r *Reader) ReadPacket() (info PacketInfo, data []byte, err error) {
+	for {
+		typ, body, err := r.block()
+		if err != nil {
+			return info, nil, err
+		}
+
+		switch typ {
+		case blockSectionHeader:
+			if err = r.section(body); err != nil {
+				return info, nil, err
+			}
+		case blockInterface:
+			if len(body) < 8 {
+				return info, nil, ErrBadBlock
+			}
+			r.interfaces = append(r.interfaces, readInterface{
+				linkType: r.order.Uint16(body[0:2]),
+				name:     string(r.options(body[8:], optionInterfaceName)),
+			})
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return info, nil, ErrBadBlock
+			}
+			id := int(r.order.Uint32(body[0:4]))
+			captured := int(r.order.Uint32(body[12:16]))
+			if id >= len(r.interfaces) || 20+captured > len(body) {
+				return info, nil, ErrBadBlock
+			}
+
+			ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+			info = PacketInfo{
+				Time:      time.Unix(0, int64(ts)*int64(time.Microsecond)),
+				Interface: r.interfaces[id].name,
+				LinkType:  r.interfaces[id].linkType,
+			}
+			if flags := r.options(body[20+pad4(captured):], optionPacketFlags); len(flags) == 4 {
+				info.Outbound = r.order.Uint32(flags)&3 == flagOutbound
+			}
+			return info, body[20 : 20+captured], nil
+		}
+	}
+}
+
+// ICMPv6 wraps an ICMPv6 message in an IPv6 header for LinkTypeRaw, the
+// kernel adds both header and checksum on the wire so the socket sees neither
+func ICMPv6(src, dst net.IP, msg []byte) []byte {
+	b := make([]byte, ipv6HeaderLength+len(msg))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(msg)))
+	b[6] = ipProtocolICMPv6
+	b[7] = 255
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+
+	icmp := b[ipv6HeaderLength:]
+	copy(icmp, msg)
+	if len(icmp) >= 4 {
+		icmp[2], icmp[3] = 0, 0
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(b[8:40], icmp))
+	}
+	return b
+}
+
+// checksum is the ICMPv6 checksum over the pseudo header and the message
+func checksum(addrs, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(addrs)
+	sum += uint32(len(msg)) + ipProtocolICMPv6
+	add(msg)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// ParseIPv6 splits a packet of LinkTypeRaw, extension headers are not
+// skipped
+func ParseIPv6(data []byte) (src, dst net.IP, nextHeader uint8, payload []byte, err error) {
+	if len(data) < ipv6HeaderLength || data[0]>>4 != 6 {
+		return nil, nil, 0, nil, ErrNotIPv6
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if ipv6HeaderLength+length > len(data) {
+		return nil, nil, 0, nil, ErrNotIPv6
+	}
+	src = append(net.IP(nil), data[8:24]...)
+	dst = append(net.IP(nil), data[24:40]...)
+	return src, dst, data[6], data[ipv6HeaderLength : ipv6HeaderLength+length], nil
+}
@@ -0,0 +1,123 @@
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 123456000)
+	packets := []struct {
+		info PacketInfo
+		data []byte
+	}{
+		{PacketInfo{Time: now, Interface: "eth0", LinkType: LinkTypeEthernet}, []byte{1, 2, 3, 4, 5}},
+		{PacketInfo{Time: now, Interface: "eth0", LinkType: LinkTypeRaw, Outbound: true}, []byte{6, 7}},
+		{PacketInfo{Time: now, Interface: "eth1", LinkType: LinkTypeEthernet}, []byte{8, 9, 10, 11}},
+		{PacketInfo{Time: now, Interface: "eth0", LinkType: LinkTypeEthernet, Outbound: true}, nil},
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.info, p.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range packets {
+		info, data, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Interface != p.info.Interface || info.LinkType != p.info.LinkType ||
+			info.Outbound != p.info.Outbound || !info.Time.Equal(p.info.Time) {
+			t.Fatalf("packet %d: %+v, want %+v", i, info, p.info)
+		}
+		if !bytes.Equal(data, p.data) {
+			t.Fatalf("packet %d: %x, want %x", i, data, p.data)
+		}
+	}
+	if _, _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+}
+
+func TestNotPcapng(t *testing.T) {
+	// a classic pcap header
+	if _, err := NewReader(bytes.NewReader([]byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0, 0, 0, 0, 0})); err != ErrNotPcapng {
+		t.Fatalf("err = %v, want %v", err, ErrNotPcapng)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "arp.pcapng")
+	w, err := OpenFile(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := w.WritePacket(PacketInfo{Interface: "eth0", LinkType: LinkTypeEthernet}, make([]byte, 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every file starts its own section with its own interfaces
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, _, err := r.ReadPacket(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		f.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept %s.3", path)
+	}
+}
+
+func TestICMPv6(t *testing.T) {
+	src, dst := net.ParseIP("fe80::1"), net.ParseIP("ff02::1")
+	msg := []byte{136, 0, 0xff, 0xff, 0x20, 0, 0, 0}
+	b := ICMPv6(src, dst, msg)
+
+	s, d, next, payload, err := ParseIPv6(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Equal(src) || !d.Equal(dst) || next != ipProtocolICMPv6 || len(payload) != len(msg) {
+		t.Fatalf("%s -> %s next %d payload %x", s, d, next, payload)
+	}
+	// summing with the checksum in place gives zero
+	if sum := checksum(b[8:40], payload); sum != 0 {
+		t.Fatalf("checksum off by %#x", sum)
+	}
+}
@@ -0,0 +1,258 @@
+// Package preflight checks what the VIP and ND proxy packages need from the
+// host: capabilities, tools and sysctls.
+package preflight
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capabilities, see linux/capability.h
+const (
+	CapNetAdmin = 12
+	CapNetRaw   = 13
+)
+
+var capNames = map[int]string{
+	CapNetAdmin: "CAP_NET_ADMIN",
+	CapNetRaw:   "CAP_NET_RAW",
+}
+
+var errNoCapEff = errors.New("no CapEff in /proc status")
+
+// Check is the result of checking one requirement
+type Check struct {
+	Name string
+	OK   bool
+	// Required checks fail operations, the others only change behavior
+	Required bool
+	Detail   string
+}
+
+// Report lists the checks of a Preflight
+type Report struct {
+	Checks []Check
+}
+
+func (r *Report) Add(c Check) {
+	r.Checks = append(r.Checks, c)
+}
+
+// OK tells whether every required check passed
+func (r *Report) OK() bool {
+	for _, c := range r.Checks {
+		if c.Required && !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the checks which did not pass, required or not
+func (r *Report) Failed() (failed []Check) {
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c)
+		}
+	}
+	return
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, c := range r.Checks {
+		status := "ok"
+		switch {
+		case !c.OK && c.Required:
+			status = "missing"
+		case !c.OK:
+			status = "warning"
+		}
+		fmt.Fprintf(&b, "%-8s %s", status, c.Name)
+		if c.Detail != "" {
+			fmt.Fprintf(&b, ": %s", c.Detail)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// CapName returns the name of a capability
+func CapName(c int) string {
+	if name, ok := capNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("capability(%d)", c)
+}
+
+// parseCapEff reads the effective capability set from a /proc status file
+func parseCapEff(r io.Reader) (caps uint64, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "CapEff:" {
+			return strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	return 0, errNoCapEff
+}
+
+// HasCapability tells whether the calling thread holds capability c
+func HasCapability(c int) (ok bool, err error) {
+	f, err := os.Open("/proc/thread-self/status")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	caps, err := parseCapEff(f)
+	if err != nil {
+		return
+	}
+	return caps&(1<<uint(c)) != 0, nil
+}
+
+// CapabilityCheck is a required check of capability c
+func CapabilityCheck(c int, why string) Check {
+	check := Check{Name: CapName(c), Required: true, Detail: why}
+	ok, err := HasCapability(c)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = ok
+	return check
+}
+
+// ToolCheck is a required check of an executable
+func ToolCheck(path, why string) Check {
+	check := Check{Name: path, Required: true, Detail: why}
+	fi, err := os.Stat(path)
+	switch {
+	case err != nil:
+		check.Detail = err.Error()
+	case fi.IsDir() || fi.Mode()&0111 == 0:
+		check.Detail = "not executable"
+	default:
+		check.OK = true
+	}
+	return check
+}
+
+// Sysctl reads a sysctl of the calling thread's network namespace, key is
+// dotted like net.ipv4.conf.all.arp_ignore
+func Sysctl(key string) (value string, err error) {
+	data, err := ioutil.ReadFile("/proc/sys/" + strings.Replace(key, ".", "/", -1))
+	if err != nil {
+		return
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SysctlInt reads an integer sysctl
+func SysctlInt(key string) (value int, err error) {
+	s, err := Sysctl(key)
+	if err != nil {
+		return
+	}
+	return strconv.Atoi(s)
+}
+
+// ConfSysctl is what an interface's conf sysctl should be, e.g. arp_ignore
+// of ipv4
+type ConfSysctl struct {
+	Family, Name string
+	// OK tells whether an effective value is fine, Why is the trouble
+	// otherwise
+	OK  func(int) bool
+	Why string
+}
+
+// Key is the sysctl of ifName
+func (s ConfSysctl) Key(ifName string) string {
+	return fmt.Sprintf("net.%s.conf.%s.%s", s.Family, ifName, s.Name)
+}
+
+// Effective combines the all and ifName values the way the kernel does,
+// the larger one wins, booleans are or-ed
+func (s ConfSysctl) Effective(ifName string) (value int, err error) {
+	all, err := SysctlInt(s.Key("all"))
+	if err != nil {
+		return
+	}
+	dev, err := SysctlInt(s.Key(ifName))
+	if err != nil {
+		return
+	}
+	if all > dev {
+		return all, nil
+	}
+	return dev, nil
+}
+
+// Check is an advisory check of the effective value on ifName
+func (s ConfSysctl) Check(ifName string) Check {
+	c := Check{Name: s.Key(ifName)}
+	value, err := s.Effective(ifName)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	c.OK = s.OK(value)
+	if !c.OK {
+		c.Detail = fmt.Sprintf("%d, %s", value, s.Why)
+	}
+	return c
+}
+
+// MissingError is returned by operations which failed for lack of
+// capabilities or tools
+type MissingError struct {
+	Op      string
+	Missing []string
+	Err     error
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("%s: missing %s: %v", e.Op, strings.Join(e.Missing, ", "), e.Err)
+}
+
+func (e *MissingError) Unwrap() error {
+	return e.Err
+}
+
+// Explain returns err of op as a MissingError if the calling thread lacks
+// any of caps, otherwise err unchanged
+func Explain(op string, err error, caps ...int) error {
+	if err == nil {
+		return nil
+	}
+	var missing []string
+	for _, c := range caps {
+		if ok, cerr := HasCapability(c); cerr == nil && !ok {
+			missing = append(missing, CapName(c))
+		}
+	}
+	if len(missing) == 0 {
+		return err
+	}
+	return &MissingError{Op: op, Missing: missing, Err: err}
+}
+
+// MissingTool returns the error of running path as a MissingError if path
+// does not exist, otherwise err unchanged
+func MissingTool(op, path string, err error) error {
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return &MissingError{Op: op, Missing: []string{path}, Err: err}
+}
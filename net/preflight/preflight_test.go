@@ -0,0 +1,101 @@
+package preflight
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const status = `Name:	vipd
+CapInh:	0000000000000000
+CapPrm:	0000000000003000
+CapEff:	0000000000002000
+CapBnd:	000001ffffffffff
+`
+
+func TestParseCapEff(t *testing.T) {
+	caps, err := parseCapEff(strings.NewReader(status))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps&(1<<CapNetRaw) == 0 || caps&(1<<CapNetAdmin) != 0 {
+		t.Fatalf("CapEff %x", caps)
+	}
+
+	if _, err := parseCapEff(strings.NewReader("Name:\tvipd\n")); err != errNoCapEff {
+		t.Fatalf("err = %v, want %v", err, errNoCapEff)
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := new(Report)
+	r.Add(Check{Name: "a", OK: true, Required: true})
+	r.Add(Check{Name: "b", Detail: "advisory"})
+	if !r.OK() || len(r.Failed()) != 1 {
+		t.Fatalf("report %+v", r)
+	}
+
+	r.Add(Check{Name: "c", Required: true})
+	if r.OK() || len(r.Failed()) != 2 {
+		t.Fatalf("report %+v", r)
+	}
+	if want := "missing  c\n"; !strings.HasSuffix(r.String(), want) {
+		t.Fatalf("report %q, want suffix %q", r.String(), want)
+	}
+}
+
+func TestConfSysctl(t *testing.T) {
+	s := ConfSysctl{Family: "ipv6", Name: "hop_limit", OK: func(v int) bool { return v > 1 }, Why: "too few hops"}
+	all, err := SysctlInt("net.ipv6.conf.all.hop_limit")
+	if err != nil {
+		t.Skip(err)
+	}
+	lo, err := SysctlInt("net.ipv6.conf.lo.hop_limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all < lo {
+		all = lo
+	}
+	if value, err := s.Effective("lo"); err != nil || value != all {
+		t.Fatalf("effective %d, %v, want %d", value, err, all)
+	}
+	if c := s.Check("lo"); !c.OK || c.Name != "net.ipv6.conf.lo.hop_limit" {
+		t.Fatalf("check %+v", c)
+	}
+
+	s.OK = func(int) bool { return false }
+	if c := s.Check("lo"); c.OK || !strings.HasSuffix(c.Detail, ", too few hops") {
+		t.Fatalf("check %+v", c)
+	}
+	if c := s.Check("nonexistent0"); c.OK || c.Detail == "" {
+		t.Fatalf("check of a missing interface %+v", c)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	err := errors.New("socket: operation not permitted")
+	if Explain("listen", nil, CapNetRaw) != nil {
+		t.Fatal("explained no error")
+	}
+
+	// no thread holds capabilities past the last one defined
+	const unknown = 63
+	var missing *MissingError
+	if !errors.As(Explain("listen", err, unknown), &missing) {
+		t.Fatal("not a MissingError")
+	}
+	if missing.Op != "listen" || len(missing.Missing) != 1 || !errors.Is(missing, err) {
+		t.Fatalf("missing %+v", missing)
+	}
+
+	_, err = exec.Command("/nonexistent/ip").CombinedOutput()
+	if !errors.As(MissingTool("ip", "/nonexistent/ip", err), &missing) || missing.Missing[0] != "/nonexistent/ip" {
+		t.Fatalf("missing tool %v", err)
+	}
+	if err := MissingTool("ip", "/nonexistent/ip", os.ErrPermission); err != os.ErrPermission {
+		t.Fatalf("explained %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package vip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// address attributes and flags, see linux/if_addr.h
+const (
+	ifaFlags = 8
+	ifaProto = 11
+
+	ifaFNodad = 0x02
+)
+
+// link attributes, see linux/if_link.h
+const iflaInfoKind = 1
+
+const (
+	// vipProto tags the addresses setLookup binds, the kernel's own
+	// protocols are 1 to 3. IFA_PROTO came with 5.18, older kernels drop it.
+	vipProto = 0x76
+	// ip4LabelSuffix tags IPv4 VIPs on kernels without address protocols as
+	// well, the label is the device's name with it. IPv6 addresses have no
+	// labels, only the protocol tags them, so before 5.18 their leftovers
+	// are not found.
+	ip4LabelSuffix = ":vip"
+)
+
+// ifAddr is an address of an interface
+type ifAddr struct {
+	ip        net.IP
+	prefixLen int
+	device    string
+	// kind of the device's link, e.g. dummy or veth, empty for lo
+	kind  string
+	label string
+	flags uint32
+	proto uint8
+}
+
+func (a ifAddr) String() string {
+	return fmt.Sprintf("%s/%d dev %s", a.ip, a.prefixLen, a.device)
+}
+
+// bits is the length of a host prefix of a
+func (a ifAddr) bits() int {
+	if a.ip.To4() != nil {
+		return net.IPv4len * 8
+	}
+	return net.IPv6len * 8
+}
+
+// tagged tells whether setLookup bound a
+func (a ifAddr) tagged() bool {
+	if a.proto == vipProto {
+		return true
+	}
+	return a.ip.To4() != nil && a.label != "" && a.label == ip4Label(a.device)
+}
+
+// ip4Label is the label tagging IPv4 VIPs on device, empty when the device's
+// name leaves no room for it within IFNAMSIZ
+func ip4Label(device string) string {
+	if len(device)+len(ip4LabelSuffix) >= syscall.IFNAMSIZ {
+		return ""
+	}
+	return device + ip4LabelSuffix
+}
+
+// addressTable reads and changes the addresses of the calling thread's
+// namespace, tests replace it
+type addressTable interface {
+	list() ([]ifAddr, error)
+	replace(a ifAddr) error
+	remove(a ifAddr) error
+}
+
+// netlinkAddrs is the kernel's address table
+type netlinkAddrs struct{}
+
+func (netlinkAddrs) replace(a ifAddr) error {
+	msg, err := addrMessage(a)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest("add "+a.String(), syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, msg)
+}
+
+func (netlinkAddrs) remove(a ifAddr) error {
+	// the address selects the one to delete, the rest would have to match
+	a.label, a.flags, a.proto = "", 0, 0
+	msg, err := addrMessage(a)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest("delete "+a.String(), syscall.RTM_DELADDR, 0, msg)
+}
+
+// addrMessage returns the RTM_NEWADDR/RTM_DELADDR message of a
+func addrMessage(a ifAddr) ([]byte, error) {
+	ifc, err := net.InterfaceByName(a.device)
+	if err != nil {
+		return nil, err
+	}
+	family, ip := uint8(syscall.AF_INET6), a.ip
+	if ip4 := ip.To4(); ip4 != nil {
+		family, ip = syscall.AF_INET, ip4
+	}
+
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	*(*syscall.IfAddrmsg)(unsafe.Pointer(&msg[0])) = syscall.IfAddrmsg{
+		Family:    family,
+		Prefixlen: uint8(a.prefixLen),
+		Flags:     uint8(a.flags),
+		Index:     uint32(ifc.Index),
+	}
+	msg = appendAttr(msg, syscall.IFA_LOCAL, ip)
+	msg = appendAttr(msg, syscall.IFA_ADDRESS, ip)
+	if a.label != "" {
+		msg = appendAttr(msg, syscall.IFA_LABEL, append([]byte(a.label), 0))
+	}
+	if a.flags != 0 {
+		msg = appendAttr(msg, ifaFlags, nativeUint32(a.flags))
+	}
+	if a.proto != 0 {
+		msg = appendAttr(msg, ifaProto, []byte{a.proto})
+	}
+	return msg, nil
+}
+
+func (netlinkAddrs) list() (addrs []ifAddr, err error) {
+	links, err := netlinkDump(syscall.RTM_GETLINK)
+	if err != nil {
+		return
+	}
+	names, kinds := make(map[int]string), make(map[int]string)
+	for _, msg := range links {
+		index, name, kind, ok := parseLink(&msg)
+		if ok {
+			names[index], kinds[index] = name, kind
+		}
+	}
+
+	msgs, err := netlinkDump(syscall.RTM_GETADDR)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		a, index, ok := parseAddr(&msg)
+		if !ok {
+			continue
+		}
+		a.device, a.kind = names[index], kinds[index]
+		addrs = append(addrs, a)
+	}
+	return
+}
+
+func netlinkDump(typ int) ([]syscall.NetlinkMessage, error) {
+	rib, err := syscall.NetlinkRIB(typ, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("netlinkrib", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, os.NewSyscallError("parsenetlinkmessage", err)
+	}
+	return msgs, nil
+}
+
+// parseAddr reads an RTM_NEWADDR message
+func parseAddr(msg *syscall.NetlinkMessage) (a ifAddr, ifIndex int, ok bool) {
+	if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+		return
+	}
+	ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+	a.prefixLen, a.flags = int(ifa.Prefixlen), uint32(ifa.Flags)
+
+	var address, local net.IP
+	parseAttrs(msg.Data[nlmAlign(syscall.SizeofIfAddrmsg):], func(typ uint16, value []byte) {
+		switch typ {
+		case syscall.IFA_ADDRESS:
+			address = append(net.IP(nil), value...)
+		case syscall.IFA_LOCAL:
+			local = append(net.IP(nil), value...)
+		case syscall.IFA_LABEL:
+			a.label = string(bytes.TrimRight(value, "\x00"))
+		case ifaFlags:
+			if len(value) == 4 {
+				a.flags = *(*uint32)(unsafe.Pointer(&value[0]))
+			}
+		case ifaProto:
+			if len(value) == 1 {
+				a.proto = value[0]
+			}
+		}
+	})
+	// IFA_ADDRESS is the peer of point-to-point IPv4 addresses
+	if a.ip = local; a.ip == nil {
+		a.ip = address
+	}
+	if len(a.ip) != net.IPv4len && len(a.ip) != net.IPv6len {
+		return
+	}
+	return a, int(ifa.Index), true
+}
+
+// parseLink reads an RTM_NEWLINK message
+func parseLink(msg *syscall.NetlinkMessage) (index int, name, kind string, ok bool) {
+	if msg.Header.Type != syscall.RTM_NEWLINK || len(msg.Data) < syscall.SizeofIfInfomsg {
+		return
+	}
+	ifi := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+	parseAttrs(msg.Data[nlmAlign(syscall.SizeofIfInfomsg):], func(typ uint16, value []byte) {
+		switch typ {
+		case syscall.IFLA_IFNAME:
+			name = string(bytes.TrimRight(value, "\x00"))
+		case syscall.IFLA_LINKINFO:
+			parseAttrs(value, func(typ uint16, value []byte) {
+				if typ == iflaInfoKind {
+					kind = string(bytes.TrimRight(value, "\x00"))
+				}
+			})
+		}
+	})
+	return int(ifi.Index), name, kind, name != ""
+}
@@ -0,0 +1,279 @@
+package vip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Announcer announces VIPs beyond the ARP/NDP responders, e.g. to routers.
+// Announce is called when a VIP is enabled on this node, Withdraw when it is
+// disabled or removed, both in the Manager's namespace. Failed calls are
+// retried until they succeed or the VIP's state changes, failed withdrawals
+// also after the VIP or the announcer is removed.
+type Announcer interface {
+	Announce(ip net.IP) error
+	Withdraw(ip net.IP) error
+}
+
+// AddAnnouncer adds an announcer to the default Manager, see
+// Manager.AddAnnouncer
+func AddAnnouncer(a Announcer) error {
+	return defaultManager.AddAnnouncer(a)
+}
+
+// AddAnnouncer makes Enable and Disable drive a as well, the VIPs enabled
+// already are announced to it now. Every VIP is attempted, the first error
+// is returned, failed announcements are retried until they succeed.
+func (m *Manager) AddAnnouncer(a Announcer) error {
+	return m.ns.Do(func() (err error) {
+		m.opLock.Lock()
+		defer m.opLock.Unlock()
+
+		for _, cur := range m.announcers {
+			if cur == a {
+				return
+			}
+		}
+		m.announcers = append(m.announcers, a)
+		for _, v := range m.vipes.all() {
+			if m.vipes.state(v) != StateAnnounced {
+				continue
+			}
+			if e := m.announce(v); e != nil && err == nil {
+				err = e
+			}
+		}
+		return
+	})
+}
+
+// RemoveAnnouncer removes an announcer from the default Manager
+func RemoveAnnouncer(a Announcer) error {
+	return defaultManager.RemoveAnnouncer(a)
+}
+
+// RemoveAnnouncer withdraws the enabled VIPs from a and stops driving it,
+// failed withdrawals are retried
+func (m *Manager) RemoveAnnouncer(a Announcer) error {
+	return m.ns.Do(func() (err error) {
+		m.opLock.Lock()
+		defer m.opLock.Unlock()
+
+		for i, cur := range m.announcers {
+			if cur != a {
+				continue
+			}
+			m.announcers = append(m.announcers[:i:i], m.announcers[i+1:]...)
+			for _, v := range m.vipes.all() {
+				if !v.announced[a] {
+					continue
+				}
+				delete(v.announced, a)
+				if e := a.Withdraw(v.ip); e != nil {
+					m.withdrawals[withdrawal{a, v.address}] = v.ip
+					if err == nil {
+						err = e
+					}
+				}
+			}
+			if err != nil {
+				m.scheduleAnnounceRetry()
+			}
+			return
+		}
+		return
+	})
+}
+
+// announceRetryDelay spaces the attempts of announcers which failed
+const announceRetryDelay = 5 * time.Second
+
+// withdrawal is a VIP an announcer still holds while the VIP or the
+// announcer is gone from the Manager
+type withdrawal struct {
+	a       Announcer
+	address string
+}
+
+// announce tells the announcers not holding v yet about it, those failing
+// are retried later, opLock is held
+func (m *Manager) announce(v *virtualIpAddress) (err error) {
+	for _, a := range m.announcers {
+		if v.announced[a] {
+			continue
+		}
+		// the VIP is back before an earlier one was withdrawn
+		delete(m.withdrawals, withdrawal{a, v.address})
+		if e := a.Announce(v.ip); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		if v.announced == nil {
+			v.announced = make(map[Announcer]bool)
+		}
+		v.announced[a] = true
+	}
+	if err != nil {
+		m.scheduleAnnounceRetry()
+	}
+	return
+}
+
+// withdrawAnnounced takes v back from the announcers holding it, those
+// failing are retried later, opLock is held
+func (m *Manager) withdrawAnnounced(v *virtualIpAddress) (err error) {
+	for _, a := range m.announcers {
+		if !v.announced[a] {
+			continue
+		}
+		if e := a.Withdraw(v.ip); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		delete(v.announced, a)
+	}
+	if err != nil {
+		m.scheduleAnnounceRetry()
+	}
+	return
+}
+
+// scheduleAnnounceRetry runs retryAnnouncers later unless it is pending,
+// opLock is held
+func (m *Manager) scheduleAnnounceRetry() {
+	if m.announceRetry == nil {
+		m.announceRetry = time.AfterFunc(announceRetryDelay, m.retryAnnouncers)
+	}
+}
+
+// retryAnnouncers brings the announcers in line with the VIPs' states
+// again, enabled VIPs are announced, the others withdrawn
+func (m *Manager) retryAnnouncers() {
+	m.initLock.Lock()
+	closed := m.closed
+	m.initLock.Unlock()
+	if closed {
+		return
+	}
+
+	err := m.ns.Do(func() (err error) {
+		m.opLock.Lock()
+		defer m.opLock.Unlock()
+
+		m.announceRetry = nil
+		err = m.withdrawPending()
+		for _, v := range m.vipes.all() {
+			var e error
+			if m.vipes.state(v) == StateAnnounced {
+				e = m.announce(v)
+			} else {
+				e = m.withdrawAnnounced(v)
+			}
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("announcers, retrying in %s: %v", announceRetryDelay, err)
+	}
+}
+
+// withdrawPending retries the withdrawals of removed VIPs and announcers,
+// opLock is held
+func (m *Manager) withdrawPending() (err error) {
+	for w, ip := range m.withdrawals {
+		if e := w.a.Withdraw(ip); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		delete(m.withdrawals, w)
+	}
+	if err != nil {
+		m.scheduleAnnounceRetry()
+	}
+	return
+}
+
+// RouteAnnouncer installs a host route per enabled VIP in a routing table,
+// for a routing daemon like bird or FRR to redistribute
+type RouteAnnouncer struct {
+	Table int
+	// Device the routes point at, lo by default
+	Device string
+	// Protocol tags the routes for the daemon's filters, e.g. 4 for static,
+	// 0 is boot like the ip tool's default
+	Protocol int
+	Metric   int
+}
+
+// NewRouteAnnouncer returns a RouteAnnouncer for table via lo
+func NewRouteAnnouncer(table int) *RouteAnnouncer {
+	return &RouteAnnouncer{Table: table}
+}
+
+func (r *RouteAnnouncer) Announce(ip net.IP) error {
+	dev := r.Device
+	if dev == "" {
+		dev = "lo"
+	}
+	ifc, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	protocol := r.Protocol
+	if protocol == 0 {
+		protocol = syscall.RTPROT_BOOT
+	}
+	msg := r.routeMessage(ip, syscall.RtMsg{
+		Protocol: uint8(protocol),
+		Scope:    syscall.RT_SCOPE_LINK,
+		Type:     syscall.RTN_UNICAST,
+	})
+	msg = appendAttr(msg, syscall.RTA_OIF, nativeUint32(uint32(ifc.Index)))
+	return netlinkRequest("replace route "+ipPrefix(ip), syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, msg)
+}
+
+func (r *RouteAnnouncer) Withdraw(ip net.IP) error {
+	msg := r.routeMessage(ip, syscall.RtMsg{Scope: syscall.RT_SCOPE_NOWHERE})
+	return netlinkRequest("delete route "+ipPrefix(ip), syscall.RTM_DELROUTE, 0, msg)
+}
+
+// routeMessage returns the message of the VIP's host route in the table,
+// rtm carries what differs between adding and deleting it
+func (r *RouteAnnouncer) routeMessage(ip net.IP, rtm syscall.RtMsg) []byte {
+	rtm.Family, rtm.Dst_len = syscall.AF_INET6, net.IPv6len*8
+	if ip4 := ip.To4(); ip4 != nil {
+		rtm.Family, rtm.Dst_len, ip = syscall.AF_INET, net.IPv4len*8, ip4
+	}
+	// rtm_table holds 8 bits, RTA_TABLE any table
+	if r.Table < 256 {
+		rtm.Table = uint8(r.Table)
+	}
+	msg := append([]byte(nil), (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rtm))[:]...)
+	msg = appendAttr(msg, syscall.RTA_DST, ip)
+	msg = appendAttr(msg, syscall.RTA_TABLE, nativeUint32(uint32(r.Table)))
+	if r.Metric != 0 {
+		msg = appendAttr(msg, syscall.RTA_PRIORITY, nativeUint32(uint32(r.Metric)))
+	}
+	return msg
+}
+
+// ipPrefix is the host prefix of ip
+func ipPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return fmt.Sprintf("%s/%d", ip, len(ip)*8)
+}
@@ -0,0 +1,149 @@
+package vip
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// recordingAnnouncer records announcements as "+ip" and withdrawals as "-ip",
+// failing with fail instead while it is set
+type recordingAnnouncer struct {
+	events []string
+	fail   error
+}
+
+func (a *recordingAnnouncer) Announce(ip net.IP) error {
+	if a.fail != nil {
+		return a.fail
+	}
+	a.events = append(a.events, "+"+ip.String())
+	return nil
+}
+
+func (a *recordingAnnouncer) Withdraw(ip net.IP) error {
+	if a.fail != nil {
+		return a.fail
+	}
+	a.events = append(a.events, "-"+ip.String())
+	return nil
+}
+
+func TestAnnouncer(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.announce(t, "10.0.0.100")
+	bound, err := parseIP("fd00::100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound.refs, bound.state = 1, StateBound
+	n.m.vipes.add(bound)
+
+	a := new(recordingAnnouncer)
+	if err := n.m.AddAnnouncer(a); err != nil {
+		t.Fatal(err)
+	}
+	// only the takeover and the last Disable reach the announcer
+	for _, op := range []func(string) error{n.m.enable, n.m.enable, n.m.disable, n.m.disable} {
+		if err := op("fd00::100"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.m.RemoveAnnouncer(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.disable("10.0.0.100"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"+10.0.0.100", "+fd00::100", "-fd00::100", "-10.0.0.100"}
+	if !reflect.DeepEqual(a.events, want) {
+		t.Fatalf("events %v, want %v", a.events, want)
+	}
+}
+
+func TestAnnouncerRetry(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	a := &recordingAnnouncer{fail: errors.New("bird down")}
+	if err := n.m.AddAnnouncer(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.add("10.0.0.100"); err != nil {
+		t.Fatal(err)
+	}
+	defer n.m.Close()
+
+	// answered, but retried until the announcer holds it
+	if err := n.m.enable("10.0.0.100"); err != a.fail {
+		t.Fatalf("enable: %v", err)
+	}
+	if s, _ := n.m.GetState("10.0.0.100"); s != StateAnnounced || n.m.announceRetry == nil {
+		t.Fatalf("%s, retry %v", s, n.m.announceRetry)
+	}
+	n.m.retryAnnouncers()
+	a.fail = nil
+	n.m.retryAnnouncers()
+	n.m.retryAnnouncers()
+	if want := []string{"+10.0.0.100"}; !reflect.DeepEqual(a.events, want) || n.m.announceRetry != nil {
+		t.Fatalf("events %v, want %v, retry %v", a.events, want, n.m.announceRetry)
+	}
+
+	// a failed withdrawal is retried as well
+	a.fail = errors.New("bird down")
+	if err := n.m.disable("10.0.0.100"); err != a.fail {
+		t.Fatalf("disable: %v", err)
+	}
+	a.fail = nil
+	n.m.retryAnnouncers()
+	if want := []string{"+10.0.0.100", "-10.0.0.100"}; !reflect.DeepEqual(a.events, want) {
+		t.Fatalf("events %v, want %v", a.events, want)
+	}
+}
+
+func TestAnnouncerRetryRemoved(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.announce(t, "10.0.0.100")
+	n.announce(t, "10.0.0.101")
+	a, b := new(recordingAnnouncer), new(recordingAnnouncer)
+	for _, x := range []*recordingAnnouncer{a, b} {
+		if err := n.m.AddAnnouncer(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer n.m.Close()
+
+	// the withdrawal of a removed VIP outlives it
+	a.fail = errors.New("bird down")
+	if err := n.m.remove("10.0.0.100"); err != a.fail {
+		t.Fatalf("remove: %v", err)
+	}
+	// and the ones of a removed announcer outlive it
+	b.fail = a.fail
+	if err := n.m.RemoveAnnouncer(b); err != b.fail {
+		t.Fatalf("remove announcer: %v", err)
+	}
+	if n.m.announceRetry == nil {
+		t.Fatal("no retry scheduled")
+	}
+	a.fail, b.fail = nil, nil
+	n.m.retryAnnouncers()
+	n.m.retryAnnouncers()
+
+	// the VIPs are announced in any order
+	sort.Strings(a.events)
+	sort.Strings(b.events)
+	if want := []string{"+10.0.0.100", "+10.0.0.101", "-10.0.0.100"}; !reflect.DeepEqual(a.events, want) {
+		t.Fatalf("a: events %v, want %v", a.events, want)
+	}
+	if want := []string{"+10.0.0.100", "+10.0.0.101", "-10.0.0.100", "-10.0.0.101"}; !reflect.DeepEqual(b.events, want) {
+		t.Fatalf("b: events %v, want %v", b.events, want)
+	}
+	if len(n.m.withdrawals) != 0 || n.m.announceRetry != nil {
+		t.Fatalf("withdrawals %v left, retry %v", n.m.withdrawals, n.m.announceRetry)
+	}
+}
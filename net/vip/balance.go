@@ -0,0 +1,147 @@
+package vip
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+)
+
+const (
+	// ringReplicas spreads each member over the ring so requesters split
+	// evenly and a member change only moves its own share
+	ringReplicas = 128
+)
+
+var errNotMember = errors.New("balance members do not include self")
+
+// balanceRing is a consistent hash ring over the nodes sharing a VIP
+type balanceRing struct {
+	self   string
+	points []uint32
+	owners []string
+}
+
+// ringHash is FNV-1a with a final avalanche, plain FNV clusters the
+// similar keys found here, names with a counter and adjacent addresses
+func ringHash(b []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(b)
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+func newBalanceRing(self string, members []string) (r *balanceRing, err error) {
+	r = &balanceRing{self: self}
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringHash([]byte(m+"#"+strconv.Itoa(i))))
+			r.owners = append(r.owners, m)
+		}
+	}
+	if !seen[self] {
+		return nil, errNotMember
+	}
+	sort.Sort(r)
+	return
+}
+
+func (r *balanceRing) Len() int           { return len(r.points) }
+func (r *balanceRing) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *balanceRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+// owner returns the member answering the requester key
+func (r *balanceRing) owner(key []byte) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// requesterKey hashes requesters by address, by MAC when the address is
+// missing or unspecified, e.g. ARP probes and DAD
+func requesterKey(ip net.IP, mac net.HardwareAddr) []byte {
+	if ip != nil && !ip.IsUnspecified() {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip
+	}
+	return mac
+}
+
+// owns reports whether this node answers the request, always true for
+// VIPs not balanced
+func (m *Manager) owns(req vipRequest) bool {
+	v := m.vipes.get(req.target().String())
+	if v == nil {
+		return true
+	}
+	r := m.vipes.balanceRing(v)
+	if r == nil {
+		return true
+	}
+
+	key := requesterKey(req.sender())
+	if len(key) == 0 {
+		return true
+	}
+	return r.owner(key) == r.self
+}
+
+// WithBalance shares the VIP among members, self is this node's name among
+// them. Every member answers ARP/NDP only for the requesters hashing to it,
+// so all of them have to enable the VIP with the same members. Enable does
+// not announce a balanced VIP.
+func WithBalance(self string, members []string) Option {
+	return func(v *virtualIpAddress) {
+		r, err := newBalanceRing(self, members)
+		if err != nil && v.optErr == nil {
+			v.optErr = err
+		}
+		v.balance = r
+	}
+}
+
+// SetBalance replaces the members sharing an added VIP, no members makes
+// this node answer all requesters again
+func SetBalance(address, self string, members []string) (err error) {
+	return defaultManager.SetBalance(address, self, members)
+}
+
+func (m *Manager) SetBalance(address, self string, members []string) (err error) {
+	v, err := parseIP(address)
+	if err != nil {
+		return
+	}
+
+	var r *balanceRing
+	if len(members) != 0 {
+		if r, err = newBalanceRing(self, members); err != nil {
+			return
+		}
+	}
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return ErrNotAdded
+	}
+	m.vipes.setBalance(cur, r)
+	return
+}
@@ -0,0 +1,63 @@
+package vip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestBalanceRing(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	rings := make(map[string]*balanceRing)
+	for _, m := range members {
+		r, err := newBalanceRing(m, members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rings[m] = r
+	}
+
+	share := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := requesterKey(net.ParseIP(fmt.Sprintf("10.%d.%d.1", i/256, i%256)), nil)
+		owners := 0
+		for _, m := range members {
+			if rings[m].owner(key) == m {
+				owners++
+				share[m]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("requester %d owned by %d members", i, owners)
+		}
+	}
+	for _, m := range members {
+		if share[m] < 500 {
+			t.Errorf("member %s answers %d of 3000 requesters", m, share[m])
+		}
+	}
+
+	// dropping a member only moves its own requesters
+	smaller, _ := newBalanceRing("a", []string{"a", "b"})
+	for i := 0; i < 3000; i++ {
+		key := requesterKey(net.ParseIP(fmt.Sprintf("10.%d.%d.1", i/256, i%256)), nil)
+		before := rings["a"].owner(key)
+		if after := smaller.owner(key); before != "c" && after != before {
+			t.Fatalf("requester %d moved from %s to %s", i, before, after)
+		}
+	}
+
+	if _, err := newBalanceRing("d", members); err != errNotMember {
+		t.Fatalf("ring without self: %v", err)
+	}
+}
+
+func TestRequesterKey(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	if key := requesterKey(net.IPv4zero, mac); string(key) != string(mac) {
+		t.Errorf("probe keyed by %v, want its MAC", key)
+	}
+	if key := requesterKey(net.ParseIP("10.0.0.1"), mac); len(key) != net.IPv4len {
+		t.Errorf("IPv4 requester keyed by %v", key)
+	}
+}
@@ -0,0 +1,118 @@
+package vip
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	batchSize = 32
+)
+
+// mmsghdr mirrors struct mmsghdr
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// arpBatch holds the buffers of one recvmmsg call, they are reused by every
+// call so only frames not yet handed out may be referenced
+type arpBatch struct {
+	msgs  []mmsghdr
+	iovs  []syscall.Iovec
+	bufs  [][]byte
+	oobs  [][]byte
+	names []syscall.RawSockaddrLinklayer
+	n     int
+	next  int
+}
+
+func newArpBatch(size int) (b *arpBatch) {
+	b = &arpBatch{
+		msgs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		bufs:  make([][]byte, size),
+		oobs:  make([][]byte, size),
+		names: make([]syscall.RawSockaddrLinklayer, size),
+	}
+
+	oobSize := syscall.CmsgSpace(int(unsafe.Sizeof(tpacketAuxdata{})))
+	for i := range b.msgs {
+		b.bufs[i] = make([]byte, buffSize)
+		b.oobs[i] = make([]byte, oobSize)
+		b.iovs[i].Base = &b.bufs[i][0]
+		b.iovs[i].SetLen(buffSize)
+
+		hdr := &b.msgs[i].hdr
+		hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		hdr.Iov = &b.iovs[i]
+		hdr.Iovlen = 1
+		hdr.Control = &b.oobs[i][0]
+	}
+	return
+}
+
+func (b *arpBatch) reset() {
+	for i := range b.msgs {
+		hdr := &b.msgs[i].hdr
+		hdr.Namelen = uint32(unsafe.Sizeof(b.names[i]))
+		hdr.SetControllen(len(b.oobs[i]))
+		hdr.Flags = 0
+		b.msgs[i].len = 0
+	}
+	b.n, b.next = 0, 0
+}
+
+// frame returns the next received frame, ok is false once the batch is drained
+func (b *arpBatch) frame() (data, oob []byte, remote *syscall.SockaddrLinklayer, truncated, ok bool) {
+	if b.next >= b.n {
+		return
+	}
+
+	i := b.next
+	b.next++
+
+	m := &b.msgs[i]
+	raw := &b.names[i]
+	remote = &syscall.SockaddrLinklayer{
+		Protocol: raw.Protocol,
+		Ifindex:  int(raw.Ifindex),
+		Hatype:   raw.Hatype,
+		Pkttype:  raw.Pkttype,
+		Halen:    raw.Halen,
+		Addr:     raw.Addr,
+	}
+	truncated = m.hdr.Flags&syscall.MSG_TRUNC != 0
+	return b.bufs[i][:m.len], b.oobs[i][:m.hdr.Controllen], remote, truncated, true
+}
+
+// recvBatch blocks until at least one frame is received and reads as many
+// pending frames as the batch holds with a single recvmmsg
+func (as *arpSocket) recvBatch(b *arpBatch) (err error) {
+	b.reset()
+
+	cerr := as.rc.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&b.msgs[0])), uintptr(len(b.msgs)),
+			0, 0, 0)
+		err = nil
+		if e != 0 {
+			err = e
+			return err != syscall.EAGAIN
+		}
+		b.n = int(r)
+		return true
+	})
+
+	// the raw conn does not tell a closed file, a read it cut short ends
+	// with EAGAIN
+	if (err != nil || cerr != nil) && atomic.LoadInt32(&as.closed) != 0 {
+		return os.ErrClosed
+	}
+	if err != nil {
+		return err
+	}
+	return cerr
+}
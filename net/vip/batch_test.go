@@ -0,0 +1,109 @@
+package vip
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+const benchChunk = 32
+
+// benchSocket returns a non-blocking datagram socket wrapped like the
+// AF_PACKET one, and a function queueing benchChunk frames on it. UDP on
+// loopback needs no privileges and exercises the same receive calls.
+func benchSocket(b *testing.B) (as *arpSocket, fill func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		b.Fatal(err)
+	}
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		b.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	f := os.NewFile(uintptr(fd), "bench-socket")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = f.Close() })
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: sa.(*syscall.SockaddrInet4).Port,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = conn.Close() })
+
+	// size of a minimal ethernet frame carrying an arp request
+	frame := make([]byte, 60)
+	fill = func() {
+		for i := 0; i < benchChunk; i++ {
+			if _, err := conn.Write(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return &arpSocket{f: f, rc: rc}, fill
+}
+
+// BenchmarkRecvPerFrame receives like accept did before batching, one
+// recvfrom and one fresh buffer per frame.
+func BenchmarkRecvPerFrame(b *testing.B) {
+	as, fill := benchSocket(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += benchChunk {
+		b.StopTimer()
+		fill()
+		b.StartTimer()
+
+		for j := 0; j < benchChunk; j++ {
+			buff := make([]byte, 1024)
+			var err error
+			cerr := as.rc.Read(func(fd uintptr) bool {
+				_, _, err = syscall.Recvfrom(int(fd), buff, 0)
+				return err != syscall.EAGAIN
+			})
+			if err != nil || cerr != nil {
+				b.Fatal(err, cerr)
+			}
+		}
+	}
+}
+
+// BenchmarkRecvBatch receives through recvmmsg into reused buffers.
+func BenchmarkRecvBatch(b *testing.B) {
+	as, fill := benchSocket(b)
+	batch := newArpBatch(batchSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += benchChunk {
+		b.StopTimer()
+		fill()
+		b.StartTimer()
+
+		for got := 0; got < benchChunk; {
+			if err := as.recvBatch(batch); err != nil {
+				b.Fatal(err)
+			}
+			for {
+				if _, _, _, _, ok := batch.frame(); !ok {
+					break
+				}
+				got++
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package vip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// BindMode selects where Add binds a VIP's address
+type BindMode int
+
+const (
+	// BindLoopback binds a host prefix to lo, the default
+	BindLoopback BindMode = iota
+	// BindDummy binds a host prefix to a dummy interface, created when
+	// missing
+	BindDummy
+	// BindInterface binds the VIP with its subnet's prefix length to a NIC
+	// while it is announced, the kernel answers ARP/NDP for it then and the
+	// VIP is only announced by the responder
+	BindInterface
+	// BindNone binds no address, the VIP is only answered for, e.g. in front
+	// of an XDP or IPVS dataplane
+	BindNone
+)
+
+// defaultDummy is the dummy interface of BindDummy without a Device
+const defaultDummy = "vip0"
+
+var errKernelAnswers = errors.New("the kernel answers for VIPs bound to an interface, virtual MACs do not apply")
+
+func (b BindMode) String() string {
+	switch b {
+	case BindLoopback:
+		return "lo"
+	case BindDummy:
+		return "dummy"
+	case BindInterface:
+		return "interface"
+	case BindNone:
+		return "none"
+	}
+	return fmt.Sprintf("BindMode(%d)", int(b))
+}
+
+// Binding says where a VIP's address goes
+type Binding struct {
+	Mode BindMode
+	// Device is the dummy interface, vip0 by default, or the NIC, the
+	// first VIP interface by default
+	Device string
+	// PrefixLen of BindInterface, 0 takes the one of the NIC's address
+	// covering the VIP, or a host prefix without one
+	PrefixLen int
+}
+
+// WithBinding binds the VIP elsewhere than on lo
+func WithBinding(b Binding) Option {
+	return func(v *virtualIpAddress) {
+		v.bind = b
+	}
+}
+
+// hostBinding is the binding of parseIP, a host prefix on lo
+func hostBinding(ip net.IP) Binding {
+	return Binding{Mode: BindLoopback, Device: "lo", PrefixLen: len(ip) * 8}
+}
+
+// leftoverBinding is the binding of a tagged address
+func leftoverBinding(a ifAddr) Binding {
+	b := Binding{Mode: BindInterface, Device: a.device, PrefixLen: a.prefixLen}
+	switch {
+	case a.device == "lo":
+		b.Mode = BindLoopback
+	case a.kind == "dummy":
+		b.Mode = BindDummy
+	}
+	return b
+}
+
+// resolveBinding fills in the defaults of v's binding, opLock is held
+func (m *Manager) resolveBinding(v *virtualIpAddress) (err error) {
+	b := &v.bind
+	switch b.Mode {
+	case BindLoopback:
+		b.Device = "lo"
+	case BindDummy:
+		if b.Device == "" {
+			b.Device = defaultDummy
+		}
+	case BindInterface:
+		if v.vmac != nil {
+			return errKernelAnswers
+		}
+		if b.Device == "" {
+			if len(m.vipInterfaces) == 0 {
+				return errNoVipInterface
+			}
+			b.Device = m.vipInterfaces[0].Name
+		}
+		if b.PrefixLen == 0 {
+			b.PrefixLen, err = m.subnetPrefixLen(b.Device, v.ip)
+			return
+		}
+	case BindNone:
+		return
+	default:
+		return fmt.Errorf("unknown bind mode %d", int(b.Mode))
+	}
+
+	if b.PrefixLen == 0 {
+		b.PrefixLen = len(v.ip) * 8
+	}
+	if b.PrefixLen < 0 || b.PrefixLen > len(v.ip)*8 {
+		return fmt.Errorf("invalid prefix length %d for %s", b.PrefixLen, v.address)
+	}
+	return
+}
+
+// subnetPrefixLen returns the prefix length of the address of dev covering
+// ip, or a host prefix
+func (m *Manager) subnetPrefixLen(dev string, ip net.IP) (ones int, err error) {
+	addrs, err := m.addrs.list()
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		if a.device != dev || (a.ip.To4() == nil) != (len(ip) == net.IPv6len) {
+			continue
+		}
+		if (&net.IPNet{IP: a.ip, Mask: net.CIDRMask(a.prefixLen, a.bits())}).Contains(ip) {
+			return a.prefixLen, nil
+		}
+	}
+	return len(ip) * 8, nil
+}
+
+// boundWhileDeclared tells whether Add binds the address, BindInterface
+// binds it on Enable
+func (v *virtualIpAddress) boundWhileDeclared() bool {
+	return v.bind.Mode != BindInterface && v.bind.Mode != BindNone
+}
+
+// kernelAnswers tells whether the kernel rather than the responder answers
+// requests for the VIP
+func (v *virtualIpAddress) kernelAnswers() bool {
+	return v.bind.Mode == BindInterface
+}
+
+// ensureDummy creates the dummy interface name unless it exists
+func (m *Manager) ensureDummy(name string) (err error) {
+	if _, err = m.links.interfaceByName(name); err == nil {
+		return
+	}
+	if err = m.ip("link", "add", name, "type", "dummy"); err != nil {
+		return
+	}
+	return m.ip("link", "set", name, "up")
+}
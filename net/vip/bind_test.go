@@ -0,0 +1,191 @@
+package vip
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseTagged(t *testing.T) {
+	addr := func(address string, prefixLen int, device, kind, label string, proto uint8) ifAddr {
+		return ifAddr{ip: net.ParseIP(address), prefixLen: prefixLen, device: device, kind: kind, label: label, proto: proto}
+	}
+	list := []ifAddr{
+		addr("127.0.0.1", 8, "lo", "", "lo", 0),
+		addr("10.0.0.100", 32, "lo", "", "lo:vip", vipProto),
+		// tagged by a kernel without address protocols
+		addr("10.0.0.104", 32, "lo", "", "lo:vip", 0),
+		addr("10.0.0.101", 32, "lo", "", "lo", 0),
+		addr("fd00::100", 128, "lo", "", "", vipProto),
+		// someone else's
+		addr("fd00::101", 128, "lo", "", "", 0),
+		addr("10.0.0.1", 24, "eth0", "veth", "eth0", 0),
+		addr("10.0.0.105", 24, "eth0", "veth", "eth0:vip", vipProto),
+		addr("fd00::105", 64, "eth0", "veth", "", vipProto),
+		addr("10.0.0.102", 32, "vip0", "dummy", "vip0:vip", vipProto),
+		addr("10.0.0.103", 32, "vip0", "dummy", "lo:vip", 0),
+		// setLookup binds host prefixes to dummies
+		addr("10.0.0.106", 24, "vip0", "dummy", "vip0:vip", vipProto),
+	}
+	want := map[string]Binding{
+		"10.0.0.100": {Mode: BindLoopback, Device: "lo", PrefixLen: 32},
+		"10.0.0.104": {Mode: BindLoopback, Device: "lo", PrefixLen: 32},
+		"fd00::100":  {Mode: BindLoopback, Device: "lo", PrefixLen: 128},
+		"10.0.0.102": {Mode: BindDummy, Device: "vip0", PrefixLen: 32},
+		"10.0.0.105": {Mode: BindInterface, Device: "eth0", PrefixLen: 24},
+		"fd00::105":  {Mode: BindInterface, Device: "eth0", PrefixLen: 64},
+	}
+	got := make(map[string]Binding)
+	for address, a := range parseTagged(list) {
+		got[address] = leftoverBinding(a)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tagged %v, want %v", got, want)
+	}
+}
+
+func TestIP4Label(t *testing.T) {
+	if l := ip4Label("eth0"); l != "eth0:vip" {
+		t.Fatalf("label %q", l)
+	}
+	// IFNAMSIZ holds 15 characters
+	if l := ip4Label("enx0123456789"); l != "" {
+		t.Fatalf("label %q of a long name", l)
+	}
+	a := ifAddr{ip: net.ParseIP("10.0.0.100"), device: "enx0123456789", proto: vipProto}
+	if !a.tagged() {
+		t.Fatal("not tagged by the protocol")
+	}
+}
+
+func TestSubnetPrefixLen(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.addrs.addrs = []ifAddr{
+		{ip: net.ParseIP("10.0.0.1").To4(), prefixLen: 24, device: "eth0"},
+		{ip: net.ParseIP("10.1.0.1").To4(), prefixLen: 16, device: "eth1"},
+		{ip: net.ParseIP("fd00::1"), prefixLen: 64, device: "eth0"},
+	}
+	cases := map[string]int{
+		"10.0.0.100": 24,
+		// on another device
+		"10.1.0.100": 32,
+		"fd00::100":  64,
+		"fd01::100":  128,
+	}
+	for address, want := range cases {
+		v, _ := parseIP(address)
+		WithBinding(Binding{Mode: BindInterface})(v)
+		if err := n.m.resolveBinding(v); err != nil {
+			t.Fatal(err)
+		}
+		if v.bind.PrefixLen != want {
+			t.Errorf("%s: prefix length %d, want %d", address, v.bind.PrefixLen, want)
+		}
+	}
+}
+
+func TestAdoptInterface(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.addrs.addrs = []ifAddr{
+		{ip: net.ParseIP("10.0.0.1").To4(), prefixLen: 24, device: "eth0", kind: "veth"},
+		{ip: net.ParseIP("10.0.0.100").To4(), prefixLen: 24, device: "eth0", kind: "veth", label: "eth0:vip", proto: vipProto},
+	}
+	adopted, err := n.m.adopt()
+	if err != nil || !reflect.DeepEqual(adopted, []string{"10.0.0.100"}) {
+		t.Fatalf("adopted %v, %v", adopted, err)
+	}
+	// the kernel must not answer before Enable
+	if s, _ := n.m.GetState("10.0.0.100"); s != StateBound || len(n.addrs.addrs) != 1 {
+		t.Fatalf("%s with addresses %v", s, n.addrs.addrs)
+	}
+	if err = n.m.enable("10.0.0.100"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"address del 10.0.0.100/24 dev eth0", "address replace 10.0.0.100/24 dev eth0"}
+	if !reflect.DeepEqual(n.ip.cmds, want) {
+		t.Fatalf("ip %q, want %q", n.ip.cmds, want)
+	}
+}
+
+func TestAddrMessage(t *testing.T) {
+	for _, a := range []ifAddr{
+		{ip: net.ParseIP("10.0.0.100").To4(), prefixLen: 32, device: "lo", label: "lo:vip", proto: vipProto},
+		{ip: net.ParseIP("fd00::100"), prefixLen: 64, device: "lo", flags: ifaFNodad, proto: vipProto},
+	} {
+		data, err := addrMessage(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWADDR}, Data: data}
+		got, index, ok := parseAddr(&msg)
+		if !ok {
+			t.Fatalf("%s not parsed", a)
+		}
+		if lo, _ := net.InterfaceByName("lo"); index != lo.Index {
+			t.Fatalf("%s: index %d, want %d", a, index, lo.Index)
+		}
+		got.device = a.device
+		if !reflect.DeepEqual(got, a) {
+			t.Fatalf("parsed %+v, want %+v", got, a)
+		}
+	}
+}
+
+func TestResolveBinding(t *testing.T) {
+	cases := []struct {
+		name    string
+		address string
+		b       Binding
+		want    Binding
+		fails   bool
+	}{
+		{name: "default", address: "10.0.0.100", want: Binding{Mode: BindLoopback, Device: "lo", PrefixLen: 32}},
+		{name: "dummy", address: "fd00::100", b: Binding{Mode: BindDummy},
+			want: Binding{Mode: BindDummy, Device: "vip0", PrefixLen: 128}},
+		{name: "interface", address: "10.0.0.100", b: Binding{Mode: BindInterface, PrefixLen: 24},
+			want: Binding{Mode: BindInterface, Device: "eth0", PrefixLen: 24}},
+		{name: "none", address: "10.0.0.100", b: Binding{Mode: BindNone}, want: Binding{Mode: BindNone}},
+		{name: "prefix too long", address: "10.0.0.100", b: Binding{Mode: BindDummy, PrefixLen: 33}, fails: true},
+		{name: "unknown", address: "10.0.0.100", b: Binding{Mode: 9}, fails: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := newFakeNode(t, eth0)
+			n.m.vipInterfaces = []*net.Interface{eth0}
+			v, err := parseIP(c.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.b != (Binding{}) {
+				WithBinding(c.b)(v)
+			}
+			err = n.m.resolveBinding(v)
+			if c.fails {
+				if err == nil {
+					t.Fatalf("resolved to %+v", v.bind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.bind != c.want {
+				t.Fatalf("binding %+v, want %+v", v.bind, c.want)
+			}
+		})
+	}
+
+	// the kernel's replies carry the NIC's MAC
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	v, _ := parseIP("10.0.0.100")
+	WithVirtualMAC(5, VirtualMACSpoof)(v)
+	WithBinding(Binding{Mode: BindInterface, PrefixLen: 24})(v)
+	if err := n.m.resolveBinding(v); err != errKernelAnswers {
+		t.Fatalf("virtual MAC on the interface: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package vip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/adoyee/go-utils/net/arp"
+)
+
+// classic BPF opcodes, see linux/filter.h
+const (
+	bpfLdW    = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfLdH    = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS
+	bpfLdIndW = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_IND
+	bpfLdIndH = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND
+	bpfLdIndB = syscall.BPF_LD | syscall.BPF_B | syscall.BPF_IND
+	bpfLdxImm = syscall.BPF_LDX | syscall.BPF_W | syscall.BPF_IMM
+	bpfLsh    = syscall.BPF_ALU | syscall.BPF_LSH | syscall.BPF_K
+	bpfAddX   = syscall.BPF_ALU | syscall.BPF_ADD | syscall.BPF_X
+	bpfAnd    = syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K
+	bpfTax    = syscall.BPF_MISC | syscall.BPF_TAX
+	bpfJa     = syscall.BPF_JMP | syscall.BPF_JA
+	bpfJeq    = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfRet    = syscall.BPF_RET | syscall.BPF_K
+	bpfDrop   = 0
+	bpfWhole  = 0xffffffff
+
+	bpfMaxInstructions = 4096
+
+	// ancillary data, loads relative to skfAdOff read skb fields
+	skfAdOff      = 0xfffff000
+	skfAdProtocol = 0
+	skfAdPktType  = 4
+	skfAdIfIndex  = 8
+	// loads relative to skfNetOff start at the network header, which is the
+	// arp packet, or the inner tag of a QinQ frame
+	skfNetOff = 0xfff00000
+)
+
+var errFilterTooLong = errors.New("bpf program too long")
+
+type bpfJump struct {
+	at     int
+	label  string
+	isTrue bool
+}
+
+// bpfAsm assembles a classic BPF program, jumps refer to labels, an empty
+// label continues with the next instruction
+type bpfAsm struct {
+	ins    []syscall.SockFilter
+	labels map[string]int
+	jumps  []bpfJump
+}
+
+func (a *bpfAsm) emit(code uint16, k uint32) {
+	a.ins = append(a.ins, syscall.SockFilter{Code: code, K: k})
+}
+
+func (a *bpfAsm) jeq(k uint32, jt, jf string) {
+	at := len(a.ins)
+	a.emit(bpfJeq, k)
+	if jt != "" {
+		a.jumps = append(a.jumps, bpfJump{at: at, label: jt, isTrue: true})
+	}
+	if jf != "" {
+		a.jumps = append(a.jumps, bpfJump{at: at, label: jf})
+	}
+}
+
+func (a *bpfAsm) ja(label string) {
+	a.jumps = append(a.jumps, bpfJump{at: len(a.ins), label: label})
+	a.emit(bpfJa, 0)
+}
+
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.ins)
+}
+
+func (a *bpfAsm) assemble() (filter []syscall.SockFilter, err error) {
+	if len(a.ins) > bpfMaxInstructions {
+		return nil, errFilterTooLong
+	}
+
+	for _, j := range a.jumps {
+		to, ok := a.labels[j.label]
+		if !ok || to <= j.at {
+			return nil, syscall.EINVAL
+		}
+		offset := to - j.at - 1
+
+		ins := &a.ins[j.at]
+		switch {
+		case ins.Code == bpfJa:
+			ins.K = uint32(offset)
+		case offset > 0xff:
+			return nil, errFilterTooLong
+		case j.isTrue:
+			ins.Jt = uint8(offset)
+		default:
+			ins.Jf = uint8(offset)
+		}
+	}
+	return a.ins, nil
+}
+
+// arpFilter passes received ARP requests, also those still carrying an inner
+// 802.1Q tag after the kernel moved the outer tag of a QinQ frame out of band.
+// Non empty ifIndexes further restrict the receiving interface, non empty
+// targets or prefixes the requested address.
+func arpFilter(ifIndexes []int, targets []net.IP, prefixes []*net.IPNet) (filter []syscall.SockFilter, err error) {
+	a := new(bpfAsm)
+
+	a.emit(bpfLdH, skfAdOff+skfAdPktType)
+	a.jeq(syscall.PACKET_OUTGOING, "drop", "")
+
+	if len(ifIndexes) != 0 {
+		a.emit(bpfLdW, skfAdOff+skfAdIfIndex)
+		for i, idx := range ifIndexes {
+			if i == len(ifIndexes)-1 {
+				a.jeq(uint32(idx), "", "drop")
+			} else {
+				a.jeq(uint32(idx), "protocol", "")
+			}
+		}
+	}
+
+	a.label("protocol")
+	a.emit(bpfLdH, skfAdOff+skfAdProtocol)
+	a.jeq(syscall.ETH_P_ARP, "plain", "")
+	a.jeq(syscall.ETH_P_8021Q, "qinq", "")
+	a.jeq(arp.EtherTypeServiceVLAN, "qinq", "drop")
+
+	a.label("qinq")
+	a.emit(bpfLdH, skfNetOff+2)
+	a.jeq(syscall.ETH_P_ARP, "", "drop")
+	a.emit(bpfLdxImm, 4)
+	a.ja("request")
+
+	a.label("plain")
+	a.emit(bpfLdxImm, 0)
+
+	// x holds the offset of the arp packet from the network header
+	a.label("request")
+	a.emit(bpfLdIndH, skfNetOff+6)
+	a.jeq(arp.OperationRequest, "", "drop")
+
+	if len(targets) == 0 && len(prefixes) == 0 {
+		a.emit(bpfRet, bpfWhole)
+		a.label("drop")
+		a.emit(bpfRet, bpfDrop)
+		return a.assemble()
+	}
+
+	a.ja("target")
+	a.label("drop")
+	a.emit(bpfRet, bpfDrop)
+
+	// target protocol address follows 8 bytes of header, the sender addresses
+	// and the target hardware address
+	a.label("target")
+	a.emit(bpfLdIndB, skfNetOff+4)
+	a.emit(bpfLsh, 1)
+	a.emit(bpfAddX, 0)
+	a.emit(bpfTax, 0)
+	a.emit(bpfLdIndW, skfNetOff+8+net.IPv4len)
+	for _, ip := range targets {
+		a.jeq(binary.BigEndian.Uint32(ip.To4()), "", "")
+		a.ins[len(a.ins)-1].Jf = 1
+		a.emit(bpfRet, bpfWhole)
+	}
+	for _, p := range prefixes {
+		a.emit(bpfLdIndW, skfNetOff+8+net.IPv4len)
+		a.emit(bpfAnd, binary.BigEndian.Uint32(p.Mask))
+		a.jeq(binary.BigEndian.Uint32(p.IP.To4()), "", "")
+		a.ins[len(a.ins)-1].Jf = 1
+		a.emit(bpfRet, bpfWhole)
+	}
+	a.emit(bpfRet, bpfDrop)
+	return a.assemble()
+}
+
+func (as *arpSocket) attachFilter(filter []syscall.SockFilter) error {
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	err := as.control(func(fd int) error {
+		_, _, e := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd),
+			syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER,
+			uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+		if e != 0 {
+			return e
+		}
+		return nil
+	})
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
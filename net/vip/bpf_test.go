@@ -0,0 +1,138 @@
+package vip
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/adoyee/go-utils/net/arp"
+	"golang.org/x/net/bpf"
+)
+
+// the VM has no skb, skbHeader holds the fields the filter loads from it
+// in front of the network header
+const (
+	skbPktType  = 0
+	skbProtocol = 2
+	skbIfIndex  = 4
+	skbHeader   = 8
+)
+
+type skb struct {
+	pktType  uint16
+	protocol uint16
+	ifIndex  uint32
+	// network is the data from the network header on
+	network []byte
+}
+
+func (s skb) bytes() []byte {
+	b := make([]byte, skbHeader, skbHeader+len(s.network))
+	binary.BigEndian.PutUint16(b[skbPktType:], s.pktType)
+	binary.BigEndian.PutUint16(b[skbProtocol:], s.protocol)
+	binary.BigEndian.PutUint32(b[skbIfIndex:], s.ifIndex)
+	return append(b, s.network...)
+}
+
+// filterVM runs filter with its ancillary and network header loads moved
+// onto the skbHeader layout
+func filterVM(t *testing.T, filter []syscall.SockFilter) *bpf.VM {
+	ancillary := map[uint32]uint32{
+		skfAdOff + skfAdPktType:  skbPktType,
+		skfAdOff + skfAdProtocol: skbProtocol,
+		skfAdOff + skfAdIfIndex:  skbIfIndex,
+	}
+	ins := make([]bpf.Instruction, 0, len(filter))
+	for _, f := range filter {
+		k := f.K
+		if f.Code&0x07 == syscall.BPF_LD && (f.Code&0xe0 == syscall.BPF_ABS || f.Code&0xe0 == syscall.BPF_IND) {
+			if off, ok := ancillary[k]; ok {
+				k = off
+			} else if k >= skfNetOff {
+				k = k - skfNetOff + skbHeader
+			}
+		}
+		ins = append(ins, bpf.RawInstruction{Op: f.Code, Jt: f.Jt, Jf: f.Jf, K: k}.Disassemble())
+	}
+	vm, err := bpf.NewVM(ins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func arpPacket(t *testing.T, op uint16, target string) []byte {
+	p, err := arp.NewPacket(op, 1, requesterMAC, net.ParseIP("10.0.0.2"),
+		net.HardwareAddr{0, 0, 0, 0, 0, 0}, net.ParseIP(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestARPFilter(t *testing.T) {
+	request := arpPacket(t, arp.OperationRequest, "10.0.0.100")
+	// the kernel took the outer tag, the network header is the inner one
+	qinq := append([]byte{0x01, 0x2c, 0x08, 0x06}, request...)
+
+	cases := []struct {
+		name string
+		skb  skb
+		pass bool
+	}{
+		{name: "request", skb: skb{protocol: syscall.ETH_P_ARP, ifIndex: 2, network: request}, pass: true},
+		{name: "QinQ request", skb: skb{protocol: syscall.ETH_P_8021Q, ifIndex: 2, network: qinq}, pass: true},
+		{name: "service tag", skb: skb{protocol: arp.EtherTypeServiceVLAN, ifIndex: 2, network: qinq}, pass: true},
+		{name: "other target", skb: skb{protocol: syscall.ETH_P_ARP, ifIndex: 2,
+			network: arpPacket(t, arp.OperationRequest, "10.0.0.99")}},
+		{name: "in subnet", skb: skb{protocol: syscall.ETH_P_ARP, ifIndex: 2,
+			network: arpPacket(t, arp.OperationRequest, "10.1.0.7")}, pass: true},
+		{name: "other QinQ target", skb: skb{protocol: syscall.ETH_P_8021Q, ifIndex: 2,
+			network: append([]byte{0x01, 0x2c, 0x08, 0x06}, arpPacket(t, arp.OperationRequest, "10.0.0.99")...)}},
+		{name: "reply", skb: skb{protocol: syscall.ETH_P_ARP, ifIndex: 2,
+			network: arpPacket(t, arp.OperationReply, "10.0.0.100")}},
+		{name: "tagged IPv4", skb: skb{protocol: syscall.ETH_P_8021Q, ifIndex: 2,
+			network: append([]byte{0x01, 0x2c, 0x08, 0x00}, request...)}},
+		{name: "IPv4", skb: skb{protocol: syscall.ETH_P_IP, ifIndex: 2, network: request}},
+		{name: "outgoing", skb: skb{pktType: syscall.PACKET_OUTGOING, protocol: syscall.ETH_P_ARP, ifIndex: 2, network: request}},
+		{name: "other interface", skb: skb{protocol: syscall.ETH_P_ARP, ifIndex: 3, network: request}},
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/24")
+	filter, err := arpFilter([]int{2, 4}, []net.IP{net.ParseIP("10.0.0.100")}, []*net.IPNet{subnet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := filterVM(t, filter)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n, err := vm.Run(c.skb.bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pass := n != 0; pass != c.pass {
+				t.Fatalf("passed %v, want %v", pass, c.pass)
+			}
+		})
+	}
+
+	// without VIPs or interfaces every received request passes
+	filter, err = arpFilter(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = filterVM(t, filter)
+	for _, s := range []skb{
+		{protocol: syscall.ETH_P_ARP, ifIndex: 3, network: arpPacket(t, arp.OperationRequest, "10.0.0.99")},
+		{protocol: syscall.ETH_P_8021Q, ifIndex: 7, network: qinq},
+	} {
+		if n, err := vm.Run(s.bytes()); err != nil || n == 0 {
+			t.Fatalf("request dropped, %v", err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package vip
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/adoyee/go-utils/net/arp"
+	"github.com/adoyee/go-utils/net/pcap"
+	"golang.org/x/net/ipv6"
+)
+
+// capture writes the ARP and NDP traffic of the listeners, limited to some
+// VIPs when vips is not empty
+type capture struct {
+	w    *pcap.Writer
+	vips map[string]bool
+
+	lock  sync.Mutex
+	names map[int]string
+}
+
+func StartCapture(w *pcap.Writer, vips ...string) error {
+	return defaultManager.StartCapture(w, vips...)
+}
+
+// StartCapture records what the listeners receive and send to w until
+// StopCapture, only frames about vips unless none are given. Frames of links
+// without an ethernet header are not recorded.
+func (m *Manager) StartCapture(w *pcap.Writer, vips ...string) error {
+	c := &capture{
+		w:     w,
+		vips:  make(map[string]bool),
+		names: make(map[int]string),
+	}
+	for _, address := range vips {
+		v, err := parseIP(address)
+		if err != nil {
+			return err
+		}
+		c.vips[v.ip.String()] = true
+	}
+	m.capture.Store(c)
+	return nil
+}
+
+func StopCapture() {
+	defaultManager.StopCapture()
+}
+
+func (m *Manager) StopCapture() {
+	m.capture.Store((*capture)(nil))
+}
+
+func (m *Manager) capturing() *capture {
+	c, _ := m.capture.Load().(*capture)
+	return c
+}
+
+func (c *capture) match(ips ...net.IP) bool {
+	if len(c.vips) == 0 {
+		return true
+	}
+	for _, ip := range ips {
+		if ip != nil && c.vips[ip.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceName is looked up once per interface, replays map it back
+func (c *capture) interfaceName(links linkInfo, ifIndex int) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	name, ok := c.names[ifIndex]
+	if !ok {
+		if ifc, err := links.interfaceByIndex(ifIndex); err == nil {
+			name = ifc.Name
+		}
+		c.names[ifIndex] = name
+	}
+	return name
+}
+
+func (c *capture) write(links linkInfo, ifIndex int, linkType uint16, outbound bool, data []byte) {
+	err := c.w.WritePacket(pcap.PacketInfo{
+		Interface: c.interfaceName(links, ifIndex),
+		LinkType:  linkType,
+		Outbound:  outbound,
+	}, data)
+	if err != nil {
+		log.Println("capture ", err)
+	}
+}
+
+// captureFrame records an ethernet frame carrying packet, VLAN tags inline
+func (l *vipListener4) captureFrame(ifIndex int, frame *arp.Frame, packet *arp.Packet, outbound bool) {
+	c := l.m.capturing()
+	if c == nil || l.replay || !c.match(packet.SenderIP, packet.TargetIP) {
+		return
+	}
+	data, err := frame.MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.write(l.m.links, ifIndex, pcap.LinkTypeEthernet, outbound, data)
+}
+
+// captureMessage records an ICMPv6 message, which the socket sees without
+// its IPv6 header
+func (l *listener6) captureMessage(ifIndex int, src, dst net.IP, msg []byte, outbound bool) {
+	c := l.m.capturing()
+	if c == nil || l.replay || len(msg) < 24 || !c.match(net.IP(msg[8:24])) {
+		return
+	}
+	c.write(l.m.links, ifIndex, pcap.LinkTypeRaw, outbound, pcap.ICMPv6(src, dst, msg))
+}
+
+func Replay(r *pcap.Reader, w *pcap.Writer) (replies int, err error) {
+	return defaultManager.Replay(r, w)
+}
+
+// Replay feeds the requests received in a capture to m as if they arrived
+// now, the replies are written to w instead of the network, nil drops them.
+// Interfaces are matched by name with the ones in m's namespace, the VIPs,
+// policies and counters are m's own.
+func (m *Manager) Replay(r *pcap.Reader, w *pcap.Writer) (replies int, err error) {
+	err = m.ns.Do(func() error {
+		replies, err = m.replay(r, w)
+		return err
+	})
+	return
+}
+
+func (m *Manager) replay(r *pcap.Reader, w *pcap.Writer) (replies int, err error) {
+	out := &replayConn{m: m, w: w}
+	l4 := &vipListener4{m: m, socket: out, cooked: out, replay: true}
+	l6 := &listener6{m: m, conn: out, gm: newGroupMap(), replay: true}
+
+	for {
+		info, data, err := r.ReadPacket()
+		if err == io.EOF {
+			return replies, nil
+		}
+		if err != nil {
+			return replies, err
+		}
+		if info.Outbound {
+			continue
+		}
+
+		ifc, err := m.links.interfaceByName(info.Interface)
+		if err != nil {
+			log.Printf("replay %s: %v", info.Interface, err)
+			continue
+		}
+
+		var req vipRequest
+		switch info.LinkType {
+		case pcap.LinkTypeEthernet:
+			from := &syscall.SockaddrLinklayer{
+				Protocol: htons(syscall.ETH_P_ARP),
+				Ifindex:  ifc.Index,
+				Hatype:   syscall.ARPHRD_ETHER,
+			}
+			if r := l4.parse(data, nil, from); r != nil {
+				req = r
+			}
+		case pcap.LinkTypeRaw:
+			src, dst, next, msg, err := pcap.ParseIPv6(data)
+			if err != nil || next != ipProtocolICMP6 {
+				continue
+			}
+			cm := &ipv6.ControlMessage{Src: src, Dst: dst, IfIndex: ifc.Index}
+			if r := l6.parse(msg, cm, &net.IPAddr{IP: src}); r != nil {
+				req = r
+			}
+		}
+		if req == nil {
+			continue
+		}
+
+		replied, err := m.handle(req)
+		if err != nil {
+			log.Println("replay ", err)
+		}
+		if replied {
+			replies++
+		}
+	}
+}
+
+// replayConn takes the replies of a replay, as packetConn for ARP and as
+// icmpConn for NDP
+type replayConn struct {
+	m *Manager
+	w *pcap.Writer
+}
+
+func (c *replayConn) write(ifIndex int, linkType uint16, data []byte) error {
+	if c.w == nil {
+		return nil
+	}
+	info := pcap.PacketInfo{LinkType: linkType, Outbound: true}
+	if ifc, err := c.m.links.interfaceByIndex(ifIndex); err == nil {
+		info.Interface = ifc.Name
+	}
+	return c.w.WritePacket(info, data)
+}
+
+func (c *replayConn) readFrame() (data, oob []byte, from *syscall.SockaddrLinklayer, err error) {
+	return nil, nil, nil, io.EOF
+}
+
+func (c *replayConn) sendTo(buff []byte, ifIndex int, protocol uint16, hwAddr net.HardwareAddr) error {
+	// replays only parse ethernet frames, so replies are never cooked
+	return c.write(ifIndex, pcap.LinkTypeEthernet, buff)
+}
+
+func (c *replayConn) attachFilter(filter []syscall.SockFilter) error {
+	return nil
+}
+
+func (c *replayConn) bind(ifIndex int) error {
+	return nil
+}
+
+func (c *replayConn) close() error {
+	return nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+func (c *replayConn) ReadFrom(b []byte) (n int, cm *ipv6.ControlMessage, src net.Addr, err error) {
+	return 0, nil, nil, io.EOF
+}
+
+func (c *replayConn) WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (n int, err error) {
+	var dstIP net.IP
+	if a, ok := dst.(*net.IPAddr); ok {
+		dstIP = a.IP
+	}
+	if err = c.write(cm.IfIndex, pcap.LinkTypeRaw, pcap.ICMPv6(cm.Src, dstIP, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *replayConn) JoinGroup(ifi *net.Interface, group net.Addr) error {
+	return nil
+}
+
+func (c *replayConn) LeaveGroup(ifi *net.Interface, group net.Addr) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package vip
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/adoyee/go-utils/net/arp"
+	"github.com/adoyee/go-utils/net/pcap"
+	"golang.org/x/net/ipv6"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	qinq := etherFrame(frameRequestInnerTag, eth0)
+	qinq.oob = auxdataOOB(tpacketAuxdata{
+		status:   tpStatusVlanValid | tpStatusVlanTpidValid,
+		vlanTCI:  200,
+		vlanTPID: arp.EtherTypeServiceVLAN,
+	})
+
+	n := newFakeNode(t, eth0)
+	n.announce(t, "10.0.0.100")
+	n.announce(t, "10.0.0.101")
+	n.announce(t, "fd00::100")
+
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.StartCapture(w, "10.0.0.100", "fd00::100"); err != nil {
+		t.Fatal(err)
+	}
+
+	n.raw.frames = []fakeFrame{qinq, etherFrame(frameRequestOther, eth0)}
+	n.icmp.in = []fakeMessage{{
+		data: mustHex(messageSolicitation),
+		cm:   &ipv6.ControlMessage{IfIndex: eth0.Index, Src: net.ParseIP("fd00::2"), Dst: net.ParseIP("ff02::1:ff00:100")},
+		addr: &net.IPAddr{IP: net.ParseIP("fd00::2")},
+	}}
+	for _, l := range []vipListener{n.m.l4, n.m.l6} {
+		for {
+			req, err := l.accept()
+			if err == io.EOF {
+				break
+			}
+			if _, err = n.m.handle(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n.m.StopCapture()
+	if err := n.m.l4.gratuitous(net.ParseIP("10.0.0.100").To4()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request and reply of each VIP, not those of 10.0.0.101
+	captured := buf.Bytes()
+	r, err := pcap.NewReader(bytes.NewReader(captured))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inbound, outbound int
+	for {
+		info, data, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Interface != eth0.Name {
+			t.Fatalf("captured on %q", info.Interface)
+		}
+		if info.LinkType == pcap.LinkTypeEthernet {
+			var f arp.Frame
+			if err := f.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.VLANs) != 2 {
+				t.Fatalf("captured VLANs %v, want both tags", f.VLANs)
+			}
+		}
+		if info.Outbound {
+			outbound++
+		} else {
+			inbound++
+		}
+	}
+	if inbound != 2 || outbound != 2 {
+		t.Fatalf("captured %d received and %d sent, want 2 and 2", inbound, outbound)
+	}
+
+	// another node answers the captured requests the same way
+	other := newFakeNode(t, eth0)
+	other.announce(t, "10.0.0.100")
+	other.announce(t, "fd00::100")
+	r, _ = pcap.NewReader(bytes.NewReader(captured))
+	var replies bytes.Buffer
+	rw, _ := pcap.NewWriter(&replies)
+	n2, err := other.m.Replay(r, rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n2 != 2 {
+		t.Fatalf("replayed %d replies, want 2", n2)
+	}
+	if len(other.raw.sent)+len(other.icmp.sent) != 0 {
+		t.Fatal("replay sent to the network")
+	}
+
+	rr, err := pcap.NewReader(&replies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		info, _, err := rr.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Outbound || info.Interface != eth0.Name {
+			t.Fatalf("replay wrote %+v", info)
+		}
+	}
+}
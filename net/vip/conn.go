@@ -0,0 +1,201 @@
+package vip
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/ipv6"
+)
+
+// packetConn is the link-layer socket ARP is received and answered on, the
+// listeners only use it through this so tests can feed them frames
+type packetConn interface {
+	// readFrame returns the next frame with its auxdata control message, the
+	// buffers are reused by the next call
+	readFrame() (data, oob []byte, from *syscall.SockaddrLinklayer, err error)
+	sendTo(buff []byte, ifIndex int, protocol uint16, hwAddr net.HardwareAddr) error
+	attachFilter(filter []syscall.SockFilter) error
+	// bind receives from one interface, 0 for all of them
+	bind(ifIndex int) error
+	close() error
+}
+
+// icmpConn is the ICMPv6 socket solicitations are received and answered
+// on, *ipv6.PacketConn implements it
+type icmpConn interface {
+	ReadFrom(b []byte) (n int, cm *ipv6.ControlMessage, src net.Addr, err error)
+	WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (n int, err error)
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	Close() error
+}
+
+// linkInfo looks up the interfaces requests arrive on
+type linkInfo interface {
+	interfaceByIndex(index int) (*net.Interface, error)
+	interfaceByName(name string) (*net.Interface, error)
+	// linkLayer returns the ARP hardware type and broadcast address
+	linkLayer(ifc *net.Interface) (hwType uint16, broadcast net.HardwareAddr, err error)
+	hasVlanDevice(ifIndex int, id uint16) bool
+}
+
+// systemLinks asks the kernel of the calling thread's namespace. VLAN
+// devices are looked up in /proc, which is too slow for every frame, so they
+// are cached while watch sees the link changes.
+type systemLinks struct {
+	// lookupVlan is hasVlanDevice, replaced by tests
+	lookupVlan func(ifIndex int, id uint16) bool
+
+	lock sync.Mutex
+	// vlans is nil while the links are not watched, gen counts the times
+	// it was dropped
+	vlans map[vlanKey]bool
+	gen   uint64
+	watch *os.File
+}
+
+// rtmgrpLink is the multicast group of link changes, see linux/rtnetlink.h
+const rtmgrpLink = 0x1
+
+type vlanKey struct {
+	ifIndex int
+	id      uint16
+}
+
+func newSystemLinks() *systemLinks {
+	return &systemLinks{lookupVlan: hasVlanDevice}
+}
+
+func (*systemLinks) interfaceByIndex(index int) (*net.Interface, error) {
+	return net.InterfaceByIndex(index)
+}
+
+func (*systemLinks) interfaceByName(name string) (*net.Interface, error) {
+	return net.InterfaceByName(name)
+}
+
+func (*systemLinks) linkLayer(ifc *net.Interface) (hwType uint16, broadcast net.HardwareAddr, err error) {
+	return linkLayer(ifc)
+}
+
+func (l *systemLinks) hasVlanDevice(ifIndex int, id uint16) bool {
+	key := vlanKey{ifIndex: ifIndex, id: id}
+	l.lock.Lock()
+	has, ok := l.vlans[key]
+	gen := l.gen
+	l.lock.Unlock()
+	if ok {
+		return has
+	}
+
+	has = l.lookupVlan(ifIndex, id)
+	l.lock.Lock()
+	// a link changed meanwhile, the answer may be stale already
+	if l.vlans != nil && l.gen == gen {
+		l.vlans[key] = has
+	}
+	l.lock.Unlock()
+	return has
+}
+
+// startWatch caches VLAN devices until a link of the calling thread's
+// namespace changes
+func (l *systemLinks) startWatch() (err error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}); err != nil {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("setnonblock", err)
+	}
+
+	l.lock.Lock()
+	l.watch = os.NewFile(uintptr(fd), "link-watch")
+	l.vlans = make(map[vlanKey]bool)
+	l.lock.Unlock()
+	go l.watchLinks(l.watch)
+	return
+}
+
+func (l *systemLinks) watchLinks(f *os.File) {
+	buff := make([]byte, os.Getpagesize())
+	for {
+		_, err := f.Read(buff)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOBUFS {
+			// notifications were dropped, the links changed anyway
+			err = nil
+		}
+
+		l.lock.Lock()
+		l.gen++
+		if err != nil {
+			l.vlans = nil
+			l.lock.Unlock()
+			if !isClosed(err) {
+				log.Println("link watch ", err)
+			}
+			return
+		}
+		l.vlans = make(map[vlanKey]bool)
+		l.lock.Unlock()
+	}
+}
+
+// stopWatch closes the watch, VLAN devices are looked up every time then
+func (l *systemLinks) stopWatch() (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.watch != nil {
+		err = l.watch.Close()
+		l.watch = nil
+	}
+	return
+}
+
+func (as *arpSocket) readFrame() (data, oob []byte, from *syscall.SockaddrLinklayer, err error) {
+	if as.batch == nil {
+		as.batch = newArpBatch(batchSize)
+	}
+
+	for {
+		data, oob, from, truncated, ok := as.batch.frame()
+		if !ok {
+			if err = as.recvBatch(as.batch); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		if truncated {
+			continue
+		}
+		return data, oob, from, nil
+	}
+}
+
+func (as *arpSocket) bind(ifIndex int) error {
+	err := as.control(func(fd int) error {
+		return syscall.Bind(fd, &syscall.SockaddrLinklayer{
+			Protocol: htons(syscall.ETH_P_ALL),
+			Ifindex:  ifIndex,
+		})
+	})
+	if err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	return nil
+}
+
+// isClosed tells whether err comes from using a closed file, sockets
+// closed by the Manager report os.ErrClosed as well
+func isClosed(err error) bool {
+	return errors.Is(err, os.ErrClosed)
+}
@@ -0,0 +1,47 @@
+package vip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adoyee/go-utils/net/internal/nstest"
+)
+
+func TestVlanCache(t *testing.T) {
+	p := nstest.NewPair(t)
+	lookups := 0
+	l := newSystemLinks()
+	l.lookupVlan = func(ifIndex int, id uint16) bool {
+		lookups++
+		return id == 100
+	}
+
+	// without a watch every frame looks the devices up
+	l.hasVlanDevice(2, 100)
+	l.hasVlanDevice(2, 100)
+	if lookups != 2 {
+		t.Fatalf("%d lookups unwatched, want 2", lookups)
+	}
+
+	if err := p.Local.NS.Do(l.startWatch); err != nil {
+		t.Fatal(err)
+	}
+	defer l.stopWatch()
+	lookups = 0
+	if !l.hasVlanDevice(2, 100) || !l.hasVlanDevice(2, 100) || l.hasVlanDevice(2, 200) {
+		t.Fatal("wrong VLAN devices")
+	}
+	if lookups != 2 {
+		t.Fatalf("%d lookups watched, want 2", lookups)
+	}
+
+	// a changed link drops the cache
+	p.Local.IP(t, "link", "set", p.Local.Link, "mtu", "1400")
+	deadline := time.Now().Add(probeTimeout)
+	for l.hasVlanDevice(2, 100); lookups == 2; l.hasVlanDevice(2, 100) {
+		if time.Now().After(deadline) {
+			t.Fatal("cache kept after a link change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
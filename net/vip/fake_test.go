@@ -0,0 +1,276 @@
+package vip
+
+import (
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/net/ipv6"
+)
+
+type fakeFrame struct {
+	data []byte
+	oob  []byte
+	from *syscall.SockaddrLinklayer
+}
+
+type sentFrame struct {
+	data     []byte
+	ifIndex  int
+	protocol uint16
+	hwAddr   net.HardwareAddr
+}
+
+// fakePacketConn hands out queued frames and records what is sent, reads
+// fail with io.EOF once the queue is empty
+type fakePacketConn struct {
+	frames []fakeFrame
+	sent   []sentFrame
+	filter []syscall.SockFilter
+	bound  int
+}
+
+func (c *fakePacketConn) readFrame() (data, oob []byte, from *syscall.SockaddrLinklayer, err error) {
+	if len(c.frames) == 0 {
+		return nil, nil, nil, io.EOF
+	}
+	f := c.frames[0]
+	c.frames = c.frames[1:]
+	return f.data, f.oob, f.from, nil
+}
+
+func (c *fakePacketConn) sendTo(buff []byte, ifIndex int, protocol uint16, hwAddr net.HardwareAddr) error {
+	c.sent = append(c.sent, sentFrame{
+		data:     append([]byte(nil), buff...),
+		ifIndex:  ifIndex,
+		protocol: protocol,
+		hwAddr:   hwAddr,
+	})
+	return nil
+}
+
+func (c *fakePacketConn) attachFilter(filter []syscall.SockFilter) error {
+	c.filter = filter
+	return nil
+}
+
+func (c *fakePacketConn) bind(ifIndex int) error {
+	c.bound = ifIndex
+	return nil
+}
+
+func (c *fakePacketConn) close() error {
+	return nil
+}
+
+type fakeMessage struct {
+	data []byte
+	cm   *ipv6.ControlMessage
+	addr net.Addr
+}
+
+// fakeICMPConn is fakePacketConn for ICMPv6
+type fakeICMPConn struct {
+	in     []fakeMessage
+	sent   []fakeMessage
+	groups map[string]bool
+}
+
+func (c *fakeICMPConn) ReadFrom(b []byte) (n int, cm *ipv6.ControlMessage, src net.Addr, err error) {
+	if len(c.in) == 0 {
+		return 0, nil, nil, io.EOF
+	}
+	m := c.in[0]
+	c.in = c.in[1:]
+	return copy(b, m.data), m.cm, m.addr, nil
+}
+
+func (c *fakeICMPConn) WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (n int, err error) {
+	c.sent = append(c.sent, fakeMessage{data: append([]byte(nil), b...), cm: cm, addr: dst})
+	return len(b), nil
+}
+
+func (c *fakeICMPConn) JoinGroup(ifi *net.Interface, group net.Addr) error {
+	c.groups[group.String()] = true
+	return nil
+}
+
+func (c *fakeICMPConn) LeaveGroup(ifi *net.Interface, group net.Addr) error {
+	delete(c.groups, group.String())
+	return nil
+}
+
+func (c *fakeICMPConn) Close() error {
+	return nil
+}
+
+// fakeLinks knows the interfaces of a test
+type fakeLinks struct {
+	interfaces map[int]*net.Interface
+	hwTypes    map[int]uint16
+	vlans      map[int][]uint16
+}
+
+func (l *fakeLinks) interfaceByIndex(index int) (*net.Interface, error) {
+	if ifc, ok := l.interfaces[index]; ok {
+		return ifc, nil
+	}
+	return nil, errNoLink
+}
+
+func (l *fakeLinks) interfaceByName(name string) (*net.Interface, error) {
+	for _, ifc := range l.interfaces {
+		if ifc.Name == name {
+			return ifc, nil
+		}
+	}
+	return nil, errNoLink
+}
+
+func (l *fakeLinks) linkLayer(ifc *net.Interface) (hwType uint16, broadcast net.HardwareAddr, err error) {
+	hwType, ok := l.hwTypes[ifc.Index]
+	if !ok {
+		hwType = syscall.ARPHRD_ETHER
+	}
+	broadcast = make(net.HardwareAddr, len(ifc.HardwareAddr))
+	for i := range broadcast {
+		broadcast[i] = 0xff
+	}
+	return hwType, broadcast, nil
+}
+
+func (l *fakeLinks) hasVlanDevice(ifIndex int, id uint16) bool {
+	for _, v := range l.vlans[ifIndex] {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeIP records the ip commands of a test, the ones starting with a key of
+// fail fail with its error
+type fakeIP struct {
+	cmds []string
+	fail map[string]error
+}
+
+func (f *fakeIP) run(args ...string) error {
+	cmd := strings.Join(args, " ")
+	f.cmds = append(f.cmds, cmd)
+	for prefix, err := range f.fail {
+		if strings.HasPrefix(cmd, prefix) {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeAddrs is an address table, its changes are run as ip address
+// commands on ip
+type fakeAddrs struct {
+	ip    *fakeIP
+	addrs []ifAddr
+}
+
+func (f *fakeAddrs) list() ([]ifAddr, error) {
+	return append([]ifAddr(nil), f.addrs...), nil
+}
+
+func (f *fakeAddrs) replace(a ifAddr) error {
+	if err := f.ip.run("address", "replace", a.String()); err != nil {
+		return err
+	}
+	f.drop(a)
+	f.addrs = append(f.addrs, a)
+	return nil
+}
+
+func (f *fakeAddrs) remove(a ifAddr) error {
+	if err := f.ip.run("address", "del", a.String()); err != nil {
+		return err
+	}
+	if !f.drop(a) {
+		return syscall.EADDRNOTAVAIL
+	}
+	return nil
+}
+
+func (f *fakeAddrs) drop(a ifAddr) bool {
+	for i, cur := range f.addrs {
+		if cur.ip.Equal(a.ip) && cur.device == a.device {
+			f.addrs = append(f.addrs[:i], f.addrs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeNode struct {
+	m      *Manager
+	raw    *fakePacketConn
+	cooked *fakePacketConn
+	icmp   *fakeICMPConn
+	links  *fakeLinks
+	ip     *fakeIP
+	addrs  *fakeAddrs
+}
+
+// newFakeNode returns a Manager on fake sockets and a fake ip tool, with the
+// interfaces by index, announce puts VIPs in place without the lifecycle
+func newFakeNode(t *testing.T, interfaces ...*net.Interface) *fakeNode {
+	n := &fakeNode{
+		m:      New(nil),
+		raw:    new(fakePacketConn),
+		cooked: new(fakePacketConn),
+		icmp:   &fakeICMPConn{groups: make(map[string]bool)},
+		links: &fakeLinks{
+			interfaces: make(map[int]*net.Interface),
+			hwTypes:    make(map[int]uint16),
+			vlans:      make(map[int][]uint16),
+		},
+		ip: &fakeIP{fail: make(map[string]error)},
+	}
+	n.addrs = &fakeAddrs{ip: n.ip}
+	for _, ifc := range interfaces {
+		n.links.interfaces[ifc.Index] = ifc
+	}
+
+	n.m.links = n.links
+	n.m.ip = n.ip.run
+	n.m.addrs = n.addrs
+	l4, err := n.m.newListener4(n.raw, n.cooked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.m.l4 = l4
+	n.m.l6 = n.m.newListener6(n.icmp)
+	return n
+}
+
+func (n *fakeNode) announce(t *testing.T, address string, opts ...Option) {
+	v, err := parseIP(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	v.refs, v.enables, v.state = 1, 1, StateAnnounced
+	n.m.vipes.add(v)
+}
+
+// auxdataOOB builds the PACKET_AUXDATA control message of a frame
+func auxdataOOB(aux tpacketAuxdata) []byte {
+	size := int(unsafe.Sizeof(aux))
+	b := make([]byte, syscall.CmsgSpace(size))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = syscall.SOL_PACKET
+	h.Type = packetAuxdata
+	h.SetLen(syscall.CmsgLen(size))
+	*(*tpacketAuxdata)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = aux
+	return b
+}
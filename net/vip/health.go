@@ -0,0 +1,276 @@
+package vip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckInterval = 2 * time.Second
+	defaultCheckTimeout  = time.Second
+	// events are dropped for subscribers this far behind
+	healthEventBuffer = 64
+)
+
+var (
+	errHealthCheckAttached = errors.New("health check already attached")
+	errNoHealthCheck       = errors.New("no health check attached")
+)
+
+// Checker probes the service behind a VIP, nil means healthy
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckFunc adapts a function to a Checker
+type CheckFunc func(ctx context.Context) error
+
+func (f CheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// TCPCheck is healthy when a TCP connection to address succeeds
+func TCPCheck(address string) Checker {
+	return CheckFunc(func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// HTTPCheck is healthy when a GET of url answers with status
+func HTTPCheck(url string, status int) Checker {
+	return CheckFunc(func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != status {
+			return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// ExecCheck is healthy when the command exits with status 0
+func ExecCheck(name string, args ...string) Checker {
+	return CheckFunc(func(ctx context.Context) error {
+		return exec.CommandContext(ctx, name, args...).Run()
+	})
+}
+
+// HealthCheck gates the announcement of a VIP on a Checker
+type HealthCheck struct {
+	Checker Checker
+	// Interval between checks and Timeout of one check
+	Interval time.Duration
+	Timeout  time.Duration
+	// Rise consecutive successes announce the VIP, Fall consecutive
+	// failures withdraw it
+	Rise int
+	Fall int
+}
+
+// HealthEvent reports a VIP going up or down
+type HealthEvent struct {
+	Address string
+	Healthy bool
+	// Err is the failed check for a VIP going down, or the error of
+	// enabling or disabling it
+	Err  error
+	Time time.Time
+}
+
+type healthWatch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// AttachHealthCheck checks an added VIP until DetachHealthCheck or its last
+// Remove. The VIP starts down, the check holds one Enable on it while
+// healthy, so it should not be enabled elsewhere.
+func AttachHealthCheck(address string, hc HealthCheck) (err error) {
+	return defaultManager.AttachHealthCheck(address, hc)
+}
+
+// AttachHealthCheck runs the checks in the caller's namespace, not in the
+// Manager's one
+func (m *Manager) AttachHealthCheck(address string, hc HealthCheck) (err error) {
+	v, err := parseIP(address)
+	if err != nil {
+		return
+	}
+	if m.vipes.get(v.address) == nil {
+		return ErrNotAdded
+	}
+
+	if hc.Interval <= 0 {
+		hc.Interval = defaultCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultCheckTimeout
+	}
+	if hc.Rise < 1 {
+		hc.Rise = 1
+	}
+	if hc.Fall < 1 {
+		hc.Fall = 1
+	}
+
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+	if m.healthWatches[v.address] != nil {
+		return errHealthCheckAttached
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &healthWatch{cancel: cancel, done: make(chan struct{})}
+	m.healthWatches[v.address] = w
+	go m.runHealthCheck(ctx, v.address, hc, w.done)
+	return
+}
+
+// DetachHealthCheck stops checking a VIP and drops the Enable the check
+// held, the VIP stays added
+func DetachHealthCheck(address string) (err error) {
+	return defaultManager.DetachHealthCheck(address)
+}
+
+func (m *Manager) DetachHealthCheck(address string) (err error) {
+	v, err := parseIP(address)
+	if err != nil {
+		return
+	}
+
+	m.healthLock.Lock()
+	w := m.healthWatches[v.address]
+	delete(m.healthWatches, v.address)
+	m.healthLock.Unlock()
+	if w == nil {
+		return errNoHealthCheck
+	}
+
+	w.cancel()
+	<-w.done
+	return
+}
+
+// HealthEvents subscribes to the transitions of all checked VIPs, events
+// are dropped while the channel is full, cancel ends the subscription
+func HealthEvents() (events <-chan HealthEvent, cancel func()) {
+	return defaultManager.HealthEvents()
+}
+
+func (m *Manager) HealthEvents() (events <-chan HealthEvent, cancel func()) {
+	ch := make(chan HealthEvent, healthEventBuffer)
+
+	m.healthLock.Lock()
+	m.healthSubscribers[ch] = true
+	m.healthLock.Unlock()
+
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() {
+			m.healthLock.Lock()
+			delete(m.healthSubscribers, ch)
+			m.healthLock.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+func (m *Manager) publishHealth(e HealthEvent) {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+	for ch := range m.healthSubscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (m *Manager) runHealthCheck(ctx context.Context, address string, hc HealthCheck, done chan struct{}) {
+	var (
+		// held is the Enable taken, it lags behind healthy while enabling
+		// fails
+		healthy, held bool
+		successes     int
+		failures      int
+	)
+	defer func() {
+		if held {
+			_ = m.Disable(address)
+		}
+		close(done)
+	}()
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, hc.Timeout)
+		err := hc.Checker.Check(checkCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			successes, failures = successes+1, 0
+		} else {
+			successes, failures = 0, failures+1
+		}
+
+		switch {
+		case !healthy && successes >= hc.Rise:
+			healthy = true
+			held, err = m.holdEnable(address)
+			m.publishHealth(HealthEvent{Address: address, Healthy: true, Err: err, Time: time.Now()})
+		case healthy && !held && err == nil:
+			// the VIP stays dark until enabling it works, the event of its
+			// rise carried the error already
+			if held, err = m.holdEnable(address); held {
+				m.publishHealth(HealthEvent{Address: address, Healthy: true, Err: err, Time: time.Now()})
+			}
+		case healthy && failures >= hc.Fall:
+			healthy = false
+			if held {
+				if derr := m.Disable(address); derr != nil {
+					err = derr
+				}
+				held = false
+			}
+			m.publishHealth(HealthEvent{Address: address, Healthy: false, Err: err, Time: time.Now()})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// holdEnable enables a checked VIP, held tells whether the check took the
+// Enable, which it did when only announcing the VIP failed
+func (m *Manager) holdEnable(address string) (held bool, err error) {
+	err = m.Enable(address)
+	state, _ := m.GetState(address)
+	return state == StateAnnounced, err
+}
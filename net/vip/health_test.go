@@ -0,0 +1,167 @@
+package vip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeChecker returns the results sent on it, one per Check
+type fakeChecker chan error
+
+func (c fakeChecker) Check(ctx context.Context) error {
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func nextHealthEvent(t *testing.T, events <-chan HealthEvent) HealthEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no health event")
+	}
+	return HealthEvent{}
+}
+
+func newCheckedNode(t *testing.T, address string, opts ...Option) (*fakeNode, fakeChecker, <-chan HealthEvent) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	if err := n.m.add(address, opts...); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := n.m.HealthEvents()
+	t.Cleanup(cancel)
+
+	check := make(fakeChecker)
+	hc := HealthCheck{Checker: check, Interval: time.Millisecond, Timeout: time.Second, Rise: 2, Fall: 2}
+	if err := n.m.AttachHealthCheck(address, hc); err != nil {
+		t.Fatal(err)
+	}
+	return n, check, events
+}
+
+func TestHealthCheck(t *testing.T) {
+	const vip = "10.0.0.100"
+	n, check, events := newCheckedNode(t, vip)
+	failed := errors.New("refused")
+	state := func() State {
+		s, _ := n.m.GetState(vip)
+		return s
+	}
+
+	// one success short of rising, a failure starts over
+	check <- nil
+	check <- failed
+	check <- nil
+	if s := state(); s != StateBound {
+		t.Fatalf("%s before rising", s)
+	}
+	check <- nil
+	if e := nextHealthEvent(t, events); !e.Healthy || e.Err != nil || e.Address != vip {
+		t.Fatalf("rise: %+v", e)
+	}
+	if s := state(); s != StateAnnounced {
+		t.Fatalf("%s after rising", s)
+	}
+
+	check <- failed
+	check <- nil
+	check <- failed
+	check <- failed
+	if e := nextHealthEvent(t, events); e.Healthy || e.Err != failed {
+		t.Fatalf("fall: %+v", e)
+	}
+	if s := state(); s != StateWithdrawn {
+		t.Fatalf("%s after falling", s)
+	}
+
+	check <- nil
+	check <- nil
+	nextHealthEvent(t, events)
+	if err := n.m.AttachHealthCheck(vip, HealthCheck{Checker: check}); err != errHealthCheckAttached {
+		t.Fatalf("attached twice: %v", err)
+	}
+	// the Enable of the check goes with it
+	if err := n.m.DetachHealthCheck(vip); err != nil {
+		t.Fatal(err)
+	}
+	if s := state(); s != StateWithdrawn {
+		t.Fatalf("%s after detaching", s)
+	}
+	if err := n.m.DetachHealthCheck(vip); err != errNoHealthCheck {
+		t.Fatalf("detached twice: %v", err)
+	}
+	if err := n.m.AttachHealthCheck("10.0.0.101", HealthCheck{Checker: check}); err != ErrNotAdded {
+		t.Fatalf("attached to a VIP not added: %v", err)
+	}
+}
+
+func TestHealthCheckEnableFails(t *testing.T) {
+	const vip = "10.0.0.100"
+	n, check, events := newCheckedNode(t, vip, WithBinding(Binding{Mode: BindInterface, PrefixLen: 24}))
+	defer n.m.DetachHealthCheck(vip)
+
+	failed := errors.New("no permission")
+	n.ip.fail["address replace"] = failed
+	check <- nil
+	check <- nil
+	if e := nextHealthEvent(t, events); !e.Healthy || e.Err == nil {
+		t.Fatalf("rise: %+v", e)
+	}
+	if s, _ := n.m.GetState(vip); s != StateBound {
+		t.Fatalf("%s although enabling failed", s)
+	}
+
+	// the next healthy check enables it
+	delete(n.ip.fail, "address replace")
+	check <- nil
+	if e := nextHealthEvent(t, events); !e.Healthy || e.Err != nil {
+		t.Fatalf("retry: %+v", e)
+	}
+	if s, _ := n.m.GetState(vip); s != StateAnnounced {
+		t.Fatalf("%s after enabling again", s)
+	}
+}
+
+func TestHealthCheckRemoved(t *testing.T) {
+	const vip = "10.0.0.100"
+	n, check, events := newCheckedNode(t, vip)
+	check <- nil
+	check <- nil
+	nextHealthEvent(t, events)
+
+	// the last Remove takes the check along
+	if err := n.m.remove(vip); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.add(vip); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.DetachHealthCheck(vip); err != errNoHealthCheck {
+		t.Fatalf("detach after remove: %v", err)
+	}
+	hc := HealthCheck{Checker: check, Interval: time.Millisecond, Timeout: time.Second}
+	if err := n.m.AttachHealthCheck(vip, hc); err != nil {
+		t.Fatalf("attach after remove: %v", err)
+	}
+	defer n.m.DetachHealthCheck(vip)
+	// only the new check enables the VIP added again
+	if s, _ := n.m.GetState(vip); s != StateBound {
+		t.Fatalf("%s before the new check", s)
+	}
+	check <- nil
+	if e := nextHealthEvent(t, events); !e.Healthy || e.Err != nil {
+		t.Fatalf("rise: %+v", e)
+	}
+	if s, _ := n.m.GetState(vip); s != StateAnnounced {
+		t.Fatalf("%s after rising", s)
+	}
+}
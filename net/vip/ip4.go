@@ -1,53 +1,103 @@
 package vip
 
 import (
+	"errors"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"unsafe"
 
-	"github.com/mdlayher/arp"
-	"github.com/mdlayher/ethernet"
+	"github.com/adoyee/go-utils/net/arp"
 )
 
-var l4 *vipListener4
+const (
+	packetAuxdata         = 8
+	tpStatusVlanValid     = 1 << 4
+	tpStatusVlanTpidValid = 1 << 6
+)
+
+var (
+	errHardwareAddr = errors.New("interface hardware address does not match arp request")
+	errNoLink       = errors.New("link not found")
+)
 
 type vipListener4 struct {
-	socket *arpSocket
+	m      *Manager
+	socket packetConn
+	// cooked sends frames on links whose header we cannot build ourselves
+	cooked packetConn
+
+	filterLock sync.Mutex
+	bound      int
+	// replay listeners are not captured, their conn records the replies
+	replay bool
 }
 
 type request4 struct {
-	s      *arpSocket
+	l      *vipListener4
 	remote *syscall.SockaddrLinklayer
-	frame  *ethernet.Frame
+	frame  *arp.Frame
 	packet *arp.Packet
 }
 
 type arpSocket struct {
 	f  *os.File
 	rc syscall.RawConn
+	// closed is set by close, reads fail with os.ErrClosed then
+	closed int32
+	// batch is allocated by the first readFrame
+	batch *arpBatch
+}
+
+// tpacketAuxdata mirrors struct tpacket_auxdata
+type tpacketAuxdata struct {
+	status   uint32
+	len      uint32
+	snaplen  uint32
+	mac      uint16
+	net      uint16
+	vlanTCI  uint16
+	vlanTPID uint16
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
 }
 
 func (r *request4) target() (t net.IP) {
 	return r.packet.TargetIP
 }
 
+func (r *request4) sender() (net.IP, net.HardwareAddr) {
+	return r.packet.SenderIP, r.packet.SenderHardwareAddr
+}
+
 func (r *request4) ifIndex() int {
 	return r.remote.Ifindex
 }
 
 func (r *request4) reply() (err error) {
-	ifc, err := net.InterfaceByIndex(r.remote.Ifindex)
+	ifc, err := r.l.m.links.interfaceByIndex(r.remote.Ifindex)
 	if err != nil {
 		return
 	}
 
 	srcIP := r.packet.TargetIP
-	srcHW := ifc.HardwareAddr
+	srcHW := r.l.m.advertisedMAC(srcIP, ifc)
 	dstIP := r.packet.SenderIP
 	dstHW := r.packet.SenderHardwareAddr
 
-	p, err := arp.NewPacket(arp.OperationReply, srcHW, srcIP, dstHW, dstIP)
+	if len(srcHW) != len(dstHW) {
+		return errHardwareAddr
+	}
+
+	p, err := arp.NewPacket(arp.OperationReply, r.packet.HardwareType, srcHW, srcIP, dstHW, dstIP)
 	if err != nil {
 		return err
 	}
@@ -56,10 +106,16 @@ func (r *request4) reply() (err error) {
 		return err
 	}
 
-	f := &ethernet.Frame{
+	if r.frame == nil {
+		return r.l.cooked.sendTo(pb, ifc.Index, syscall.ETH_P_ARP, dstHW)
+	}
+
+	// answer on the same VLANs the request arrived on
+	f := &arp.Frame{
 		Destination: dstHW,
 		Source:      srcHW,
-		EtherType:   ethernet.EtherTypeARP,
+		VLANs:       r.frame.VLANs,
+		EtherType:   arp.EtherTypeARP,
 		Payload:     pb,
 	}
 	fb, err := f.MarshalBinary()
@@ -67,24 +123,101 @@ func (r *request4) reply() (err error) {
 		return err
 	}
 
-	var baddr [8]byte
-	copy(baddr[:], dstHW)
+	if err = r.l.socket.sendTo(fb, ifc.Index, syscall.ETH_P_ARP, dstHW); err != nil {
+		return
+	}
+	r.l.captureFrame(ifc.Index, f, p, true)
+	return
+}
+
+// newListen4 taps all protocols, a socket bound to ARP only sees frames after
+// the kernel discarded the VLAN tag of trunk ports without a VLAN device
+func (m *Manager) newListen4() (l *vipListener4, err error) {
+	socket, err := newArpSocket(syscall.SOCK_RAW, syscall.ETH_P_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = socket.control(func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetAuxdata, 1)
+	}); err != nil {
+		_ = socket.close()
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	cooked, err := newArpSocket(syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		_ = socket.close()
+		return nil, err
+	}
+
+	if l, err = m.newListener4(socket, cooked); err != nil {
+		_ = socket.close()
+		_ = cooked.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (m *Manager) newListener4(socket, cooked packetConn) (l *vipListener4, err error) {
+	l = &vipListener4{m: m, socket: socket, cooked: cooked}
+	if err = l.refreshFilter(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// refreshFilter lets the kernel drop frames we would not answer, it has to
+// run whenever the interfaces or the enabled IPv4 VIPs change
+func (l *vipListener4) refreshFilter() (err error) {
+	l.filterLock.Lock()
+	defer l.filterLock.Unlock()
+
+	ifIndexes := make([]int, 0, len(l.m.vipInterfaces))
+	for _, ifc := range l.m.vipInterfaces {
+		ifIndexes = append(ifIndexes, ifc.Index)
+	}
+
+	var filter []syscall.SockFilter
+	targets, prefixes := l.m.vipes.ip4s(), l.m.subnets.prefixes()
+	switch {
+	case l.m.filterTargets && len(targets) == 0 && len(prefixes) == 0:
+		filter = []syscall.SockFilter{{Code: bpfRet, K: bpfDrop}}
+	case l.m.filterTargets:
+		filter, err = arpFilter(ifIndexes, targets, prefixes)
+		if err == errFilterTooLong {
+			// too many VIPs for one program, targets are still checked in startListen
+			filter, err = arpFilter(ifIndexes, nil, nil)
+		}
+	default:
+		filter, err = arpFilter(ifIndexes, nil, nil)
+	}
+	if err != nil {
+		return
+	}
+
+	if err = l.socket.attachFilter(filter); err != nil {
+		return
+	}
 
-	to := &syscall.SockaddrLinklayer{
-		Protocol: r.remote.Protocol,
-		Ifindex:  r.remote.Ifindex,
-		Hatype:   r.remote.Hatype,
-		Pkttype:  r.remote.Pkttype,
-		Halen:    r.remote.Halen,
-		Addr:     baddr,
+	// a packet socket is bound to a single interface or to all of them
+	bound := 0
+	if len(ifIndexes) == 1 {
+		bound = ifIndexes[0]
+	}
+	if bound == l.bound {
+		return
 	}
 
-	err = r.s.sendTo(fb, 0, to)
+	if err = l.socket.bind(bound); err != nil {
+		return
+	}
+	l.bound = bound
 	return
 }
 
-func newListen4() (l *vipListener4, err error) {
-	socket, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0x0608)
+func newArpSocket(typ int, protocol uint16) (as *arpSocket, err error) {
+	socket, err := syscall.Socket(syscall.AF_PACKET, typ, int(htons(protocol)))
 	if err != nil {
 		return nil, os.NewSyscallError("socket", err)
 	}
@@ -96,71 +229,104 @@ func newListen4() (l *vipListener4, err error) {
 	f := os.NewFile(uintptr(socket), "arp-socket")
 	rc, err := f.SyscallConn()
 	if err != nil {
-		_ = syscall.Close(socket)
+		_ = f.Close()
 		return nil, err
 	}
-	l = &vipListener4{socket: &arpSocket{f: f, rc: rc}}
-	return l, nil
+	return &arpSocket{f: f, rc: rc}, nil
 }
 
 func (l *vipListener4) accept() (req vipRequest, err error) {
-	buff := make([]byte, buffSize)
-
 	for {
-		_, sa, err := l.socket.recvFrom(buff, 0)
+		data, oob, remote, err := l.socket.readFrame()
 		if err != nil {
 			return nil, err
 		}
 
-		frame := new(ethernet.Frame)
-		if err = frame.UnmarshalBinary(buff); err != nil {
-			log.Println("unmarshal frame ", err)
-			continue
+		if r := l.parse(data, oob, remote); r != nil {
+			return r, nil
 		}
+	}
+}
 
-		if frame.EtherType != ethernet.EtherTypeARP {
-			continue
-		}
+// parse decodes an ARP request from a received frame of exactly the received length
+func (l *vipListener4) parse(data, oob []byte, remote *syscall.SockaddrLinklayer) (req *request4) {
+	if remote.Pkttype == syscall.PACKET_OUTGOING {
+		return nil
+	}
 
-		packet := new(arp.Packet)
-		if err = packet.UnmarshalBinary(frame.Payload); err != nil {
-			log.Println("unmarshal arp failed")
-			continue
-		}
+	aux := parseAuxdata(oob)
 
-		if packet.Operation != arp.OperationRequest {
-			continue
+	var frame *arp.Frame
+	payload := data
+	if remote.Hatype == syscall.ARPHRD_ETHER {
+		frame = new(arp.Frame)
+		if err := frame.UnmarshalBinary(payload); err != nil {
+			log.Println("unmarshal frame ", err)
+			return nil
 		}
-
-		remote, ok := sa.(*syscall.SockaddrLinklayer)
-		if !ok {
-			return nil, syscall.EINVAL
+		if frame.EtherType != arp.EtherTypeARP {
+			return nil
 		}
-
-		req = &request4{
-			s:      l.socket,
-			remote: remote,
-			frame:  frame,
-			packet: packet,
+		if tag, ok := aux.vlan(); ok {
+			// the VLAN device will see the frame again, untagged
+			if l.m.links.hasVlanDevice(remote.Ifindex, tag.ID()) {
+				return nil
+			}
+			frame.VLANs = append([]arp.VLAN{tag}, frame.VLANs...)
+		}
+		payload = frame.Payload
+	} else {
+		// no ethernet header, the kernel tells where the arp packet starts
+		if htons(remote.Protocol) != syscall.ETH_P_ARP || aux == nil || int(aux.net) > len(data) {
+			return nil
 		}
-		//log.Printf("%#v\n", sa)
-		return req, nil
+		payload = payload[aux.net:]
+	}
+
+	packet := new(arp.Packet)
+	if err := packet.UnmarshalBinary(payload); err != nil {
+		log.Println("unmarshal arp failed")
+		return nil
+	}
+	if frame != nil {
+		l.captureFrame(remote.Ifindex, frame, packet, false)
+	}
+
+	if packet.Operation != arp.OperationRequest {
+		return nil
+	}
+
+	return &request4{
+		l:      l,
+		remote: remote,
+		frame:  frame,
+		packet: packet,
 	}
 }
 
 func (l *vipListener4) gratuitous(ip net.IP) (err error) {
-	if len(vipInterfaces) == 0 {
+	if len(l.m.vipInterfaces) == 0 {
+		return
+	}
+
+	ifc := l.m.vipInterfaces[0]
+
+	// links without hardware addresses do not resolve with arp
+	if len(ifc.HardwareAddr) == 0 {
 		return
 	}
 
-	ifc := vipInterfaces[0]
+	hwType, broadcast, err := l.m.links.linkLayer(ifc)
+	if err != nil {
+		return
+	}
 
 	srcIP := ip
-	srcHW := ifc.HardwareAddr
+	srcHW := l.m.advertisedMAC(ip, ifc)
 	dstIP := ip
-	dstHW := ethernet.Broadcast
+	dstHW := broadcast
 
-	p, err := arp.NewPacket(arp.OperationReply, srcHW, srcIP, dstHW, dstIP)
+	p, err := arp.NewPacket(arp.OperationReply, hwType, srcHW, srcIP, dstHW, dstIP)
 	if err != nil {
 		return
 	}
@@ -169,10 +335,14 @@ func (l *vipListener4) gratuitous(ip net.IP) (err error) {
 		return
 	}
 
-	f := &ethernet.Frame{
+	if hwType != syscall.ARPHRD_ETHER {
+		return l.cooked.sendTo(pb, ifc.Index, syscall.ETH_P_ARP, dstHW)
+	}
+
+	f := &arp.Frame{
 		Destination: dstHW,
 		Source:      srcHW,
-		EtherType:   ethernet.EtherTypeARP,
+		EtherType:   arp.EtherTypeARP,
 		Payload:     pb,
 	}
 
@@ -181,35 +351,145 @@ func (l *vipListener4) gratuitous(ip net.IP) (err error) {
 		return err
 	}
 
-	var baddr [8]byte
-	copy(baddr[:], ethernet.Broadcast)
-	to := &syscall.SockaddrLinklayer{
-		Protocol: 0x0608,
-		Ifindex:  ifc.Index,
-		Hatype:   0x1,
-		Pkttype:  0x0,
-		Halen:    0x6,
-		Addr:     baddr,
+	if err = l.socket.sendTo(fb, ifc.Index, syscall.ETH_P_ARP, dstHW); err != nil {
+		return
 	}
-	err = l.socket.sendTo(fb, 0, to)
+	l.captureFrame(ifc.Index, f, p, true)
 	return
 }
 
-func (as *arpSocket) recvFrom(buff []byte, flags int) (n int, addr syscall.Sockaddr, err error) {
-	cerr := as.rc.Read(func(fd uintptr) bool {
-		n, addr, err = syscall.Recvfrom(int(fd), buff, flags)
-		return err != syscall.EAGAIN
-	})
+// linkLayer reads the ARP hardware type and broadcast address of an interface
+// over netlink, sysfs shows the links of the namespace it was mounted in
+func linkLayer(ifc *net.Interface) (hwType uint16, broadcast net.HardwareAddr, err error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return 0, nil, os.NewSyscallError("netlinkrib", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return 0, nil, os.NewSyscallError("parsenetlinkmessage", err)
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWLINK || len(msg.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		if int(info.Index) != ifc.Index {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return 0, nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.IFLA_BROADCAST {
+				broadcast = net.HardwareAddr(a.Value)
+			}
+		}
+		return info.Type, broadcast, nil
+	}
+	return 0, nil, errNoLink
+}
+
+// hasVlanDevice reports whether a VLAN device with the id sits on top of the
+// interface, vlan/config only exists when the 8021q module is loaded. It is
+// read for the thread's namespace, /proc/net is the one of the main thread.
+func hasVlanDevice(ifIndex int, id uint16) bool {
+	ifc, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return false
+	}
+
+	b, err := ioutil.ReadFile("/proc/thread-self/net/vlan/config")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 3 || strings.TrimSpace(fields[2]) != ifc.Name {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil && uint16(v) == id {
+			return true
+		}
+	}
+	return false
+}
 
+func parseAuxdata(oob []byte) (aux *tpacketAuxdata) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
 	if err != nil {
-		return n, addr, err
+		return nil
 	}
-	return n, addr, cerr
+
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_PACKET || m.Header.Type != packetAuxdata {
+			continue
+		}
+		if len(m.Data) < int(unsafe.Sizeof(tpacketAuxdata{})) {
+			continue
+		}
+		aux = new(tpacketAuxdata)
+		*aux = *(*tpacketAuxdata)(unsafe.Pointer(&m.Data[0]))
+		return aux
+	}
+	return nil
 }
 
-func (as *arpSocket) sendTo(buff []byte, flags int, to syscall.Sockaddr) (err error) {
+// vlan returns the tag the kernel stripped from the frame, if any
+func (aux *tpacketAuxdata) vlan() (tag arp.VLAN, ok bool) {
+	if aux == nil || aux.status&tpStatusVlanValid == 0 {
+		return
+	}
+
+	tag = arp.VLAN{TPID: arp.EtherTypeVLAN, TCI: aux.vlanTCI}
+	if aux.status&tpStatusVlanTpidValid != 0 {
+		tag.TPID = aux.vlanTPID
+	}
+	return tag, true
+}
+
+func (as *arpSocket) control(fn func(fd int) error) (err error) {
+	cerr := as.rc.Control(func(fd uintptr) {
+		err = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+func (as *arpSocket) close() error {
+	atomic.StoreInt32(&as.closed, 1)
+	return as.f.Close()
+}
+
+// sendTo sends to a link-layer address of any length, syscall.SockaddrLinklayer
+// only holds 8 bytes which is too short for e.g. infiniband
+func (as *arpSocket) sendTo(buff []byte, ifIndex int, protocol uint16, hwAddr net.HardwareAddr) (err error) {
+	// struct sockaddr_ll with a trailing address of arbitrary length
+	size := 12 + len(hwAddr)
+	if size < syscall.SizeofSockaddrLinklayer {
+		size = syscall.SizeofSockaddrLinklayer
+	}
+	sa := make([]byte, size)
+	*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_PACKET
+	*(*uint16)(unsafe.Pointer(&sa[2])) = htons(protocol)
+	*(*int32)(unsafe.Pointer(&sa[4])) = int32(ifIndex)
+	sa[11] = uint8(len(hwAddr))
+	copy(sa[12:], hwAddr)
+
 	cerr := as.rc.Write(func(fd uintptr) bool {
-		err = syscall.Sendto(int(fd), buff, flags, to)
+		_, _, e := syscall.Syscall6(syscall.SYS_SENDTO, fd,
+			uintptr(unsafe.Pointer(&buff[0])), uintptr(len(buff)), 0,
+			uintptr(unsafe.Pointer(&sa[0])), uintptr(len(sa)))
+		err = nil
+		if e != 0 {
+			err = e
+		}
 		return err != syscall.EAGAIN
 	})
 
@@ -2,9 +2,11 @@ package vip
 
 import (
 	"encoding/binary"
-	"log"
+	"errors"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv6"
@@ -13,11 +15,13 @@ import (
 const (
 	ipProtocolICMP6            = 58
 	neighborAdvertisementFlags = 0x60000000
-	advertisementSize          = 32
+	advertisementHeaderSize    = 24
+	optSourceLinkLayerAddress  = 1
+	optTargetLinkLayerAddress  = 2
 )
 
 var (
-	l6 *listener6
+	errLinkLayerAddress = errors.New("link-layer address too long for neighbor discovery option")
 )
 
 func composeGroupAddress(ip net.IP) (group net.IP) {
@@ -28,21 +32,35 @@ func composeGroupAddress(ip net.IP) (group net.IP) {
 }
 
 type listener6 struct {
-	conn *ipv6.PacketConn
+	m    *Manager
+	conn icmpConn
 	gm   *groupMap
+	// replay listeners are not captured, their conn records the replies
+	replay bool
+	// closed is set by close, reads fail with os.ErrClosed then
+	closed int32
 }
 
 type request6 struct {
-	conn   *ipv6.PacketConn
+	l      *listener6
+	conn   icmpConn
 	cm     *ipv6.ControlMessage
 	tgt    net.IP
 	remote net.Addr
+	srcMAC net.HardwareAddr
 }
 
 func (r *request6) target() (ip net.IP) {
 	return r.tgt
 }
 
+func (r *request6) sender() (ip net.IP, mac net.HardwareAddr) {
+	if a, ok := r.remote.(*net.IPAddr); ok {
+		ip = a.IP
+	}
+	return ip, r.srcMAC
+}
+
 func (r *request6) ifIndex() int {
 	return r.cm.IfIndex
 }
@@ -54,30 +72,41 @@ type advertisement struct {
 	Flags                 uint32 // 4 bytes
 	TargetAddress         net.IP // 16 bytes
 	OptType               uint8  // 1 byte
-	OptLength             uint8  // 1 byte
-	OptLinkerLayerAddress []byte // 6 bytes
+	OptLinkerLayerAddress []byte // variable, option omitted when empty
 }
 
-func (ad *advertisement) marshal() (data []byte) {
-	payload := make([]byte, advertisementSize)
+func (ad *advertisement) marshal() (data []byte, err error) {
+	target := ad.TargetAddress.To16()
+	if target == nil {
+		return nil, net.InvalidAddrError(ad.TargetAddress.String())
+	}
+
+	// option length is counted in units of 8 octets, including type and length
+	optLength := 0
+	if len(ad.OptLinkerLayerAddress) != 0 {
+		optLength = (2 + len(ad.OptLinkerLayerAddress) + 7) / 8
+		if optLength > 0xff {
+			return nil, errLinkLayerAddress
+		}
+	}
+
+	payload := make([]byte, advertisementHeaderSize+optLength*8)
 	payload[0] = ad.Type
 	payload[1] = ad.Code
 	binary.BigEndian.PutUint16(payload[2:4], ad.CheckSum)
 	binary.BigEndian.PutUint32(payload[4:8], ad.Flags)
-	for i := 0; i < 16; i++ {
-		payload[8+i] = ad.TargetAddress[i]
-	}
+	copy(payload[8:24], target)
 
-	payload[24] = ad.OptType
-	payload[25] = ad.OptLength
-	for i := 0; i < 6; i++ {
-		payload[26+i] = ad.OptLinkerLayerAddress[i]
+	if optLength != 0 {
+		payload[24] = ad.OptType
+		payload[25] = uint8(optLength)
+		copy(payload[26:], ad.OptLinkerLayerAddress)
 	}
-	return payload
+	return payload, nil
 }
 
 func (r *request6) reply() (err error) {
-	ifc, err := net.InterfaceByIndex(r.cm.IfIndex)
+	ifc, err := r.l.m.links.interfaceByIndex(r.cm.IfIndex)
 	if err != nil {
 		return
 	}
@@ -86,9 +115,8 @@ func (r *request6) reply() (err error) {
 		Type:                  uint8(ipv6.ICMPTypeNeighborAdvertisement),
 		Flags:                 neighborAdvertisementFlags,
 		TargetAddress:         r.tgt,
-		OptType:               2,
-		OptLength:             1,
-		OptLinkerLayerAddress: ifc.HardwareAddr,
+		OptType:               optTargetLinkLayerAddress,
+		OptLinkerLayerAddress: r.l.m.advertisedMAC(r.tgt, ifc),
 	}
 
 	cm := &ipv6.ControlMessage{
@@ -96,20 +124,37 @@ func (r *request6) reply() (err error) {
 		IfIndex: ifc.Index,
 	}
 
-	data := ad.marshal()
-	_, err = r.conn.WriteTo(data, cm, r.remote)
+	data, err := ad.marshal()
+	if err != nil {
+		return
+	}
+	if _, err = r.conn.WriteTo(data, cm, r.remote); err != nil {
+		return
+	}
+	if a, ok := r.remote.(*net.IPAddr); ok {
+		r.l.captureMessage(ifc.Index, r.tgt, a.IP, data, true)
+	}
 	return
 }
 
-func (l *listener6) gratuitous(ip net.IP) {
-	if len(vipInterfaces) == 0 {
+func (l *listener6) gratuitous(ip net.IP) (err error) {
+	if len(l.m.vipInterfaces) == 0 {
 		return
 	}
 
-	ifc := vipInterfaces[0]
+	ifc := l.m.vipInterfaces[0]
+
+	// an unsolicited advertisement without a link-layer address tells
+	// neighbors nothing, e.g. on tun or wireguard interfaces
+	if len(ifc.HardwareAddr) == 0 {
+		return
+	}
 
 	g := composeGroupAddress(ip)
-	dst, _ := net.ResolveIPAddr("ip6", g.String())
+	dst, err := net.ResolveIPAddr("ip6", g.String())
+	if err != nil {
+		return
+	}
 	cm := &ipv6.ControlMessage{
 		Src:     ip,
 		IfIndex: ifc.Index,
@@ -119,15 +164,21 @@ func (l *listener6) gratuitous(ip net.IP) {
 		Type:                  uint8(ipv6.ICMPTypeNeighborAdvertisement),
 		Flags:                 neighborAdvertisementFlags,
 		TargetAddress:         ip,
-		OptType:               2,
-		OptLength:             1,
-		OptLinkerLayerAddress: ifc.HardwareAddr,
+		OptType:               optTargetLinkLayerAddress,
+		OptLinkerLayerAddress: l.m.advertisedMAC(ip, ifc),
+	}
+	data, err := ns.marshal()
+	if err != nil {
+		return
+	}
+	if _, err = l.conn.WriteTo(data, cm, dst); err != nil {
+		return
 	}
-	data := ns.marshal()
-	_, _ = l.conn.WriteTo(data, cm, dst)
+	l.captureMessage(ifc.Index, ip, g, data, true)
+	return
 }
 
-func createListen6() (l *listener6, err error) {
+func (m *Manager) createListen6() (l *listener6, err error) {
 	var conn *icmp.PacketConn
 	var filter ipv6.ICMPFilter
 
@@ -157,85 +208,146 @@ func createListen6() (l *listener6, err error) {
 		return
 	}
 
-	l = &listener6{
-		conn: conn6,
-	}
-	l.gm = &groupMap{
-		groups: make(map[string][]string),
+	return m.newListener6(conn6), nil
+}
+
+func (m *Manager) newListener6(conn icmpConn) *listener6 {
+	return &listener6{
+		m:    m,
+		conn: conn,
+		gm:   newGroupMap(),
 	}
-	return
 }
 
 func (l *listener6) accept() (req vipRequest, err error) {
+	bp := buffPool.Get().(*[]byte)
+	defer buffPool.Put(bp)
+	buff := *bp
+
 	for {
-		buff := make([]byte, buffSize)
 		n, cm, remote, err := l.conn.ReadFrom(buff)
+		if err != nil && atomic.LoadInt32(&l.closed) != 0 {
+			// net.ErrClosed is only there from Go 1.16
+			return nil, os.ErrClosed
+		}
 		if err != nil {
-			log.Println(err)
-			continue
+			return nil, err
 		}
-		buff = buff[:n]
-		if len(buff) < 24 {
-			continue
+		if r := l.parse(buff[:n], cm, remote); r != nil {
+			return r, nil
 		}
+	}
+}
 
-		msg, err := icmp.ParseMessage(ipProtocolICMP6, buff)
-		if err != nil {
-			continue
-		}
+func (l *listener6) close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return l.conn.Close()
+}
 
-		if msg.Type != ipv6.ICMPTypeNeighborSolicitation {
-			continue
-		}
+// parse decodes a neighbor solicitation, data is copied where kept
+func (l *listener6) parse(data []byte, cm *ipv6.ControlMessage, remote net.Addr) (req *request6) {
+	if len(data) < 24 || cm == nil {
+		return nil
+	}
 
-		target := make(net.IP, net.IPv6len)
-		copy(target, buff[8:24])
+	msg, err := icmp.ParseMessage(ipProtocolICMP6, data)
+	if err != nil {
+		return nil
+	}
 
-		req = &request6{
-			conn:   l.conn,
-			cm:     cm,
-			remote: remote,
-			tgt:    target,
-		}
-		return req, nil
+	if msg.Type != ipv6.ICMPTypeNeighborSolicitation {
+		return nil
+	}
+	if a, ok := remote.(*net.IPAddr); ok {
+		l.captureMessage(cm.IfIndex, a.IP, cm.Dst, data, false)
+	}
+
+	target := make(net.IP, net.IPv6len)
+	copy(target, data[8:24])
+
+	return &request6{
+		l:      l,
+		conn:   l.conn,
+		cm:     cm,
+		remote: remote,
+		tgt:    target,
+		srcMAC: sourceLinkLayer(data[24:]),
 	}
 }
 
-func (l *listener6) joinGroup(ip6 net.IP) {
-	op := l.gm.joinGroup(ip6)
-	if op == groupNoOperation {
-		return
+// sourceLinkLayer returns the source link-layer address option of a
+// solicitation, nil if there is none, e.g. during DAD
+func sourceLinkLayer(opts []byte) net.HardwareAddr {
+	for len(opts) >= 2 {
+		size := int(opts[1]) * 8
+		if size == 0 || size > len(opts) {
+			return nil
+		}
+		if opts[0] == optSourceLinkLayerAddress {
+			mac := make(net.HardwareAddr, size-2)
+			copy(mac, opts[2:size])
+			return mac
+		}
+		opts = opts[size:]
 	}
+	return nil
+}
 
-	ip := composeGroupAddress(ip6)
-	g, err := net.ResolveIPAddr("ip6", ip.String())
-	if err != nil {
-		return
+// groupInterfaces returns the interfaces to join solicited-node groups on,
+// nil lets the kernel pick one
+func (l *listener6) groupInterfaces() []*net.Interface {
+	if len(l.m.vipInterfaces) == 0 {
+		return []*net.Interface{nil}
 	}
-	var ifc *net.Interface = nil
-	if len(vipInterfaces) != 0 {
-		ifc = vipInterfaces[0]
+	return l.m.vipInterfaces
+}
+
+func (l *listener6) joinGroup(ip6 net.IP) (err error) {
+	for _, ifc := range l.groupInterfaces() {
+		if jerr := l.joinGroupOn(ifc, ip6); err == nil {
+			err = jerr
+		}
 	}
+	return
+}
 
-	_ = l.conn.JoinGroup(ifc, g)
+func (l *listener6) leaveGroup(ip6 net.IP) (err error) {
+	for _, ifc := range l.groupInterfaces() {
+		if lerr := l.leaveGroupOn(ifc, ip6); err == nil {
+			err = lerr
+		}
+	}
+	return
 }
 
-func (l *listener6) leaveGroup(ip6 net.IP) {
-	op := l.gm.leaveGroup(ip6)
+func (l *listener6) joinGroupOn(ifc *net.Interface, ip6 net.IP) (err error) {
+	op := l.gm.joinGroup(groupIndex(ifc), ip6)
 	if op == groupNoOperation {
 		return
 	}
-	ip := composeGroupAddress(ip6)
-	g, err := net.ResolveIPAddr("ip6", ip.String())
-	if err != nil {
+
+	g := &net.IPAddr{IP: composeGroupAddress(ip6)}
+	if err = l.conn.JoinGroup(ifc, g); err != nil {
+		l.gm.leaveGroup(groupIndex(ifc), ip6)
+	}
+	return
+}
+
+func (l *listener6) leaveGroupOn(ifc *net.Interface, ip6 net.IP) (err error) {
+	op := l.gm.leaveGroup(groupIndex(ifc), ip6)
+	if op == groupNoOperation {
 		return
 	}
 
-	var ifc *net.Interface = nil
-	if len(vipInterfaces) != 0 {
-		ifc = vipInterfaces[0]
+	g := &net.IPAddr{IP: composeGroupAddress(ip6)}
+	return l.conn.LeaveGroup(ifc, g)
+}
+
+func groupIndex(ifc *net.Interface) int {
+	if ifc == nil {
+		return 0
 	}
-	_ = l.conn.LeaveGroup(ifc, g)
+	return ifc.Index
 }
 
 const (
@@ -244,74 +356,64 @@ const (
 	groupDelete
 )
 
+type groupKey struct {
+	ifIndex int
+	group   string
+}
+
+// groupMap tracks which VIPs need a solicited-node group on an interface, the
+// group is joined with the first VIP and left with the last one
 type groupMap struct {
-	groups map[string][]string
+	groups map[groupKey]map[string]struct{}
 	lock   sync.Mutex
 }
 
-func (gm *groupMap) joinGroup(ip6 net.IP) int {
-	group := composeGroupAddress(ip6)
+func newGroupMap() *groupMap {
+	return &groupMap{
+		groups: make(map[groupKey]map[string]struct{}),
+	}
+}
+
+func (gm *groupMap) joinGroup(ifIndex int, ip6 net.IP) int {
+	key := groupKey{ifIndex: ifIndex, group: composeGroupAddress(ip6).String()}
 	gm.lock.Lock()
 	defer gm.lock.Unlock()
 
-	addr := gm.groups[group.String()]
-	if addr == nil {
-		addr = make([]string, 8)
-		addr[0] = ip6.String()
+	members, ok := gm.groups[key]
+	if !ok {
+		gm.groups[key] = map[string]struct{}{ip6.String(): {}}
 		return groupAdd
 	}
 
-	for _, a := range addr {
-		if a == ip6.String() {
-			return groupNoOperation
-		}
-	}
-
-	addr = append(addr, ip6.String())
+	members[ip6.String()] = struct{}{}
 	return groupNoOperation
 }
 
-func (gm *groupMap) leaveGroup(ip6 net.IP) int {
-	group := composeGroupAddress(ip6)
+func (gm *groupMap) leaveGroup(ifIndex int, ip6 net.IP) int {
+	key := groupKey{ifIndex: ifIndex, group: composeGroupAddress(ip6).String()}
 	gm.lock.Lock()
 	defer gm.lock.Unlock()
 
-	addr, ok := gm.groups[group.String()]
+	members, ok := gm.groups[key]
 	if !ok {
 		return groupNoOperation
 	}
 
-	if addr == nil {
-		delete(gm.groups, ip6.String())
-		return groupDelete
-	}
-
-	exist := -1
-
-	for i := 0; i < len(addr); i++ {
-		a := addr[i]
-		if a == ip6.String() {
-			exist = i
-			break
-		}
-	}
-
-	if exist == -1 {
+	if _, ok = members[ip6.String()]; !ok {
 		return groupNoOperation
 	}
 
-	addr = remove(addr, exist)
-
-	if len(addr) == 0 {
-		delete(gm.groups, group.String())
+	delete(members, ip6.String())
+	if len(members) == 0 {
+		delete(gm.groups, key)
 		return groupDelete
 	}
-
-	gm.groups[group.String()] = addr
 	return groupNoOperation
 }
 
-func remove(s []string, i int) []string {
-	s[i] = s[len(s)-1]
-	return s[:len(s)-1]
+// members returns the VIPs holding the group on the interface
+func (gm *groupMap) members(ifIndex int, group net.IP) int {
+	gm.lock.Lock()
+	defer gm.lock.Unlock()
+	return len(gm.groups[groupKey{ifIndex: ifIndex, group: group.String()}])
 }
@@ -0,0 +1,103 @@
+package vip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestComposeGroupAddress(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1:a0b:c0d")
+	want := net.ParseIP("ff02::1:ff0b:c0d")
+	if g := composeGroupAddress(ip); !g.Equal(want) {
+		t.Fatalf("group of %s = %s, want %s", ip, g, want)
+	}
+}
+
+// VIPs sharing the last 24 bits share a solicited-node group
+func TestGroupMapSharedGroup(t *testing.T) {
+	a := net.ParseIP("2001:db8::1:aa:bbcc")
+	b := net.ParseIP("2001:db8::2:aa:bbcc")
+	c := net.ParseIP("2001:db8:1::ff:ffaa:bbcc")
+	group := composeGroupAddress(a)
+	for _, ip := range []net.IP{b, c} {
+		if !composeGroupAddress(ip).Equal(group) {
+			t.Fatalf("%s not in group %s", ip, group)
+		}
+	}
+
+	gm := newGroupMap()
+	steps := []struct {
+		join bool
+		ip   net.IP
+		op   int
+		size int
+	}{
+		{true, a, groupAdd, 1},
+		{true, b, groupNoOperation, 2},
+		{true, b, groupNoOperation, 2},
+		{true, c, groupNoOperation, 3},
+		{false, a, groupNoOperation, 2},
+		{false, a, groupNoOperation, 2},
+		{false, c, groupNoOperation, 1},
+		{false, b, groupDelete, 0},
+		{false, b, groupNoOperation, 0},
+		{true, c, groupAdd, 1},
+	}
+
+	for i, s := range steps {
+		var op int
+		if s.join {
+			op = gm.joinGroup(1, s.ip)
+		} else {
+			op = gm.leaveGroup(1, s.ip)
+		}
+		if op != s.op {
+			t.Errorf("step %d: join=%v %s returned %d, want %d", i, s.join, s.ip, op, s.op)
+		}
+		if n := gm.members(1, group); n != s.size {
+			t.Errorf("step %d: %d members, want %d", i, n, s.size)
+		}
+	}
+}
+
+func TestGroupMapPerInterface(t *testing.T) {
+	a := net.ParseIP("2001:db8::1:aa:bbcc")
+	b := net.ParseIP("2001:db8::2:aa:bbcc")
+	group := composeGroupAddress(a)
+
+	gm := newGroupMap()
+	if op := gm.joinGroup(1, a); op != groupAdd {
+		t.Fatalf("join on 1 returned %d", op)
+	}
+	if op := gm.joinGroup(2, b); op != groupAdd {
+		t.Fatalf("join on 2 returned %d, interfaces must not share membership", op)
+	}
+	if op := gm.leaveGroup(2, a); op != groupNoOperation {
+		t.Fatalf("leave of a VIP never joined on 2 returned %d", op)
+	}
+	if op := gm.leaveGroup(1, a); op != groupDelete {
+		t.Fatalf("leave on 1 returned %d", op)
+	}
+	if n := gm.members(2, group); n != 1 {
+		t.Fatalf("%d members on 2, want 1", n)
+	}
+}
+
+func TestGroupMapDistinctGroups(t *testing.T) {
+	a := net.ParseIP("2001:db8::1:aa:bbcc")
+	b := net.ParseIP("2001:db8::1:ab:bbcc")
+
+	gm := newGroupMap()
+	if op := gm.joinGroup(1, a); op != groupAdd {
+		t.Fatalf("join a returned %d", op)
+	}
+	if op := gm.joinGroup(1, b); op != groupAdd {
+		t.Fatalf("join b returned %d, groups differ in the last 24 bits", op)
+	}
+	if op := gm.leaveGroup(1, a); op != groupDelete {
+		t.Fatalf("leave a returned %d", op)
+	}
+	if op := gm.leaveGroup(1, b); op != groupDelete {
+		t.Fatalf("leave b returned %d", op)
+	}
+}
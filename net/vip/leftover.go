@@ -0,0 +1,160 @@
+package vip
+
+import (
+	"sort"
+)
+
+// taggedAddresses returns the VIP addresses tagged by setLookup by address
+func (m *Manager) taggedAddresses() (addrs map[string]ifAddr, err error) {
+	list, err := m.addrs.list()
+	if err != nil {
+		return
+	}
+	return parseTagged(list), nil
+}
+
+// parseTagged keeps the tagged addresses, on lo and dummies only host
+// prefixes as setLookup binds there
+func parseTagged(list []ifAddr) (addrs map[string]ifAddr) {
+	addrs = make(map[string]ifAddr)
+	for _, a := range list {
+		if a.ip.IsLoopback() || !a.tagged() {
+			continue
+		}
+		if (a.device == "lo" || a.kind == "dummy") && a.prefixLen != a.bits() {
+			continue
+		}
+		addrs[a.ip.String()] = a
+	}
+	return
+}
+
+// Leftovers returns VIPs bound by an earlier process, e.g. one that crashed,
+// which this process does not know about, sorted. IPv6 ones are only found
+// on kernels since 5.18, which keep the protocol tagging them.
+func Leftovers() (addrs []string, err error) {
+	return defaultManager.Leftovers()
+}
+
+func (m *Manager) Leftovers() (addrs []string, err error) {
+	err = m.ns.Do(func() (err error) {
+		leftovers, err := m.leftovers()
+		addrs = sortedAddresses(leftovers)
+		return
+	})
+	return
+}
+
+// leftovers maps the leftover VIPs to their address
+func (m *Manager) leftovers() (addrs map[string]ifAddr, err error) {
+	tagged, err := m.taggedAddresses()
+	if err != nil {
+		return
+	}
+
+	addrs = make(map[string]ifAddr)
+	for addr, a := range tagged {
+		if m.vipes.get(addr) == nil {
+			addrs[addr] = a
+		}
+	}
+	return
+}
+
+func sortedAddresses(addrs map[string]ifAddr) (sorted []string) {
+	for addr := range addrs {
+		sorted = append(sorted, addr)
+	}
+	sort.Strings(sorted)
+	return
+}
+
+// Adopt takes over the leftover VIPs as if Add had been called for each of
+// them, they are bound but not enabled. Addresses bound to an interface are
+// removed until Enable, the kernel would answer for them meanwhile.
+func Adopt() (adopted []string, err error) {
+	return defaultManager.Adopt()
+}
+
+func (m *Manager) Adopt() (adopted []string, err error) {
+	err = m.ns.Do(func() (err error) {
+		adopted, err = m.adopt()
+		return
+	})
+	return
+}
+
+func (m *Manager) adopt() (adopted []string, err error) {
+	leftovers, err := m.leftovers()
+	if err != nil {
+		return
+	}
+
+	for _, addr := range sortedAddresses(leftovers) {
+		b := leftoverBinding(leftovers[addr])
+		if b.Mode == BindInterface {
+			if perr := m.purge(addr, leftovers[addr]); perr != nil {
+				if err == nil {
+					err = perr
+				}
+				continue
+			}
+		}
+		if aerr := m.add(addr, WithBinding(b)); aerr != nil {
+			if err == nil {
+				err = aerr
+			}
+			continue
+		}
+		adopted = append(adopted, addr)
+	}
+	return
+}
+
+// Purge removes the leftover VIP addresses from their devices
+func Purge() (purged []string, err error) {
+	return defaultManager.Purge()
+}
+
+func (m *Manager) Purge() (purged []string, err error) {
+	err = m.ns.Do(func() (err error) {
+		purged, err = m.purgeLeftovers()
+		return
+	})
+	return
+}
+
+func (m *Manager) purgeLeftovers() (purged []string, err error) {
+	leftovers, err := m.leftovers()
+	if err != nil {
+		return
+	}
+
+	for _, addr := range sortedAddresses(leftovers) {
+		if perr := m.purge(addr, leftovers[addr]); perr != nil {
+			if err == nil {
+				err = perr
+			}
+			continue
+		}
+		purged = append(purged, addr)
+	}
+	return
+}
+
+func (m *Manager) purge(addr string, a ifAddr) (err error) {
+	v, err := parseIP(addr)
+	if err != nil {
+		return
+	}
+	v.bind = leftoverBinding(a)
+
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	// added meanwhile, it is not a leftover anymore
+	if m.vipes.get(v.address) != nil {
+		return
+	}
+	return m.unsetLookup(v)
+}
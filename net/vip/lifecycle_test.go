@@ -0,0 +1,195 @@
+package vip
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLifecycle(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	const vip = "10.0.0.100"
+
+	steps := []struct {
+		name  string
+		op    func(string) error
+		err   error
+		state State
+	}{
+		{"add", func(a string) error { return n.m.add(a) }, nil, StateBound},
+		{"add again", func(a string) error { return n.m.add(a) }, nil, StateBound},
+		{"disable bound", n.m.disable, &StateError{Address: vip, Op: "disable", State: StateBound}, StateBound},
+		{"enable", n.m.enable, nil, StateAnnounced},
+		{"enable again", n.m.enable, nil, StateAnnounced},
+		{"disable", n.m.disable, nil, StateAnnounced},
+		{"disable last", n.m.disable, nil, StateWithdrawn},
+		{"disable withdrawn", n.m.disable, &StateError{Address: vip, Op: "disable", State: StateWithdrawn}, StateWithdrawn},
+		{"enable withdrawn", n.m.enable, nil, StateAnnounced},
+		{"remove", n.m.remove, nil, StateAnnounced},
+		// the last reference withdraws the VIP whatever its enables
+		{"remove last", n.m.remove, nil, StateRemoved},
+		{"remove removed", n.m.remove, ErrNotAdded, StateRemoved},
+		{"enable removed", n.m.enable, ErrNotAdded, StateRemoved},
+		{"disable removed", n.m.disable, ErrNotAdded, StateRemoved},
+	}
+	for _, s := range steps {
+		err := s.op(vip)
+		if !reflect.DeepEqual(err, s.err) {
+			t.Fatalf("%s: %v, want %v", s.name, err, s.err)
+		}
+		state, _ := n.m.GetState(vip)
+		if state != s.state {
+			t.Fatalf("%s: %s, want %s", s.name, state, s.state)
+		}
+	}
+
+	want := []string{
+		"address replace 10.0.0.100/32 dev lo",
+		"address del 10.0.0.100/32 dev lo",
+	}
+	if !reflect.DeepEqual(n.ip.cmds, want) {
+		t.Fatalf("ip %q, want %q", n.ip.cmds, want)
+	}
+}
+
+func TestEnableDeclared(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	v, err := parseIP("10.0.0.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.refs, v.state = 1, StateDeclared
+	n.m.vipes.add(v)
+
+	var stateErr *StateError
+	if err := n.m.enable("10.0.0.100"); !errors.As(err, &stateErr) || stateErr.State != StateDeclared {
+		t.Fatalf("enable declared: %v", err)
+	}
+}
+
+func TestRemoveUnbindFails(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	const vip = "10.0.0.100"
+	if err := n.m.add(vip); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.enable(vip); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("busy")
+	n.ip.fail["address del"] = failed
+	if err := n.m.remove(vip); err != failed {
+		t.Fatalf("remove: %v", err)
+	}
+	// kept withdrawn, its address is still bound
+	if state, err := n.m.GetState(vip); err != nil || state != StateWithdrawn {
+		t.Fatalf("after a failed remove: %s, %v", state, err)
+	}
+
+	delete(n.ip.fail, "address del")
+	if err := n.m.remove(vip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.m.GetState(vip); err != ErrNotAdded {
+		t.Fatalf("after remove: %v", err)
+	}
+}
+
+func TestAddFails(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.ip.fail["address replace"] = errors.New("no permission")
+	if err := n.m.add("10.0.0.100"); err == nil {
+		t.Fatal("add succeeded")
+	}
+	if list := n.m.List(); len(list) != 0 {
+		t.Fatalf("kept %v", list)
+	}
+}
+
+func TestVirtualMACShared(t *testing.T) {
+	for _, order := range [][]string{{"10.0.0.100", "10.0.0.101"}, {"10.0.0.101", "10.0.0.100"}} {
+		n := newFakeNode(t, eth0)
+		n.m.vipInterfaces = []*net.Interface{eth0}
+		for _, vip := range []string{"10.0.0.100", "10.0.0.101"} {
+			if err := n.m.add(vip, WithVirtualMAC(5, VirtualMACMacvlan)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if refs := n.m.vmacLinks["vmac4.5"]; refs != 2 {
+			t.Fatalf("vmac4.5 shared by %d VIPs, want 2", refs)
+		}
+
+		links := func() (cmds []string) {
+			for _, cmd := range n.ip.cmds {
+				if strings.HasPrefix(cmd, "link ") {
+					cmds = append(cmds, cmd)
+				}
+			}
+			return
+		}
+		if err := n.m.remove(order[0]); err != nil {
+			t.Fatal(err)
+		}
+		if refs := n.m.vmacLinks["vmac4.5"]; refs != 1 {
+			t.Fatalf("removing %s: vmac4.5 shared by %d VIPs, want 1", order[0], refs)
+		}
+		if err := n.m.remove(order[1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := n.m.vmacLinks["vmac4.5"]; ok {
+			t.Fatalf("vmac4.5 kept after removing %v", order)
+		}
+
+		want := []string{
+			"link add link eth0 name vmac4.5 address 00:00:5e:00:01:05 type macvlan mode private",
+			"link set vmac4.5 up",
+			"link del vmac4.5",
+		}
+		if !reflect.DeepEqual(links(), want) {
+			t.Fatalf("removing %v: ip %q, want %q", order, links(), want)
+		}
+	}
+}
+
+func TestVirtualMACFails(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.ip.fail["link set"] = errors.New("no such device")
+	if err := n.m.add("10.0.0.100", WithVirtualMAC(5, VirtualMACMacvlan)); err == nil {
+		t.Fatal("add succeeded")
+	}
+	if refs, ok := n.m.vmacLinks["vmac4.5"]; ok {
+		t.Fatalf("vmac4.5 counted %d times", refs)
+	}
+	// the address went again, the link too
+	if len(n.addrs.addrs) != 0 {
+		t.Fatalf("addresses %v kept", n.addrs.addrs)
+	}
+	if last := n.ip.cmds[len(n.ip.cmds)-1]; last != "address del 10.0.0.100/32 dev lo" {
+		t.Fatalf("last ip command %q", last)
+	}
+}
+
+func TestClose(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	if err := n.m.add("10.0.0.100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.enable("10.0.0.100"); err != errClosed {
+		t.Fatalf("enable after Close: %v", err)
+	}
+	if state, err := n.m.GetState("10.0.0.100"); err != nil || state != StateBound {
+		t.Fatalf("after Close: %s, %v", state, err)
+	}
+	if err := n.m.Close(); err != nil {
+		t.Fatalf("closed twice: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package vip
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/adoyee/go-utils/net/arp"
+	"golang.org/x/net/ipv6"
+)
+
+// frames as received on an AF_PACKET socket, 02:00:00:00:00:02 at 10.0.0.2
+// asking for 10.0.0.100
+const (
+	frameRequest = "ffffffffffff020000000002" + "0806" +
+		"0001080006040001" + "0200000000020a000002" + "0000000000000a000064" +
+		"000000000000000000000000000000000000"
+	frameRequestOther = "ffffffffffff020000000002" + "0806" +
+		"0001080006040001" + "0200000000020a000002" + "0000000000000a000065" +
+		"000000000000000000000000000000000000"
+	frameReply = "020000000001020000000002" + "0806" +
+		"0001080006040002" + "0200000000020a000002" + "0200000000010a000064" +
+		"000000000000000000000000000000000000"
+	// the inner tag of QinQ, the kernel moved the outer one to auxdata
+	frameRequestInnerTag = "ffffffffffff020000000002" + "8100012c" + "0806" +
+		"0001080006040001" + "0200000000020a000002" + "0000000000000a000064" +
+		"00000000000000000000000000000000"
+	// IPoIB, a 4 byte link header and 20 byte hardware addresses
+	frameRequestInfiniband = "08060000" +
+		"0020080014040001" + "00000048fe80000000000000020000fffe000002" + "0a000002" +
+		"0000000000000000000000000000000000000000" + "0a000064"
+
+	// a neighbor solicitation from fd00::2 for fd00::100
+	messageSolicitation = "8700000000000000" + "fd000000000000000000000000000100" + "0101020000000002"
+)
+
+var (
+	requesterMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	eth0         = &net.Interface{Index: 2, Name: "eth0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}}
+	eth1         = &net.Interface{Index: 3, Name: "eth1", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}}
+	ib0          = &net.Interface{Index: 4, Name: "ib0", HardwareAddr: append(net.HardwareAddr{0x00, 0x00, 0x00, 0x49},
+		bytes.Repeat([]byte{0x11}, 16)...)}
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func etherFrame(hexFrame string, ifc *net.Interface) fakeFrame {
+	return fakeFrame{
+		data: mustHex(hexFrame),
+		from: &syscall.SockaddrLinklayer{
+			Protocol: htons(syscall.ETH_P_ARP),
+			Ifindex:  ifc.Index,
+			Hatype:   syscall.ARPHRD_ETHER,
+		},
+	}
+}
+
+func TestListener4(t *testing.T) {
+	outgoing := etherFrame(frameRequest, eth0)
+	outgoing.from.Pkttype = syscall.PACKET_OUTGOING
+
+	qinq := etherFrame(frameRequestInnerTag, eth0)
+	qinq.oob = auxdataOOB(tpacketAuxdata{
+		status:   tpStatusVlanValid | tpStatusVlanTpidValid,
+		vlanTCI:  200,
+		vlanTPID: arp.EtherTypeServiceVLAN,
+	})
+
+	infiniband := fakeFrame{
+		data: mustHex(frameRequestInfiniband),
+		oob:  auxdataOOB(tpacketAuxdata{net: 4}),
+		from: &syscall.SockaddrLinklayer{
+			Protocol: htons(syscall.ETH_P_ARP),
+			Ifindex:  ib0.Index,
+			Hatype:   syscall.ARPHRD_INFINIBAND,
+		},
+	}
+
+	// the member the requester does not hash to stays silent
+	members := []string{"a", "b"}
+	ring, _ := newBalanceRing("a", members)
+	notOwner := "a"
+	if ring.owner(requesterKey(net.ParseIP("10.0.0.2"), requesterMAC)) == "a" {
+		notOwner = "b"
+	}
+
+	cases := []struct {
+		name  string
+		frame fakeFrame
+		opts  []Option
+		// vlanDevice is a VLAN id with a device on eth0
+		vlanDevice uint16
+		// cooked replies go out without a link-layer header
+		reply, cooked bool
+		vlans         []arp.VLAN
+		mac           net.HardwareAddr
+	}{
+		{name: "request", frame: etherFrame(frameRequest, eth0), reply: true, mac: eth0.HardwareAddr},
+		{name: "not a VIP", frame: etherFrame(frameRequestOther, eth0)},
+		{name: "other interface", frame: etherFrame(frameRequest, eth1)},
+		{name: "outgoing", frame: outgoing},
+		{name: "reply", frame: etherFrame(frameReply, eth0)},
+		{
+			name: "QinQ", frame: qinq, reply: true, mac: eth0.HardwareAddr,
+			vlans: []arp.VLAN{{TPID: arp.EtherTypeServiceVLAN, TCI: 200}, {TPID: arp.EtherTypeVLAN, TCI: 300}},
+		},
+		{name: "VLAN device answers", frame: qinq, vlanDevice: 200},
+		{name: "infiniband", frame: infiniband, reply: true, cooked: true, mac: ib0.HardwareAddr},
+		{
+			name: "virtual MAC", frame: etherFrame(frameRequest, eth0), reply: true,
+			opts: []Option{WithVirtualMAC(5, VirtualMACSpoof)},
+			mac:  net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x01, 0x05},
+		},
+		{
+			name: "denied requester", frame: etherFrame(frameRequest, eth0),
+			opts: []Option{WithPolicy(Policy{Deny: []string{requesterMAC.String()}})},
+		},
+		{
+			name: "balanced to another node", frame: etherFrame(frameRequest, eth0),
+			opts: []Option{WithBalance(notOwner, members)},
+		},
+		{
+			name: "kernel answers", frame: etherFrame(frameRequest, eth0),
+			opts: []Option{WithBinding(Binding{Mode: BindInterface})},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := newFakeNode(t, eth0, eth1, ib0)
+			n.m.vipInterfaces = []*net.Interface{eth0, ib0}
+			if c.vlanDevice != 0 {
+				n.links.vlans[eth0.Index] = []uint16{c.vlanDevice}
+			}
+			n.announce(t, "10.0.0.100", c.opts...)
+
+			n.raw.frames = []fakeFrame{c.frame}
+			replied := false
+			if req, err := n.m.l4.accept(); err != io.EOF {
+				if replied, err = n.m.handle(req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if replied != c.reply {
+				t.Fatalf("replied = %v, want %v", replied, c.reply)
+			}
+			if !c.reply {
+				if len(n.raw.sent)+len(n.cooked.sent) != 0 {
+					t.Fatal("sent without replying")
+				}
+				return
+			}
+
+			sent, conn := n.raw.sent, "raw"
+			if c.cooked {
+				sent, conn = n.cooked.sent, "cooked"
+			}
+			if len(sent) != 1 {
+				t.Fatalf("%d frames sent on the %s socket, want 1", len(sent), conn)
+			}
+
+			payload := sent[0].data
+			if !c.cooked {
+				var f arp.Frame
+				if err := f.UnmarshalBinary(payload); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(f.Destination, requesterMAC) || !bytes.Equal(f.Source, c.mac) {
+					t.Fatalf("frame %s -> %s", f.Source, f.Destination)
+				}
+				if len(f.VLANs) != len(c.vlans) {
+					t.Fatalf("VLANs %v, want %v", f.VLANs, c.vlans)
+				}
+				for i := range c.vlans {
+					if f.VLANs[i] != c.vlans[i] {
+						t.Fatalf("VLANs %v, want %v", f.VLANs, c.vlans)
+					}
+				}
+				payload = f.Payload
+			}
+
+			var p arp.Packet
+			if err := p.UnmarshalBinary(payload); err != nil {
+				t.Fatal(err)
+			}
+			if p.Operation != arp.OperationReply || !p.SenderIP.Equal(net.ParseIP("10.0.0.100")) ||
+				!p.TargetIP.Equal(net.ParseIP("10.0.0.2")) || !bytes.Equal(p.SenderHardwareAddr, c.mac) {
+				t.Fatalf("reply %+v", p)
+			}
+		})
+	}
+}
+
+func TestListener6(t *testing.T) {
+	solicitation := func(ifc *net.Interface) fakeMessage {
+		return fakeMessage{
+			data: mustHex(messageSolicitation),
+			cm:   &ipv6.ControlMessage{IfIndex: ifc.Index, Src: net.ParseIP("fd00::2")},
+			addr: &net.IPAddr{IP: net.ParseIP("fd00::2")},
+		}
+	}
+
+	cases := []struct {
+		name  string
+		msg   fakeMessage
+		vip   string
+		opts  []Option
+		reply bool
+		mac   net.HardwareAddr
+	}{
+		{name: "solicitation", msg: solicitation(eth0), vip: "fd00::100", reply: true, mac: eth0.HardwareAddr},
+		{name: "not a VIP", msg: solicitation(eth0), vip: "fd00::101"},
+		{name: "other interface", msg: solicitation(eth1), vip: "fd00::100"},
+		{
+			name: "virtual MAC", msg: solicitation(eth0), vip: "fd00::100", reply: true,
+			opts: []Option{WithVirtualMAC(7, VirtualMACSpoof)},
+			mac:  net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x02, 0x07},
+		},
+		{
+			name: "denied by source link-layer address", msg: solicitation(eth0), vip: "fd00::100",
+			opts: []Option{WithPolicy(Policy{Deny: []string{requesterMAC.String()}})},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := newFakeNode(t, eth0, eth1)
+			n.m.vipInterfaces = []*net.Interface{eth0}
+			n.announce(t, c.vip, c.opts...)
+
+			n.icmp.in = []fakeMessage{c.msg}
+			req, err := n.m.l6.accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			replied, err := n.m.handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replied != c.reply {
+				t.Fatalf("replied = %v, want %v", replied, c.reply)
+			}
+			if !c.reply {
+				return
+			}
+
+			if len(n.icmp.sent) != 1 {
+				t.Fatalf("%d messages sent, want 1", len(n.icmp.sent))
+			}
+			sent := n.icmp.sent[0]
+			if sent.cm.IfIndex != eth0.Index || !sent.cm.Src.Equal(net.ParseIP(c.vip)) {
+				t.Fatalf("sent from %s on %d", sent.cm.Src, sent.cm.IfIndex)
+			}
+			if sent.addr.String() != "fd00::2" {
+				t.Fatalf("sent to %s", sent.addr)
+			}
+			want := "8800000060000000" + "fd000000000000000000000000000100" + "0201" + strings.Replace(c.mac.String(), ":", "", -1)
+			if got := hex.EncodeToString(sent.data); got != want {
+				t.Fatalf("advertisement %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGratuitous(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.announce(t, "10.0.0.100")
+	n.announce(t, "fd00::100")
+
+	if err := n.m.l4.gratuitous(net.ParseIP("10.0.0.100").To4()); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.raw.sent) != 1 {
+		t.Fatalf("%d frames sent, want 1", len(n.raw.sent))
+	}
+	var f arp.Frame
+	var p arp.Packet
+	if err := f.UnmarshalBinary(n.raw.sent[0].data); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UnmarshalBinary(f.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.Destination, arp.Broadcast) || !p.SenderIP.Equal(p.TargetIP) ||
+		!bytes.Equal(p.SenderHardwareAddr, eth0.HardwareAddr) {
+		t.Fatalf("gratuitous ARP %+v to %s", p, f.Destination)
+	}
+
+	if err := n.m.l6.gratuitous(net.ParseIP("fd00::100")); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.icmp.sent) != 1 || n.icmp.sent[0].addr.String() != "ff02::1:ff00:100" {
+		t.Fatalf("unsolicited advertisements %+v", n.icmp.sent)
+	}
+}
+
+func TestRefreshFilter(t *testing.T) {
+	n := newFakeNode(t, eth0, eth1)
+	if n.raw.bound != 0 {
+		t.Fatalf("bound to %d without vip interfaces", n.raw.bound)
+	}
+
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	n.m.filterTargets = true
+	if err := n.m.l4.refreshFilter(); err != nil {
+		t.Fatal(err)
+	}
+	if n.raw.bound != eth0.Index {
+		t.Fatalf("bound to %d, want %d", n.raw.bound, eth0.Index)
+	}
+	if len(n.raw.filter) != 1 || n.raw.filter[0].K != bpfDrop {
+		t.Fatalf("filter without VIPs %v, want to drop everything", n.raw.filter)
+	}
+
+	n.m.vipInterfaces = append(n.m.vipInterfaces, eth1)
+	n.announce(t, "10.0.0.100")
+	if err := n.m.l4.refreshFilter(); err != nil {
+		t.Fatal(err)
+	}
+	if n.raw.bound != 0 || len(n.raw.filter) < 2 {
+		t.Fatalf("bound to %d with filter %v", n.raw.bound, n.raw.filter)
+	}
+}
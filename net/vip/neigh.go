@@ -0,0 +1,181 @@
+package vip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// neighbor states, see linux/neighbour.h
+const (
+	NeighIncomplete NeighState = 0x01
+	NeighReachable  NeighState = 0x02
+	NeighStale      NeighState = 0x04
+	NeighDelay      NeighState = 0x08
+	NeighProbe      NeighState = 0x10
+	NeighFailed     NeighState = 0x20
+	NeighNoARP      NeighState = 0x40
+	NeighPermanent  NeighState = 0x80
+)
+
+// neighbor attributes, see linux/neighbour.h
+const (
+	ndaDst    = 1
+	ndaLLAddr = 2
+)
+
+// NeighState is the NUD state of a neighbor entry
+type NeighState uint16
+
+var neighStateNames = []string{"incomplete", "reachable", "stale", "delay", "probe", "failed", "noarp", "permanent"}
+
+func (s NeighState) String() string {
+	var names []string
+	for i, name := range neighStateNames {
+		if s&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Neighbor is an entry of the kernel's ARP or NDP table
+type Neighbor struct {
+	IP        net.IP
+	MAC       net.HardwareAddr
+	Interface string
+	State     NeighState
+}
+
+// ndmsg is struct ndmsg of linux/neighbour.h
+type ndmsg struct {
+	family  uint8
+	pad1    uint8
+	pad2    uint16
+	ifIndex int32
+	state   uint16
+	flags   uint8
+	typ     uint8
+}
+
+const sizeofNdmsg = int(unsafe.Sizeof(ndmsg{}))
+
+// Neighbors returns the neighbor table of the default Manager's namespace
+func Neighbors() ([]Neighbor, error) {
+	return defaultManager.Neighbors()
+}
+
+// Neighbors returns the ARP and NDP entries of m's namespace, run on a peer's
+// namespace it tells which MAC the peer resolves a VIP to
+func (m *Manager) Neighbors() (neighbors []Neighbor, err error) {
+	err = m.ns.Do(func() (err error) {
+		neighbors, err = m.neighbors()
+		return
+	})
+	return
+}
+
+func (m *Manager) neighbors() (neighbors []Neighbor, err error) {
+	msgs, err := netlinkDump(syscall.RTM_GETNEIGH)
+	if err != nil {
+		return
+	}
+
+	names := make(map[int]string)
+	for _, msg := range msgs {
+		n, index, ok := parseNeighbor(&msg)
+		if !ok {
+			continue
+		}
+		if _, ok := names[index]; !ok {
+			if ifc, err := m.links.interfaceByIndex(index); err == nil {
+				names[index] = ifc.Name
+			}
+		}
+		n.Interface = names[index]
+		neighbors = append(neighbors, n)
+	}
+	return
+}
+
+// parseNeighbor reads an RTM_NEWNEIGH message, entries without an IP
+// address, e.g. bridge FDB ones, are skipped
+func parseNeighbor(msg *syscall.NetlinkMessage) (n Neighbor, ifIndex int, ok bool) {
+	if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < sizeofNdmsg {
+		return
+	}
+	nd := (*ndmsg)(unsafe.Pointer(&msg.Data[0]))
+	if nd.family != syscall.AF_INET && nd.family != syscall.AF_INET6 {
+		return
+	}
+	n.State = NeighState(nd.state)
+
+	parseAttrs(msg.Data[nlmAlign(sizeofNdmsg):], func(typ uint16, value []byte) {
+		switch typ {
+		case ndaDst:
+			n.IP = append(net.IP(nil), value...)
+		case ndaLLAddr:
+			n.MAC = append(net.HardwareAddr(nil), value...)
+		}
+	})
+	if n.IP == nil {
+		return
+	}
+	return n, int(nd.ifIndex), true
+}
+
+// FlushNeighbors makes the default Manager flush stale entries on takeover,
+// see Manager.FlushNeighbors
+func FlushNeighbors(on bool) {
+	defaultManager.FlushNeighbors(on)
+}
+
+// FlushNeighbors makes Enable drop the neighbor entries of a VIP when it
+// moves to this node, e.g. the old owner's MAC learned while this node was
+// the backup, so they cannot outlive the takeover
+func (m *Manager) FlushNeighbors(on bool) {
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+	m.flushNeighbors = on
+}
+
+// flushNeighbor removes the entries of ip on every interface but permanent
+// and noarp ones, like ip neigh flush
+func flushNeighbor(ip net.IP) (err error) {
+	msgs, err := netlinkDump(syscall.RTM_GETNEIGH)
+	if err != nil {
+		return fmt.Errorf("flush neighbors of %s: %v", ip, err)
+	}
+	for _, msg := range msgs {
+		n, index, ok := parseNeighbor(&msg)
+		if !ok || !n.IP.Equal(ip) || n.State&(NeighPermanent|NeighNoARP) != 0 {
+			continue
+		}
+		e := netlinkRequest("delete neighbor "+ip.String(), syscall.RTM_DELNEIGH, 0, delNeighMessage(n.IP, index))
+		// gone meanwhile
+		if errors.Is(e, syscall.ENOENT) {
+			continue
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// delNeighMessage returns the RTM_DELNEIGH message of the entry of ip on the
+// interface ifIndex
+func delNeighMessage(ip net.IP, ifIndex int) []byte {
+	nd := ndmsg{family: syscall.AF_INET6, ifIndex: int32(ifIndex)}
+	if ip4 := ip.To4(); ip4 != nil {
+		nd.family, ip = syscall.AF_INET, ip4
+	}
+	msg := append([]byte(nil), (*[sizeofNdmsg]byte)(unsafe.Pointer(&nd))[:]...)
+	return appendAttr(msg, ndaDst, ip)
+}
@@ -0,0 +1,72 @@
+package vip
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// neighMessage builds an RTM_NEWNEIGH message in host byte order
+func neighMessage(nd ndmsg, attrs map[uint16][]byte) *syscall.NetlinkMessage {
+	data := make([]byte, nlmAlign(sizeofNdmsg))
+	*(*ndmsg)(unsafe.Pointer(&data[0])) = nd
+	for typ, value := range attrs {
+		a := make([]byte, nlmAlign(syscall.SizeofRtAttr+len(value)))
+		*(*syscall.RtAttr)(unsafe.Pointer(&a[0])) = syscall.RtAttr{
+			Len:  uint16(syscall.SizeofRtAttr + len(value)),
+			Type: typ,
+		}
+		copy(a[syscall.SizeofRtAttr:], value)
+		data = append(data, a...)
+	}
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH},
+		Data:   data,
+	}
+}
+
+func TestParseNeighbor(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	ip := net.ParseIP("fd00::100")
+
+	n, index, ok := parseNeighbor(neighMessage(
+		ndmsg{family: syscall.AF_INET6, ifIndex: 2, state: uint16(NeighStale)},
+		map[uint16][]byte{ndaDst: ip, ndaLLAddr: mac},
+	))
+	if !ok || index != 2 || !n.IP.Equal(ip) || n.MAC.String() != mac.String() || n.State != NeighStale {
+		t.Fatalf("neighbor %+v on %d", n, index)
+	}
+
+	// incomplete entries have no link-layer address yet
+	n, _, ok = parseNeighbor(neighMessage(
+		ndmsg{family: syscall.AF_INET, ifIndex: 2, state: uint16(NeighIncomplete)},
+		map[uint16][]byte{ndaDst: net.ParseIP("10.0.0.100").To4()},
+	))
+	if !ok || n.MAC != nil || n.State.String() != "incomplete" {
+		t.Fatalf("incomplete neighbor %+v", n)
+	}
+
+	// bridge FDB entries are not neighbors
+	if _, _, ok = parseNeighbor(neighMessage(
+		ndmsg{family: syscall.AF_BRIDGE, ifIndex: 2},
+		map[uint16][]byte{ndaLLAddr: mac},
+	)); ok {
+		t.Fatal("parsed a bridge entry")
+	}
+}
+
+func TestDelNeighMessage(t *testing.T) {
+	for _, ip := range []net.IP{net.ParseIP("10.0.0.100"), net.ParseIP("fd00::100")} {
+		msg := &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH}, Data: delNeighMessage(ip, 3)}
+		want := ip.To4()
+		if want == nil {
+			want = ip
+		}
+		n, index, ok := parseNeighbor(msg)
+		if !ok || index != 3 || !bytes.Equal(n.IP, want) {
+			t.Fatalf("%s: neighbor %+v on %d", ip, n, index)
+		}
+	}
+}
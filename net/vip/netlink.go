@@ -0,0 +1,99 @@
+package vip
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/adoyee/go-utils/net/preflight"
+)
+
+// netlinkRequest sends a NETLINK_ROUTE request of the calling thread's
+// namespace and waits for its acknowledgement, op describes it in errors.
+// Failures for lack of CAP_NET_ADMIN are a *preflight.MissingError.
+func netlinkRequest(op string, typ, flags uint16, data []byte) (err error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+
+	const seq = 1
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	msg = append(msg, data...)
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&msg[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  typ,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   seq,
+	}
+	if err = syscall.Sendto(fd, msg, 0, kernel); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buff := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buff, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buff[:n])
+		if err != nil {
+			return os.NewSyscallError("parsenetlinkmessage", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			errno := -*(*int32)(unsafe.Pointer(&m.Data[0]))
+			if errno == 0 {
+				return nil
+			}
+			err = os.NewSyscallError(op, syscall.Errno(errno))
+			return preflight.Explain("netlink", err, preflight.CapNetAdmin)
+		}
+	}
+}
+
+// appendAttr appends a route attribute to b
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	a := syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: typ}
+	b = append(b, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&a))[:]...)
+	b = append(b, value...)
+	for len(b) != nlmAlign(len(b)) {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// parseAttrs calls f with the route attributes of b, a malformed one ends
+// the walk
+func parseAttrs(b []byte, f func(typ uint16, value []byte)) {
+	for len(b) >= syscall.SizeofRtAttr {
+		a := (*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		if int(a.Len) < syscall.SizeofRtAttr || int(a.Len) > len(b) {
+			return
+		}
+		f(a.Type, b[syscall.SizeofRtAttr:a.Len])
+		if next := nlmAlign(int(a.Len)); next < len(b) {
+			b = b[next:]
+		} else {
+			b = nil
+		}
+	}
+}
+
+func nlmAlign(n int) int {
+	return (n + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&b[0])) = v
+	return b
+}
@@ -0,0 +1,402 @@
+package vip
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adoyee/go-utils/net/arp"
+	"github.com/adoyee/go-utils/net/internal/nstest"
+	"github.com/adoyee/go-utils/net/preflight"
+)
+
+const (
+	probeTimeout = time.Second
+	// silenceTimeout is how long a probe waits for a reply that must not come
+	silenceTimeout = 300 * time.Millisecond
+)
+
+func newNamespaceManager(t *testing.T) (*nstest.Pair, *Manager) {
+	p := nstest.NewPair(t)
+	// the kernel must not answer for the VIPs on lo itself
+	p.Local.Sysctl(t, "ipv4/conf/all/arp_ignore", "8")
+
+	m := New(p.Local.NS)
+	// cleanups run in reverse, the Manager goes before its namespace
+	t.Cleanup(func() { _ = m.Close() })
+	if err := m.VipInterface(p.Local.Link); err != nil {
+		t.Fatal(err)
+	}
+	return p, m
+}
+
+func TestNamespaceARP(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	p.Peer.IP(t, "address", "add", "10.0.0.2/24", "dev", p.Peer.Link)
+	src, vip := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.100")
+
+	if err := m.Add(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(vip.String())
+
+	if mac := p.Peer.ARP(t, src, vip, silenceTimeout); mac != nil {
+		t.Fatalf("bound VIP answered with %s", mac)
+	}
+
+	sniffer := p.Peer.Sniff(t)
+	if err := m.Enable(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	if mac := sniffer.GratuitousARP(vip, probeTimeout); !bytes.Equal(mac, p.Local.MAC) {
+		t.Fatalf("gratuitous ARP announced %s, want %s", mac, p.Local.MAC)
+	}
+
+	if mac := p.Peer.ARP(t, src, vip, probeTimeout); !bytes.Equal(mac, p.Local.MAC) {
+		t.Fatalf("ARP reply %s, want %s", mac, p.Local.MAC)
+	}
+
+	// the reply goes back on the VLANs of the request
+	qinq := []arp.VLAN{{TPID: arp.EtherTypeServiceVLAN, TCI: 200}, {TPID: arp.EtherTypeVLAN, TCI: 300}}
+	if mac := p.Peer.ARPTagged(t, src, vip, qinq, probeTimeout); !bytes.Equal(mac, p.Local.MAC) {
+		t.Fatalf("QinQ ARP reply %s, want %s", mac, p.Local.MAC)
+	}
+
+	if other := net.ParseIP("10.0.0.101"); p.Peer.ARP(t, src, other, silenceTimeout) != nil {
+		t.Fatal("answered for an address that is no VIP")
+	}
+
+	if err := m.Disable(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	if mac := p.Peer.ARP(t, src, vip, silenceTimeout); mac != nil {
+		t.Fatalf("disabled VIP answered with %s", mac)
+	}
+
+	if c := m.GlobalReplyStats(); c.Replies != 2 {
+		t.Fatalf("%d replies counted, want 2", c.Replies)
+	}
+}
+
+func TestNamespaceNDP(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	// solicitations are answered by unicast, which needs a route back
+	p.Local.IP(t, "address", "add", "fd00::1/64", "dev", p.Local.Link, "nodad")
+	p.Peer.IP(t, "address", "add", "fd00::2/64", "dev", p.Peer.Link, "nodad")
+	src, vip := net.ParseIP("fd00::2"), net.ParseIP("fd00::100")
+
+	if err := m.Add(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(vip.String())
+
+	sniffer := p.Peer.Sniff(t)
+	if err := m.Enable(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	if mac := sniffer.UnsolicitedNA(vip, probeTimeout); !bytes.Equal(mac, p.Local.MAC) {
+		t.Fatalf("unsolicited advertisement of %s, want %s", mac, p.Local.MAC)
+	}
+
+	if mac := p.Peer.Solicit(t, src, vip, probeTimeout); !bytes.Equal(mac, p.Local.MAC) {
+		t.Fatalf("advertisement of %s, want %s", mac, p.Local.MAC)
+	}
+}
+
+func TestNamespaceSysctls(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	p.Local.Sysctl(t, "ipv6/conf/all/accept_dad", "0")
+	p.Local.Sysctl(t, "ipv6/conf/"+p.Local.Link+"/accept_dad", "1")
+	sysctl := func(name string) (value int) {
+		t.Helper()
+		err := p.Local.NS.Do(func() (err error) {
+			value, err = preflight.SysctlInt(name)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	announce := "net.ipv4.conf." + p.Local.Link + ".arp_announce"
+	ignore := "net.ipv4.conf." + p.Local.Link + ".arp_ignore"
+	dad := "net.ipv6.conf." + p.Local.Link + ".accept_dad"
+
+	if err := m.SetSysctlMode(SysctlManage); err != nil {
+		t.Fatal(err)
+	}
+	if v := sysctl(announce); v != 2 {
+		t.Fatalf("%s is %d, want 2", announce, v)
+	}
+	if v := sysctl(dad); v != 0 {
+		t.Fatalf("%s is %d, want 0", dad, v)
+	}
+	// all already ignores
+	if v := sysctl(ignore); v != 0 {
+		t.Fatalf("%s is %d, want it untouched", ignore, v)
+	}
+	if failed := m.Preflight().Failed(); len(failed) != 0 {
+		t.Fatalf("failed checks %+v", failed)
+	}
+
+	if err := m.SetSysctlMode(SysctlWarn); err != nil {
+		t.Fatal(err)
+	}
+	if v := sysctl(announce); v != 0 {
+		t.Fatalf("%s is %d after restoring, want 0", announce, v)
+	}
+	if v := sysctl(dad); v != 1 {
+		t.Fatalf("%s is %d after restoring, want 1", dad, v)
+	}
+}
+
+func TestNamespaceBinding(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	// the kernel answers for addresses on the link, not for those on lo
+	p.Local.Sysctl(t, "ipv4/conf/all/arp_ignore", "1")
+	p.Local.IP(t, "address", "add", "10.0.0.1/24", "dev", p.Local.Link)
+	p.Peer.IP(t, "address", "add", "10.0.0.2/24", "dev", p.Peer.Link)
+	src := net.ParseIP("10.0.0.2")
+	onLink, unbound := net.ParseIP("10.0.0.100"), net.ParseIP("10.0.0.101")
+	addresses := func(dev string) (addrs map[string]int) {
+		t.Helper()
+		addrs = make(map[string]int)
+		err := p.Local.NS.Do(func() error {
+			ifc, err := net.InterfaceByName(dev)
+			if err != nil {
+				return err
+			}
+			list, err := ifc.Addrs()
+			for _, a := range list {
+				ones, _ := a.(*net.IPNet).Mask.Size()
+				addrs[a.(*net.IPNet).IP.String()] = ones
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if err := m.Add(onLink.String(), WithBinding(Binding{Mode: BindInterface})); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(onLink.String())
+	if err := m.Add(unbound.String(), WithBinding(Binding{Mode: BindNone})); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(unbound.String())
+
+	if _, ok := addresses(p.Local.Link)[onLink.String()]; ok {
+		t.Fatalf("%s bound before Enable", onLink)
+	}
+	if _, ok := addresses("lo")[unbound.String()]; ok {
+		t.Fatalf("%s bound to lo", unbound)
+	}
+
+	for _, vip := range []net.IP{onLink, unbound} {
+		if err := m.Enable(vip.String()); err != nil {
+			t.Fatal(err)
+		}
+		if mac := p.Peer.ARP(t, src, vip, probeTimeout); !bytes.Equal(mac, p.Local.MAC) {
+			t.Fatalf("ARP reply for %s %s, want %s", vip, mac, p.Local.MAC)
+		}
+	}
+	if ones := addresses(p.Local.Link)[onLink.String()]; ones != 24 {
+		t.Fatalf("%s bound with prefix length %d, want 24", onLink, ones)
+	}
+	if c := m.GlobalReplyStats(); c.Replies != 1 {
+		t.Fatalf("%d replies counted, want the one for %s", c.Replies, unbound)
+	}
+
+	if err := m.Disable(onLink.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := addresses(p.Local.Link)[onLink.String()]; ok {
+		t.Fatalf("%s still bound after Disable", onLink)
+	}
+}
+
+func TestNamespaceNeighbors(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	p.Local.IP(t, "address", "add", "10.0.0.1/24", "dev", p.Local.Link)
+	p.Peer.IP(t, "address", "add", "10.0.0.2/24", "dev", p.Peer.Link)
+	vip := net.ParseIP("10.0.0.100")
+	// learned while the old owner held the VIP
+	p.Local.IP(t, "neigh", "add", vip.String(), "lladdr", "02:00:00:00:00:99", "dev", p.Local.Link, "nud", "stale")
+
+	lookup := func(m *Manager) *Neighbor {
+		t.Helper()
+		neighbors, err := m.Neighbors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range neighbors {
+			if n.IP.Equal(vip) {
+				return &neighbors[i]
+			}
+		}
+		return nil
+	}
+	if n := lookup(m); n == nil || n.Interface != p.Local.Link || n.State != NeighStale {
+		t.Fatalf("stale entry %+v", n)
+	}
+
+	m.FlushNeighbors(true)
+	if err := m.Add(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(vip.String())
+	if err := m.Enable(vip.String()); err != nil {
+		t.Fatal(err)
+	}
+	if n := lookup(m); n != nil {
+		t.Fatalf("entry %+v left after takeover", n)
+	}
+
+	// traffic from the peer makes its kernel resolve the VIP
+	err := p.Peer.NS.Do(func() error {
+		conn, err := net.Dial("udp", net.JoinHostPort(vip.String(), "9"))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("x"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := New(p.Peer.NS)
+	deadline := time.Now().Add(probeTimeout)
+	for {
+		n := lookup(peer)
+		if n != nil && bytes.Equal(n.MAC, p.Local.MAC) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer resolves %s to %+v, want %s", vip, n, p.Local.MAC)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNamespaceRouteAnnouncer(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	routes := func(family, table string) string {
+		t.Helper()
+		out, err := exec.Command(ipTool, "-n", p.Local.Name, family, "route", "show", "table", table).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	vip := "10.0.0.100"
+
+	r := NewRouteAnnouncer(100)
+	r.Protocol = 4
+	if err := m.AddAnnouncer(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(vip); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(vip)
+	if err := m.Enable(vip); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := routes("-4", "100"), vip+" dev lo proto static scope link"; got != want {
+		t.Fatalf("routes %q, want %q", got, want)
+	}
+
+	if err := m.Disable(vip); err != nil {
+		t.Fatal(err)
+	}
+	if got := routes("-4", "100"); got != "" {
+		t.Fatalf("routes %q left after Disable", got)
+	}
+
+	// tables past 255 only fit RTA_TABLE
+	r6 := &RouteAnnouncer{Table: 1000, Metric: 10}
+	if err := m.AddAnnouncer(r6); err != nil {
+		t.Fatal(err)
+	}
+	vip6 := "fd00::100"
+	if err := m.Add(vip6); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove(vip6)
+	if err := m.Enable(vip6); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := routes("-6", "1000"), vip6+" dev lo metric 10 pref medium"; got != want {
+		t.Fatalf("routes %q, want %q", got, want)
+	}
+	if err := m.Disable(vip6); err != nil {
+		t.Fatal(err)
+	}
+	if got := routes("-6", "1000"); got != "" {
+		t.Fatalf("routes %q left after Disable", got)
+	}
+}
+
+func TestNamespaceLeftovers(t *testing.T) {
+	p, m := newNamespaceManager(t)
+	// addresses like ours someone else put on lo
+	p.Local.IP(t, "address", "add", "fd00::1/128", "dev", "lo", "noprefixroute")
+	p.Local.IP(t, "address", "add", "10.0.0.1/32", "dev", "lo")
+	for _, vip := range []string{"10.0.0.100", "fd00::100"} {
+		if err := m.Add(vip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a later process sees the VIPs, only them
+	later := New(p.Local.NS)
+	t.Cleanup(func() { _ = later.Close() })
+	leftovers, err := later.Leftovers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.100", "fd00::100"}; !reflect.DeepEqual(leftovers, want) {
+		t.Fatalf("leftovers %v, want %v", leftovers, want)
+	}
+
+	if _, err := later.Reconcile(nil, ReconcileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := later.Leftovers(); !reflect.DeepEqual(after, leftovers) {
+		t.Fatalf("leftovers %v after Reconcile, want %v kept", after, leftovers)
+	}
+	result, err := later.Reconcile(nil, ReconcileOptions{PurgeLeftovers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Removed, leftovers) {
+		t.Fatalf("purged %v, want %v", result.Removed, leftovers)
+	}
+
+	err = p.Local.NS.Do(func() error {
+		ifc, err := net.InterfaceByName("lo")
+		if err != nil {
+			return err
+		}
+		list, err := ifc.Addrs()
+		found := make(map[string]bool)
+		for _, a := range list {
+			found[a.(*net.IPNet).IP.String()] = true
+		}
+		if !found["fd00::1"] || !found["10.0.0.1"] || found["10.0.0.100"] {
+			t.Errorf("addresses of lo %v", list)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
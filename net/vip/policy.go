@@ -0,0 +1,324 @@
+package vip
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxSources bounds the requesters tracked per VIP for rate limiting
+	maxSources = 4096
+)
+
+// Policy restricts who gets ARP/NDP replies for a VIP and how many
+type Policy struct {
+	// Allow and Deny hold requester prefixes, addresses or MACs, an empty
+	// Allow admits every requester not denied
+	Allow []string
+	Deny  []string
+	// SourceRate limits replies per second to one requester, letting
+	// SourceBurst replies out at once, zero disables the limit
+	SourceRate  float64
+	SourceBurst int
+}
+
+// Counters of replies sent and suppressed
+type Counters struct {
+	Replies     uint64
+	Denied      uint64
+	RateLimited uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// sourceBucket is the bucket of a requester in vipPolicy.recent
+type sourceBucket struct {
+	key string
+	tokenBucket
+}
+
+// take refills the bucket for the time passed and takes a token if any
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type vipPolicy struct {
+	allowNets []*net.IPNet
+	allowMACs []net.HardwareAddr
+	denyNets  []*net.IPNet
+	denyMACs  []net.HardwareAddr
+
+	sourceRate  float64
+	sourceBurst int
+	lock        sync.Mutex
+	// sources holds at most maxSources elements of recent, which is ordered
+	// by last request, the most recent first
+	sources map[string]*list.Element
+	recent  *list.List
+}
+
+func compilePolicy(p Policy) (vp *vipPolicy, err error) {
+	vp = &vipPolicy{
+		sourceRate:  p.SourceRate,
+		sourceBurst: p.SourceBurst,
+		sources:     make(map[string]*list.Element),
+		recent:      list.New(),
+	}
+	if vp.sourceBurst < 1 {
+		vp.sourceBurst = 1
+	}
+
+	if vp.allowNets, vp.allowMACs, err = parseRequesters(p.Allow); err != nil {
+		return nil, err
+	}
+	if vp.denyNets, vp.denyMACs, err = parseRequesters(p.Deny); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func parseRequesters(list []string) (nets []*net.IPNet, macs []net.HardwareAddr, err error) {
+	for _, s := range list {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := len(ip) * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, net.IPv4len*8
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, nil, net.InvalidAddrError(s)
+		}
+		macs = append(macs, mac)
+	}
+	return
+}
+
+func matchRequester(nets []*net.IPNet, macs []net.HardwareAddr, ip net.IP, mac net.HardwareAddr) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	for _, m := range macs {
+		if mac != nil && m.String() == mac.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *vipPolicy) admitted(ip net.IP, mac net.HardwareAddr) bool {
+	if matchRequester(p.denyNets, p.denyMACs, ip, mac) {
+		return false
+	}
+	if len(p.allowNets) == 0 && len(p.allowMACs) == 0 {
+		return true
+	}
+	return matchRequester(p.allowNets, p.allowMACs, ip, mac)
+}
+
+func (p *vipPolicy) limited(ip net.IP, now time.Time) bool {
+	if p.sourceRate <= 0 {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key := ip.String()
+	e, ok := p.sources[key]
+	if ok {
+		p.recent.MoveToFront(e)
+	} else {
+		if len(p.sources) >= maxSources {
+			p.expire(now)
+		}
+		// still full, the least recent requester starts over
+		if len(p.sources) >= maxSources {
+			p.forget(p.recent.Back())
+		}
+		b := &sourceBucket{key: key, tokenBucket: tokenBucket{tokens: float64(p.sourceBurst), last: now}}
+		e = p.recent.PushFront(b)
+		p.sources[key] = e
+	}
+	return !e.Value.(*sourceBucket).take(p.sourceRate, p.sourceBurst, now)
+}
+
+// expire forgets requesters whose bucket has refilled, they start full anyway
+func (p *vipPolicy) expire(now time.Time) {
+	full := time.Duration(float64(p.sourceBurst) / p.sourceRate * float64(time.Second))
+	for e := p.recent.Back(); e != nil && now.Sub(e.Value.(*sourceBucket).last) >= full; e = p.recent.Back() {
+		p.forget(e)
+	}
+}
+
+func (p *vipPolicy) forget(e *list.Element) {
+	delete(p.sources, e.Value.(*sourceBucket).key)
+	p.recent.Remove(e)
+}
+
+// replyLimit limits the replies of a Manager
+type replyLimit struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  int
+	bucket tokenBucket
+}
+
+// WithPolicy applies p to the VIP's replies
+func WithPolicy(p Policy) Option {
+	return func(v *virtualIpAddress) {
+		vp, err := compilePolicy(p)
+		if err != nil && v.optErr == nil {
+			v.optErr = err
+		}
+		v.policy = vp
+	}
+}
+
+// SetPolicy replaces the reply policy of an added VIP
+func SetPolicy(address string, p Policy) (err error) {
+	return defaultManager.SetPolicy(address, p)
+}
+
+func (m *Manager) SetPolicy(address string, p Policy) (err error) {
+	v, err := parseIP(address)
+	if err != nil {
+		return
+	}
+
+	vp, err := compilePolicy(p)
+	if err != nil {
+		return
+	}
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return ErrNotAdded
+	}
+	m.vipes.setPolicy(cur, vp)
+	return
+}
+
+// SetReplyRate limits the replies per second across all VIPs, letting burst
+// replies out at once, a zero rate disables the limit
+func SetReplyRate(rate float64, burst int) {
+	defaultManager.SetReplyRate(rate, burst)
+}
+
+func (m *Manager) SetReplyRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	m.limit.lock.Lock()
+	defer m.limit.lock.Unlock()
+	m.limit.rate = rate
+	m.limit.burst = burst
+	m.limit.bucket = tokenBucket{tokens: float64(burst), last: time.Now()}
+}
+
+// ReplyStats returns the reply counters of an added VIP
+func ReplyStats(address string) (c Counters, err error) {
+	return defaultManager.ReplyStats(address)
+}
+
+func (m *Manager) ReplyStats(address string) (c Counters, err error) {
+	v, err := parseIP(address)
+	if err != nil {
+		return
+	}
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return c, ErrNotAdded
+	}
+	return loadCounters(cur.counters), nil
+}
+
+// GlobalReplyStats returns the reply counters of all VIPs and subnets
+func GlobalReplyStats() Counters {
+	return defaultManager.GlobalReplyStats()
+}
+
+func (m *Manager) GlobalReplyStats() Counters {
+	return loadCounters(&m.counters)
+}
+
+func loadCounters(c *Counters) Counters {
+	return Counters{
+		Replies:     atomic.LoadUint64(&c.Replies),
+		Denied:      atomic.LoadUint64(&c.Denied),
+		RateLimited: atomic.LoadUint64(&c.RateLimited),
+	}
+}
+
+func (l *replyLimit) limited(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return false
+	}
+	return !l.bucket.take(l.rate, l.burst, now)
+}
+
+// admit applies the VIP's policy and the global limit to a request, the
+// returned counters are the VIP's, nil for subnet entries
+func (m *Manager) admit(req vipRequest) (c *Counters, ok bool) {
+	ip, mac := req.sender()
+	now := time.Now()
+
+	var p *vipPolicy
+	if v := m.vipes.get(req.target().String()); v != nil {
+		c = v.counters
+		p = m.vipes.policy(v)
+	}
+
+	count := func(field func(c *Counters) *uint64) {
+		atomic.AddUint64(field(&m.counters), 1)
+		if c != nil {
+			atomic.AddUint64(field(c), 1)
+		}
+	}
+
+	if p != nil && !p.admitted(ip, mac) {
+		count(func(c *Counters) *uint64 { return &c.Denied })
+		return c, false
+	}
+
+	if (p != nil && p.limited(ip, now)) || m.limit.limited(now) {
+		count(func(c *Counters) *uint64 { return &c.RateLimited })
+		return c, false
+	}
+	return c, true
+}
+
+func (m *Manager) countReply(c *Counters) {
+	atomic.AddUint64(&m.counters.Replies, 1)
+	if c != nil {
+		atomic.AddUint64(&c.Replies, 1)
+	}
+}
@@ -0,0 +1,97 @@
+package vip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPolicyAdmitted(t *testing.T) {
+	p, err := compilePolicy(Policy{
+		Allow: []string{"10.0.0.0/24", "2001:db8::1", "02:00:00:00:00:01"},
+		Deny:  []string{"10.0.0.66", "02:00:00:00:00:bb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := func(s string) net.HardwareAddr {
+		m, _ := net.ParseMAC(s)
+		return m
+	}
+	cases := []struct {
+		ip    string
+		mac   net.HardwareAddr
+		admit bool
+	}{
+		{"10.0.0.1", nil, true},
+		{"10.0.0.66", nil, false},
+		{"10.0.1.1", nil, false},
+		{"10.0.0.2", mac("02:00:00:00:00:bb"), false},
+		{"192.168.0.1", mac("02:00:00:00:00:01"), true},
+		{"2001:db8::1", nil, true},
+		{"2001:db8::2", nil, false},
+		{"", nil, false},
+	}
+	for _, c := range cases {
+		if got := p.admitted(net.ParseIP(c.ip), c.mac); got != c.admit {
+			t.Errorf("admitted(%s, %s) = %v, want %v", c.ip, c.mac, got, c.admit)
+		}
+	}
+
+	open, _ := compilePolicy(Policy{Deny: []string{"10.0.0.66"}})
+	if !open.admitted(net.ParseIP("192.168.0.1"), nil) {
+		t.Error("empty allow list denied a requester")
+	}
+
+	if _, err := compilePolicy(Policy{Allow: []string{"bogus"}}); err == nil {
+		t.Error("compiled a bogus requester")
+	}
+}
+
+func TestPolicyLimited(t *testing.T) {
+	p, _ := compilePolicy(Policy{SourceRate: 1, SourceBurst: 2})
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	now := time.Now()
+
+	for i, want := range []bool{false, false, true} {
+		if got := p.limited(a, now); got != want {
+			t.Fatalf("request %d limited = %v, want %v", i, got, want)
+		}
+	}
+	if p.limited(b, now) {
+		t.Fatal("another requester shares the limit")
+	}
+	if p.limited(a, now.Add(time.Second)) {
+		t.Fatal("bucket did not refill")
+	}
+
+	p.expire(now.Add(time.Hour))
+	if len(p.sources) != 0 {
+		t.Fatalf("%d requesters left after expiry", len(p.sources))
+	}
+}
+
+func TestPolicySourcesBounded(t *testing.T) {
+	p, _ := compilePolicy(Policy{SourceRate: 1, SourceBurst: 1})
+	kept := net.ParseIP("10.0.0.1")
+	now := time.Now()
+	p.limited(kept, now)
+
+	// none of them refills in time
+	for i := 0; i < 2*maxSources; i++ {
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i))
+		if p.limited(ip, now) {
+			t.Fatalf("new requester %s limited", ip)
+		}
+		if i%64 == 0 && !p.limited(kept, now) {
+			t.Fatalf("request %d: %s not limited", i, kept)
+		}
+		if len(p.sources) > maxSources || p.recent.Len() != len(p.sources) {
+			t.Fatalf("%d requesters tracked, %d in order, at most %d", len(p.sources), p.recent.Len(), maxSources)
+		}
+	}
+	if _, ok := p.sources[net.IPv4(10, 1, 0, 1).String()]; ok {
+		t.Fatal("least recent requester kept")
+	}
+}
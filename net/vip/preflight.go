@@ -0,0 +1,73 @@
+package vip
+
+import (
+	"net"
+
+	"github.com/adoyee/go-utils/net/preflight"
+)
+
+// Preflight checks what Add and Enable need, see Manager.Preflight
+func Preflight() *preflight.Report {
+	return defaultManager.Preflight()
+}
+
+// Preflight checks what Add and Enable need in m's namespace. Missing
+// capabilities make them fail with a *preflight.MissingError, a missing ip
+// tool only VIPs on dummy devices or with virtual MACs. The sysctls of the
+// VIP interfaces, of all interfaces before VipInterface, decide whether the
+// kernel answers for VIPs bound to lo as well.
+func (m *Manager) Preflight() *preflight.Report {
+	r := new(preflight.Report)
+	err := m.ns.Do(func() error {
+		r.Add(preflight.CapabilityCheck(preflight.CapNetRaw, "ARP and NDP sockets"))
+		r.Add(preflight.CapabilityCheck(preflight.CapNetAdmin, "binding VIPs to lo"))
+		ip := preflight.ToolCheck(ipTool, "dummy devices and virtual MACs")
+		ip.Required = false
+		r.Add(ip)
+
+		names, err := m.sysctlInterfaces()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			for _, c := range sysctlChecks(name) {
+				r.Add(c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.Add(preflight.Check{Name: "namespace " + m.ns.String(), Required: true, Detail: err.Error()})
+	}
+	return r
+}
+
+// sysctlInterfaces are the VIP interfaces, or every interface but lo
+func (m *Manager) sysctlInterfaces() (names []string, err error) {
+	m.opLock.Lock()
+	for _, ifc := range m.vipInterfaces {
+		names = append(names, ifc.Name)
+	}
+	m.opLock.Unlock()
+	if len(names) != 0 {
+		return
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, ifc := range interfaces {
+		if ifc.Flags&net.FlagLoopback == 0 {
+			names = append(names, ifc.Name)
+		}
+	}
+	return
+}
+
+func sysctlChecks(ifName string) (checks []preflight.Check) {
+	for _, s := range vipSysctls {
+		checks = append(checks, s.Check(ifName))
+	}
+	return
+}
@@ -0,0 +1,213 @@
+package vip
+
+import (
+	"sort"
+)
+
+// VIPSpec describes a VIP the node should hold
+type VIPSpec struct {
+	Address string
+	// Enabled answers ARP/NDP for the VIP, otherwise it is only bound
+	Enabled bool
+	// Options apply when the VIP is added
+	Options []Option
+}
+
+// ReconcileResult lists the addresses Reconcile changed
+type ReconcileResult struct {
+	Added []string
+	// Adopted VIPs were already on the device, e.g. from a previous run
+	Adopted  []string
+	Removed  []string
+	Enabled  []string
+	Disabled []string
+}
+
+func (r *ReconcileResult) Changed() bool {
+	return len(r.Added)+len(r.Adopted)+len(r.Removed)+len(r.Enabled)+len(r.Disabled) != 0
+}
+
+// ReconcileOptions tune a Reconcile call
+type ReconcileOptions struct {
+	// PurgeLeftovers removes the leftovers of an earlier process missing
+	// from desired, see Purge, otherwise they are left alone
+	PurgeLeftovers bool
+}
+
+// reconcileClaim is what Reconcile holds on a VIP, one reference and at most
+// one Enable, so callers using Add/Enable directly are left alone
+type reconcileClaim struct {
+	enabled bool
+}
+
+// Reconcile brings the VIPs to the desired set, VIPs of an earlier Reconcile
+// missing from desired are removed, leftovers of an earlier process only
+// with opts.PurgeLeftovers. Every VIP is attempted, the first error is
+// returned along with what was changed.
+func Reconcile(desired []VIPSpec, opts ReconcileOptions) (result *ReconcileResult, err error) {
+	return defaultManager.Reconcile(desired, opts)
+}
+
+func (m *Manager) Reconcile(desired []VIPSpec, opts ReconcileOptions) (result *ReconcileResult, err error) {
+	err = m.ns.Do(func() (err error) {
+		result, err = m.reconcile(desired, opts)
+		return
+	})
+	return
+}
+
+func (m *Manager) reconcile(desired []VIPSpec, opts ReconcileOptions) (result *ReconcileResult, err error) {
+	m.reconcileLock.Lock()
+	defer m.reconcileLock.Unlock()
+
+	if err = m.checkInit(); err != nil {
+		return
+	}
+
+	want := make(map[string]VIPSpec, len(desired))
+	for _, spec := range desired {
+		v, err := parseIP(spec.Address)
+		if err != nil {
+			return nil, err
+		}
+		spec.Address = v.address
+		want[v.address] = spec
+	}
+
+	onDevice, err := m.boundAddresses()
+	if err != nil {
+		return
+	}
+
+	result = new(ReconcileResult)
+	record := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+
+	for _, addr := range sortedKeys(m.reconciled) {
+		if _, ok := want[addr]; ok {
+			continue
+		}
+
+		claim := m.reconciled[addr]
+		if claim.enabled {
+			record(m.disable(addr))
+		}
+		// remove withdraws the VIP whatever its enables, one it keeps stays
+		// claimed for the next Reconcile to remove
+		e := m.remove(addr)
+		record(e)
+		if e != nil && m.vipes.get(addr) != nil {
+			claim.enabled = false
+			continue
+		}
+		delete(m.reconciled, addr)
+		result.Removed = append(result.Removed, addr)
+	}
+
+	// desired leftovers are adopted below, the others only purged on request
+	leftovers, e := m.leftovers()
+	record(e)
+	for _, addr := range sortedAddresses(leftovers) {
+		if _, ok := want[addr]; ok || !opts.PurgeLeftovers {
+			continue
+		}
+		if e := m.purge(addr, leftovers[addr]); e != nil {
+			record(e)
+			continue
+		}
+		result.Removed = append(result.Removed, addr)
+	}
+
+	addrs := make([]string, 0, len(want))
+	for addr := range want {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		spec := want[addr]
+
+		claim := m.reconciled[addr]
+		if claim == nil {
+			a, leftover := leftovers[addr]
+			adopted := m.vipes.get(addr) == nil && (onDevice[addr] || leftover)
+			addOpts := spec.Options
+			if leftover {
+				b := leftoverBinding(a)
+				// the address goes back on the interface on Enable
+				if b.Mode == BindInterface {
+					if e := m.purge(addr, a); e != nil {
+						record(e)
+						continue
+					}
+				}
+				// a binding of the spec still wins
+				addOpts = append([]Option{WithBinding(b)}, addOpts...)
+			}
+			if e := m.add(addr, addOpts...); e != nil {
+				record(e)
+				continue
+			}
+
+			claim = new(reconcileClaim)
+			m.reconciled[addr] = claim
+			if adopted {
+				result.Adopted = append(result.Adopted, addr)
+			} else {
+				result.Added = append(result.Added, addr)
+			}
+		}
+
+		switch {
+		case spec.Enabled && !claim.enabled:
+			record(m.enable(addr))
+			// a failed announcement still counts, the VIP is answered and
+			// the announcers are retried
+			if state, _ := m.GetState(addr); state == StateAnnounced {
+				claim.enabled = true
+				result.Enabled = append(result.Enabled, addr)
+			}
+		case !spec.Enabled && claim.enabled:
+			e := m.disable(addr)
+			record(e)
+			// the Enable is gone either way, a failed withdrawal is retried
+			claim.enabled = false
+			if state, _ := m.GetState(addr); e == nil || state == StateWithdrawn {
+				result.Disabled = append(result.Disabled, addr)
+			}
+		}
+	}
+	return
+}
+
+// boundAddresses returns the addresses of all devices a VIP may have left,
+// the tagged ones and host addresses, untagged on kernels before 5.18
+func (m *Manager) boundAddresses() (addrs map[string]bool, err error) {
+	list, err := m.addrs.list()
+	if err != nil {
+		return
+	}
+
+	addrs = make(map[string]bool, len(list))
+	for _, a := range list {
+		if a.ip.IsLoopback() {
+			continue
+		}
+		if a.tagged() || a.prefixLen == a.bits() {
+			addrs[a.ip.String()] = true
+		}
+	}
+	return
+}
+
+func sortedKeys(m map[string]*reconcileClaim) (keys []string) {
+	keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,113 @@
+package vip
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	// bound by hand or by an old vipd, untagged
+	n.addrs.addrs = []ifAddr{{ip: net.ParseIP("10.0.0.103").To4(), prefixLen: 32, device: "lo"}}
+
+	steps := []struct {
+		name    string
+		desired []VIPSpec
+		fail    error
+		err     error
+		want    ReconcileResult
+		states  map[string]State
+	}{
+		{
+			name:    "add",
+			desired: []VIPSpec{{Address: "10.0.0.100", Enabled: true}, {Address: "10.0.0.101"}, {Address: "10.0.0.103"}},
+			want: ReconcileResult{
+				Added:   []string{"10.0.0.100", "10.0.0.101"},
+				Adopted: []string{"10.0.0.103"},
+				Enabled: []string{"10.0.0.100"},
+			},
+			states: map[string]State{"10.0.0.100": StateAnnounced, "10.0.0.101": StateBound, "10.0.0.103": StateBound},
+		},
+		{
+			name:    "unchanged",
+			desired: []VIPSpec{{Address: "10.0.0.100", Enabled: true}, {Address: "10.0.0.101"}, {Address: "10.0.0.103"}},
+			states:  map[string]State{"10.0.0.100": StateAnnounced, "10.0.0.101": StateBound, "10.0.0.103": StateBound},
+		},
+		{
+			name:    "diff",
+			desired: []VIPSpec{{Address: "10.0.0.100"}, {Address: "10.0.0.101", Enabled: true}, {Address: "10.0.0.102", Enabled: true}},
+			want: ReconcileResult{
+				Added:    []string{"10.0.0.102"},
+				Removed:  []string{"10.0.0.103"},
+				Enabled:  []string{"10.0.0.101", "10.0.0.102"},
+				Disabled: []string{"10.0.0.100"},
+			},
+			states: map[string]State{"10.0.0.100": StateWithdrawn, "10.0.0.101": StateAnnounced, "10.0.0.102": StateAnnounced},
+		},
+		{
+			// the VIPs are kept withdrawn and claimed, nothing is reported
+			name:    "remove fails",
+			desired: []VIPSpec{{Address: "10.0.0.100"}},
+			fail:    errors.New("busy"),
+			err:     errors.New("busy"),
+			states:  map[string]State{"10.0.0.100": StateWithdrawn, "10.0.0.101": StateWithdrawn, "10.0.0.102": StateWithdrawn},
+		},
+		{
+			name:    "remove again",
+			desired: []VIPSpec{{Address: "10.0.0.100"}},
+			want:    ReconcileResult{Removed: []string{"10.0.0.101", "10.0.0.102"}},
+			states:  map[string]State{"10.0.0.100": StateWithdrawn},
+		},
+	}
+	for _, s := range steps {
+		if s.fail != nil {
+			n.ip.fail["address del"] = s.fail
+		} else {
+			delete(n.ip.fail, "address del")
+		}
+		result, err := n.m.reconcile(s.desired, ReconcileOptions{})
+		if !reflect.DeepEqual(err, s.err) {
+			t.Fatalf("%s: %v, want %v", s.name, err, s.err)
+		}
+		if !reflect.DeepEqual(*result, s.want) {
+			t.Fatalf("%s: %+v, want %+v", s.name, *result, s.want)
+		}
+		states := make(map[string]State)
+		for _, addr := range n.m.List() {
+			states[addr], _ = n.m.GetState(addr)
+		}
+		if !reflect.DeepEqual(states, s.states) {
+			t.Fatalf("%s: states %v, want %v", s.name, states, s.states)
+		}
+	}
+}
+
+func TestReconcileLeavesOthers(t *testing.T) {
+	n := newFakeNode(t, eth0)
+	n.m.vipInterfaces = []*net.Interface{eth0}
+	desired := []VIPSpec{{Address: "10.0.0.100", Enabled: true}}
+	if _, err := n.m.reconcile(desired, ReconcileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// a caller of its own holds the VIP as well
+	if err := n.m.add("10.0.0.100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.m.enable("10.0.0.100"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := n.m.reconcile(nil, ReconcileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.100"}; !reflect.DeepEqual(result.Removed, want) {
+		t.Fatalf("removed %v, want %v", result.Removed, want)
+	}
+	if state, _ := n.m.GetState("10.0.0.100"); state != StateAnnounced {
+		t.Fatalf("%s, want %s", state, StateAnnounced)
+	}
+}
@@ -0,0 +1,55 @@
+package vip
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State is the lifecycle stage of a VIP:
+// declared -> bound -> announced -> withdrawn -> removed
+type State int
+
+const (
+	// StateDeclared VIP is known but its address is not on the device yet
+	StateDeclared State = iota
+	// StateBound address is on the device, no ARP/NDP answered
+	StateBound
+	// StateAnnounced ARP/NDP answered for the VIP
+	StateAnnounced
+	// StateWithdrawn address still on the device, no longer answered
+	StateWithdrawn
+	// StateRemoved VIP and its address are gone
+	StateRemoved
+)
+
+var (
+	ErrNotAdded = errors.New("vip not added")
+	errClosed   = errors.New("vip manager closed")
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDeclared:
+		return "declared"
+	case StateBound:
+		return "bound"
+	case StateAnnounced:
+		return "announced"
+	case StateWithdrawn:
+		return "withdrawn"
+	case StateRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// StateError is returned when an operation is not valid in the VIP's state
+type StateError struct {
+	Address string
+	Op      string
+	State   State
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("vip %s: cannot %s while %s", e.Address, e.Op, e.State)
+}
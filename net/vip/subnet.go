@@ -0,0 +1,230 @@
+package vip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+var errNotIp4Subnet = errors.New("not an IPv4 subnet")
+
+// subnetEntry answers ARP for a whole IPv4 subnet but its exclusions
+type subnetEntry struct {
+	network *net.IPNet
+	exclude []*net.IPNet
+}
+
+func (e *subnetEntry) excluded(ip net.IP) bool {
+	for _, ex := range e.exclude {
+		if ex.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	entry *subnetEntry
+}
+
+// prefixTrie is a binary trie over IPv4 addresses, lookup returns the
+// longest matching prefix
+type prefixTrie struct {
+	root trieNode
+	size int
+}
+
+func ip4Bits(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func (t *prefixTrie) insert(prefix uint32, ones int, e *subnetEntry) {
+	n := &t.root
+	for i := 0; i < ones; i++ {
+		bit := prefix >> (31 - uint(i)) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = new(trieNode)
+		}
+		n = n.child[bit]
+	}
+	if n.entry == nil {
+		t.size++
+	}
+	n.entry = e
+}
+
+func (t *prefixTrie) remove(prefix uint32, ones int) bool {
+	path := make([]*trieNode, 0, ones+1)
+	n := &t.root
+	for i := 0; i < ones && n != nil; i++ {
+		path = append(path, n)
+		n = n.child[prefix>>(31-uint(i))&1]
+	}
+	if n == nil || n.entry == nil {
+		return false
+	}
+	n.entry = nil
+	t.size--
+
+	// prune branches left without entries
+	for i := len(path) - 1; i >= 0; i-- {
+		if n.entry != nil || n.child[0] != nil || n.child[1] != nil {
+			break
+		}
+		path[i].child[prefix>>(31-uint(i))&1] = nil
+		n = path[i]
+	}
+	return true
+}
+
+func (t *prefixTrie) lookup(ip uint32) (e *subnetEntry) {
+	n := &t.root
+	for i := 0; n != nil; i++ {
+		if n.entry != nil {
+			e = n.entry
+		}
+		if i == 32 {
+			break
+		}
+		n = n.child[ip>>(31-uint(i))&1]
+	}
+	return
+}
+
+func (t *prefixTrie) walk(fn func(e *subnetEntry)) {
+	var visit func(n *trieNode)
+	visit = func(n *trieNode) {
+		if n == nil {
+			return
+		}
+		if n.entry != nil {
+			fn(n.entry)
+		}
+		visit(n.child[0])
+		visit(n.child[1])
+	}
+	visit(&t.root)
+}
+
+type subnetMap struct {
+	trie prefixTrie
+	lock sync.RWMutex
+}
+
+// match reports whether ARP for ip is answered by a subnet entry
+func (sm *subnetMap) match(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	if sm.trie.size == 0 {
+		return false
+	}
+	e := sm.trie.lookup(ip4Bits(ip))
+	return e != nil && !e.excluded(ip)
+}
+
+func (sm *subnetMap) prefixes() (networks []*net.IPNet) {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	sm.trie.walk(func(e *subnetEntry) {
+		networks = append(networks, e.network)
+	})
+	return
+}
+
+func parseSubnet(cidr string) (network *net.IPNet, err error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		// a plain address excludes just itself
+		if ip = net.ParseIP(cidr); ip == nil {
+			return nil, err
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(net.IPv4len*8, net.IPv4len*8)}
+		err = nil
+	}
+
+	if network.IP = network.IP.To4(); network.IP == nil {
+		return nil, errNotIp4Subnet
+	}
+	if _, bits := network.Mask.Size(); bits != net.IPv4len*8 {
+		return nil, errNotIp4Subnet
+	}
+	return
+}
+
+// EnableSubnet answers ARP for every address of an IPv4 subnet but the
+// excluded addresses or subnets. The addresses are not bound, they have to
+// be routed to the node. Enabling a subnet again replaces its exclusions.
+func EnableSubnet(cidr string, exclude ...string) (err error) {
+	return defaultManager.EnableSubnet(cidr, exclude...)
+}
+
+func (m *Manager) EnableSubnet(cidr string, exclude ...string) (err error) {
+	return m.ns.Do(func() error {
+		return m.enableSubnet(cidr, exclude...)
+	})
+}
+
+func (m *Manager) enableSubnet(cidr string, exclude ...string) (err error) {
+	if err = m.checkInit(); err != nil {
+		return err
+	}
+
+	network, err := parseSubnet(cidr)
+	if err != nil {
+		return
+	}
+
+	e := &subnetEntry{network: network}
+	for _, ex := range exclude {
+		exNet, err := parseSubnet(ex)
+		if err != nil {
+			return err
+		}
+		e.exclude = append(e.exclude, exNet)
+	}
+
+	ones, _ := network.Mask.Size()
+	m.subnets.lock.Lock()
+	m.subnets.trie.insert(ip4Bits(network.IP), ones, e)
+	m.subnets.lock.Unlock()
+
+	return m.l4.refreshFilter()
+}
+
+// DisableSubnet stops answering ARP for a subnet enabled by EnableSubnet
+func DisableSubnet(cidr string) (err error) {
+	return defaultManager.DisableSubnet(cidr)
+}
+
+func (m *Manager) DisableSubnet(cidr string) (err error) {
+	return m.ns.Do(func() error {
+		return m.disableSubnet(cidr)
+	})
+}
+
+func (m *Manager) disableSubnet(cidr string) (err error) {
+	if err = m.checkInit(); err != nil {
+		return err
+	}
+
+	network, err := parseSubnet(cidr)
+	if err != nil {
+		return
+	}
+
+	ones, _ := network.Mask.Size()
+	m.subnets.lock.Lock()
+	ok := m.subnets.trie.remove(ip4Bits(network.IP), ones)
+	m.subnets.lock.Unlock()
+	if !ok {
+		return ErrNotAdded
+	}
+
+	return m.l4.refreshFilter()
+}
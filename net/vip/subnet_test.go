@@ -0,0 +1,81 @@
+package vip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSubnetMatch(t *testing.T) {
+	var sm subnetMap
+	add := func(cidr string, exclude ...string) {
+		network, err := parseSubnet(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &subnetEntry{network: network}
+		for _, ex := range exclude {
+			exNet, err := parseSubnet(ex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.exclude = append(e.exclude, exNet)
+		}
+		ones, _ := network.Mask.Size()
+		sm.trie.insert(ip4Bits(network.IP), ones, e)
+	}
+
+	add("10.0.0.0/24", "10.0.0.0", "10.0.0.255", "10.0.0.16/28")
+	add("10.0.0.20/30")
+	add("10.0.1.7/32")
+
+	cases := []struct {
+		ip    string
+		match bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.0", false},
+		{"10.0.0.255", false},
+		{"10.0.0.17", false},
+		// a longer prefix wins over the exclusion of a shorter one
+		{"10.0.0.21", true},
+		{"10.0.1.7", true},
+		{"10.0.1.8", false},
+		{"192.168.0.1", false},
+		{"2001:db8::1", false},
+	}
+	for _, c := range cases {
+		if got := sm.match(net.ParseIP(c.ip)); got != c.match {
+			t.Errorf("match(%s) = %v, want %v", c.ip, got, c.match)
+		}
+	}
+
+	if n := len(sm.prefixes()); n != 3 {
+		t.Fatalf("%d prefixes, want 3", n)
+	}
+
+	network, _ := parseSubnet("10.0.0.20/30")
+	if !sm.trie.remove(ip4Bits(network.IP), 30) {
+		t.Fatal("remove 10.0.0.20/30 failed")
+	}
+	if sm.trie.remove(ip4Bits(network.IP), 30) {
+		t.Fatal("removed 10.0.0.20/30 twice")
+	}
+	if sm.match(net.ParseIP("10.0.0.21")) {
+		t.Fatal("10.0.0.21 still matched, its subnet is excluded")
+	}
+	if !sm.match(net.ParseIP("10.0.0.1")) {
+		t.Fatal("removing a nested subnet dropped its parent")
+	}
+}
+
+func TestParseSubnet(t *testing.T) {
+	for _, s := range []string{"2001:db8::/64", "10.0.0.0/33", "bogus"} {
+		if _, err := parseSubnet(s); err == nil {
+			t.Errorf("parseSubnet(%q) succeeded", s)
+		}
+	}
+	n, err := parseSubnet("10.0.0.7/24")
+	if err != nil || n.String() != "10.0.0.0/24" {
+		t.Fatalf("parseSubnet = %v, %v", n, err)
+	}
+}
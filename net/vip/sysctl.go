@@ -0,0 +1,175 @@
+package vip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/adoyee/go-utils/net/preflight"
+)
+
+// SysctlMode decides what a Manager does about the conf sysctls of the VIP
+// interfaces, which make the kernel answer for VIPs bound to lo regardless
+// of their state
+type SysctlMode int
+
+const (
+	// SysctlWarn logs every conflicting sysctl once
+	SysctlWarn SysctlMode = iota
+	// SysctlManage sets the conflicting sysctls of the VIP interfaces,
+	// RestoreSysctls puts the previous values back
+	SysctlManage
+	// SysctlIgnore leaves the sysctls alone silently
+	SysctlIgnore
+)
+
+func (s SysctlMode) String() string {
+	switch s {
+	case SysctlWarn:
+		return "warn"
+	case SysctlManage:
+		return "manage"
+	case SysctlIgnore:
+		return "ignore"
+	}
+	return fmt.Sprintf("SysctlMode(%d)", int(s))
+}
+
+// sysctlWant is a conf sysctl VIPs bound to lo depend on, value is the one
+// SysctlManage sets when it is not OK
+type sysctlWant struct {
+	preflight.ConfSysctl
+	value int
+}
+
+var vipSysctls = []sysctlWant{
+	{preflight.ConfSysctl{Family: "ipv4", Name: "arp_ignore", OK: func(v int) bool { return v >= 1 },
+		Why: "the kernel answers ARP for VIPs on lo regardless of their state"}, 1},
+	{preflight.ConfSysctl{Family: "ipv4", Name: "arp_announce", OK: func(v int) bool { return v >= 2 },
+		Why: "the kernel may use VIPs as the source of its ARP requests"}, 2},
+	{preflight.ConfSysctl{Family: "ipv6", Name: "proxy_ndp", OK: func(v int) bool { return v == 0 },
+		Why: "kernel proxy entries answer solicitations for VIPs regardless of their state"}, 0},
+	{preflight.ConfSysctl{Family: "ipv6", Name: "accept_dad", OK: func(v int) bool { return v <= 0 },
+		Why: "addresses taken over from another node stay tentative"}, 0},
+}
+
+func writeSysctl(key, value string) error {
+	return ioutil.WriteFile("/proc/sys/"+strings.Replace(key, ".", "/", -1), []byte(value), 0644)
+}
+
+// SetSysctlMode chooses what the default Manager does about the sysctls,
+// see Manager.SetSysctlMode
+func SetSysctlMode(mode SysctlMode) error {
+	return defaultManager.SetSysctlMode(mode)
+}
+
+// SetSysctlMode chooses what m does about the conf sysctls of its VIP
+// interfaces, of all interfaces before VipInterface. The sysctls are looked
+// at now, on VipInterface and on Add. Leaving SysctlManage restores them.
+func (m *Manager) SetSysctlMode(mode SysctlMode) error {
+	return m.ns.Do(func() (err error) {
+		m.sysctlLock.Lock()
+		old := m.sysctlMode
+		m.sysctlMode = mode
+		if old == SysctlManage && mode != SysctlManage {
+			err = m.restoreSysctls()
+		}
+		m.sysctlLock.Unlock()
+		if err != nil {
+			return
+		}
+		return m.syncSysctls()
+	})
+}
+
+// RestoreSysctls puts back the sysctls the default Manager changed
+func RestoreSysctls() error {
+	return defaultManager.RestoreSysctls()
+}
+
+// RestoreSysctls puts back the sysctls m changed in SysctlManage, which
+// stays chosen, the first error is returned
+func (m *Manager) RestoreSysctls() error {
+	return m.ns.Do(func() error {
+		m.sysctlLock.Lock()
+		defer m.sysctlLock.Unlock()
+		return m.restoreSysctls()
+	})
+}
+
+func (m *Manager) restoreSysctls() (err error) {
+	for key, value := range m.sysctlSaved {
+		if e := writeSysctl(key, value); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		delete(m.sysctlSaved, key)
+	}
+	return
+}
+
+// syncSysctls applies the mode to the VIP interfaces, it takes opLock
+func (m *Manager) syncSysctls() (err error) {
+	names, err := m.sysctlInterfaces()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if e := m.syncInterfaceSysctls(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (m *Manager) syncInterfaceSysctls(ifName string) (err error) {
+	m.sysctlLock.Lock()
+	defer m.sysctlLock.Unlock()
+
+	if m.sysctlMode == SysctlIgnore {
+		return
+	}
+	for _, s := range vipSysctls {
+		c := s.Check(ifName)
+		if c.OK {
+			continue
+		}
+		if m.sysctlMode == SysctlManage {
+			if e := m.setSysctl(s, ifName); e != nil {
+				if err == nil {
+					err = e
+				}
+				continue
+			}
+			// all may still win over the interface
+			if c = s.Check(ifName); c.OK {
+				continue
+			}
+		}
+		if !m.sysctlWarned[c.Name] {
+			m.sysctlWarned[c.Name] = true
+			log.Printf("sysctl %s: %s", c.Name, c.Detail)
+		}
+	}
+	return
+}
+
+// setSysctl sets the interface value of s, keeping the previous one
+func (m *Manager) setSysctl(s sysctlWant, ifName string) error {
+	key := s.Key(ifName)
+	old, err := preflight.Sysctl(key)
+	if err != nil {
+		return err
+	}
+	if err = writeSysctl(key, strconv.Itoa(s.value)); err != nil {
+		return err
+	}
+	if _, ok := m.sysctlSaved[key]; !ok {
+		m.sysctlSaved[key] = old
+	}
+	return nil
+}
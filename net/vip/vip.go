@@ -2,20 +2,49 @@ package vip
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adoyee/go-utils/net/netns"
+	"github.com/adoyee/go-utils/net/preflight"
 )
 
 const (
-	buffSize = 1024
+	// large enough for jumbo frames
+	buffSize = 9216
+	ipTool   = "/usr/sbin/ip"
 )
 
 type virtualIpAddress struct {
 	address string
 	isIp6   bool
 	ip      net.IP
+	state   State
+	// refs counts Add calls, enables counts Enable calls
+	refs    int
+	enables int
+
+	vmac     net.HardwareAddr
+	vmacMode VirtualMACMode
+	vmacLink string
+	// bind is resolved by Add and does not change afterwards
+	bind Binding
+	// announced are the announcers holding the VIP, guarded by opLock
+	announced map[Announcer]bool
+
+	// policy and balance are guarded by the vipMap lock, counters are
+	// updated atomically
+	policy   *vipPolicy
+	balance  *balanceRing
+	counters *Counters
+	// optErr is the first error of an Option, reported by Add
+	optErr error
 }
 
 type vipMap struct {
@@ -25,6 +54,8 @@ type vipMap struct {
 
 type vipRequest interface {
 	target() net.IP
+	// sender returns the requester's address and MAC, either may be nil
+	sender() (net.IP, net.HardwareAddr)
 	reply() error
 	ifIndex() int
 }
@@ -33,37 +64,186 @@ type vipListener interface {
 	accept() (vipRequest, error)
 }
 
-var (
+// buffPool holds *[]byte, a slice would be copied into an interface on Put
+var buffPool = sync.Pool{
+	New: func() interface{} {
+		buff := make([]byte, buffSize)
+		return &buff
+	},
+}
+
+// Manager holds the VIPs of one network namespace and opens its sockets
+// there, the package level functions use the one of the process's namespace
+type Manager struct {
+	// counters cover the replies for all VIPs and subnets, they are first
+	// for the 64-bit alignment atomic needs on 32-bit platforms
+	counters Counters
+
+	ns *netns.Namespace
+
 	vipes         vipMap
 	vipInterfaces []*net.Interface
-)
+	filterTargets bool
+	// flushNeighbors, announcers and announceRetry are guarded by opLock
+	flushNeighbors bool
+	announcers     []Announcer
+	// announceRetry runs retryAnnouncers while announcers failed
+	announceRetry *time.Timer
+	// withdrawals are the failed withdrawals of removed VIPs and announcers,
+	// guarded by opLock
+	withdrawals map[withdrawal]net.IP
+	subnets     subnetMap
+	// vmacLinks counts the VIPs sharing a macvlan child, guarded by opLock
+	vmacLinks map[string]int
+
+	l4    *vipListener4
+	l6    *listener6
+	links linkInfo
+	// ip runs the ip tool for dummy devices and macvlan children, runIP
+	// outside of tests
+	ip    func(args ...string) error
+	addrs addressTable
+
+	initLock sync.Mutex
+	// closed is set by Close, guarded by initLock
+	closed bool
+	// listeners counts the goroutines of startListen
+	listeners sync.WaitGroup
+	// opLock serializes lifecycle transitions
+	opLock sync.Mutex
+
+	reconcileLock sync.Mutex
+	reconciled    map[string]*reconcileClaim
+
+	// limit covers the replies for all VIPs and subnets
+	limit replyLimit
+
+	healthLock        sync.Mutex
+	healthWatches     map[string]*healthWatch
+	healthSubscribers map[chan HealthEvent]bool
+
+	// capture holds the *capture of StartCapture, nil when stopped
+	capture atomic.Value
+
+	sysctlLock sync.Mutex
+	sysctlMode SysctlMode
+	// sysctlSaved holds the values SysctlManage replaced, by key
+	sysctlSaved map[string]string
+	// sysctlWarned holds the keys already logged
+	sysctlWarned map[string]bool
+}
 
-func init() {
-	vipes = vipMap{
-		addresses: make(map[string]*virtualIpAddress),
+var defaultManager = New(nil)
+
+// New returns a Manager for the VIPs of ns, nil is the process's namespace.
+// Sockets are opened when first needed, ns has to stay open until then.
+func New(ns *netns.Namespace) *Manager {
+	return &Manager{
+		ns: ns,
+		vipes: vipMap{
+			addresses: make(map[string]*virtualIpAddress),
+		},
+		vipInterfaces:     make([]*net.Interface, 0, 8),
+		links:             newSystemLinks(),
+		ip:                runIP,
+		addrs:             netlinkAddrs{},
+		vmacLinks:         make(map[string]int),
+		withdrawals:       make(map[withdrawal]net.IP),
+		reconciled:        make(map[string]*reconcileClaim),
+		healthWatches:     make(map[string]*healthWatch),
+		healthSubscribers: make(map[chan HealthEvent]bool),
+		sysctlSaved:       make(map[string]string),
+		sysctlWarned:      make(map[string]bool),
 	}
-	vipInterfaces = make([]*net.Interface, 0, 8)
 }
 
 func VipInterface(name string) (err error) {
+	return defaultManager.VipInterface(name)
+}
+
+func (m *Manager) VipInterface(name string) (err error) {
+	return m.ns.Do(func() error {
+		return m.vipInterface(name)
+	})
+}
+
+func (m *Manager) vipInterface(name string) (err error) {
 	ifc, err := net.InterfaceByName(name)
 	if err != nil {
 		return
 	}
 
-	for _, i := range vipInterfaces {
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	for _, i := range m.vipInterfaces {
 		if i.Name == strings.TrimSpace(name) {
 			return
 		}
 	}
 
-	vipInterfaces = append(vipInterfaces, ifc)
+	// groups of enabled IPv6 VIPs follow onto the new interface, away from
+	// the kernel's choice used while no interface was configured
+	if m.l6 != nil {
+		for _, ip := range m.vipes.ip6s() {
+			if len(m.vipInterfaces) == 0 {
+				_ = m.l6.leaveGroupOn(nil, ip)
+			}
+			if err = m.l6.joinGroupOn(ifc, ip); err != nil {
+				return
+			}
+		}
+	}
+
+	m.vipInterfaces = append(m.vipInterfaces, ifc)
+	if m.l4 != nil {
+		if err = m.l4.refreshFilter(); err != nil {
+			return
+		}
+	}
+	if err = m.syncInterfaceSysctls(ifc.Name); err != nil {
+		log.Println("sysctl ", err)
+	}
+	return nil
+}
+
+// FilterTargets makes the kernel pass only ARP requests for enabled VIPs
+func FilterTargets(on bool) (err error) {
+	return defaultManager.FilterTargets(on)
+}
+
+func (m *Manager) FilterTargets(on bool) (err error) {
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	m.filterTargets = on
+	if m.l4 != nil {
+		err = m.l4.refreshFilter()
+	}
 	return
 }
 
-//Add vip to loopback interface
-func Add(address string) (err error) {
-	if err = checkInit(); err != nil {
+// Add declares the vip and binds it to the loopback interface, or where
+// WithBinding says, adding an already added vip only takes another
+// reference and ignores opts
+func Add(address string, opts ...Option) (err error) {
+	return defaultManager.Add(address, opts...)
+}
+
+func (m *Manager) Add(address string, opts ...Option) (err error) {
+	return m.ns.Do(func() error {
+		if err := m.add(address, opts...); err != nil {
+			return err
+		}
+		if err := m.syncSysctls(); err != nil {
+			log.Println("sysctl ", err)
+		}
+		return nil
+	})
+}
+
+func (m *Manager) add(address string, opts ...Option) (err error) {
+	if err = m.checkInit(); err != nil {
 		return err
 	}
 
@@ -71,28 +251,146 @@ func Add(address string) (err error) {
 	if err != nil {
 		return err
 	}
-	setLookup(v)
+	for _, opt := range opts {
+		opt(v)
+	}
+	if v.optErr != nil {
+		return v.optErr
+	}
+
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	if cur := m.vipes.get(v.address); cur != nil {
+		cur.refs++
+		return
+	}
+	if err = m.resolveBinding(v); err != nil {
+		return
+	}
+
+	v.refs = 1
+	v.state = StateDeclared
+	m.vipes.add(v)
+	if v.boundWhileDeclared() {
+		if err = m.setLookup(v); err != nil {
+			m.vipes.del(v.address)
+			return
+		}
+	}
+	if err = m.setVirtualMAC(v); err != nil {
+		if v.boundWhileDeclared() {
+			_ = m.unsetLookup(v)
+		}
+		m.vipes.del(v.address)
+		return
+	}
+	m.vipes.setState(v, StateBound)
 	return
 }
 
-//Delete vip from loopback interface
-func Delete(address string) (err error) {
-	if err = checkInit(); err != nil {
-		return err
+// Remove drops a reference to the vip, the last one withdraws it, detaches
+// its health check and removes its address from its device. When the
+// address cannot be removed the vip is kept with one reference, so Remove
+// can be retried.
+func Remove(address string) (err error) {
+	return defaultManager.Remove(address)
+}
+
+func (m *Manager) Remove(address string) (err error) {
+	return m.ns.Do(func() error {
+		return m.remove(address)
+	})
+}
+
+func (m *Manager) remove(address string) (err error) {
+	w, err := m.release(address)
+	if w != nil {
+		// the check may have waited for opLock, its Enable or Disable
+		// finds the vip gone
+		<-w.done
+	}
+	return
+}
+
+// release is remove under opLock, the health check of a removed vip is
+// cancelled and returned
+func (m *Manager) release(address string) (w *healthWatch, err error) {
+	if err = m.checkInit(); err != nil {
+		return
 	}
 
 	v, err := parseIP(address)
 	if err != nil {
-		return err
+		return
+	}
+
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return nil, ErrNotAdded
+	}
+
+	cur.refs--
+	if cur.refs > 0 {
+		return
+	}
+
+	if cur.state == StateAnnounced {
+		cur.enables = 0
+		err = m.withdraw(cur)
+	}
+	if cur.boundWhileDeclared() {
+		if uerr := m.unsetLookup(cur); uerr != nil {
+			// forgetting it would orphan the bound address
+			cur.refs = 1
+			if err == nil {
+				err = uerr
+			}
+			return
+		}
+	}
+	if uerr := m.unsetVirtualMAC(cur); err == nil {
+		err = uerr
 	}
-	_ = Delete(v.address)
-	unsetLookup(v)
+	// announcers still holding it are retried after it is gone
+	for a := range cur.announced {
+		m.withdrawals[withdrawal{a, cur.address}] = cur.ip
+	}
+	m.vipes.setState(cur, StateRemoved)
+	m.vipes.del(cur.address)
+
+	m.healthLock.Lock()
+	if w = m.healthWatches[cur.address]; w != nil {
+		delete(m.healthWatches, cur.address)
+		w.cancel()
+	}
+	m.healthLock.Unlock()
 	return
 }
 
-//Enable vip
+// Delete vip from loopback interface
+//
+// Deprecated: use Remove.
+func Delete(address string) (err error) {
+	return Remove(address)
+}
+
+// Enable starts answering ARP/NDP for an added vip and announces it
 func Enable(address string) (err error) {
-	if err = checkInit(); err != nil {
+	return defaultManager.Enable(address)
+}
+
+func (m *Manager) Enable(address string) (err error) {
+	return m.ns.Do(func() error {
+		return m.enable(address)
+	})
+}
+
+func (m *Manager) enable(address string) (err error) {
+	if err = m.checkInit(); err != nil {
 		return err
 	}
 
@@ -100,19 +398,77 @@ func Enable(address string) (err error) {
 	if err != nil {
 		return err
 	}
-	vipes.add(v)
-	if v.isIp6 {
-		l6.joinGroup(v.ip)
-		l6.gratuitous(v.ip)
-	} else {
-		err = l4.gratuitous(v.ip)
+
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return ErrNotAdded
+	}
+
+	takeover := false
+	switch cur.state {
+	case StateBound, StateWithdrawn:
+		takeover = true
+		if cur.kernelAnswers() {
+			if err = m.setLookup(cur); err != nil {
+				return
+			}
+		}
+		if cur.isIp6 {
+			if err = m.l6.joinGroup(cur.ip); err != nil {
+				return
+			}
+		}
+		m.vipes.setState(cur, StateAnnounced)
+		if !cur.isIp6 {
+			if err = m.l4.refreshFilter(); err != nil {
+				return
+			}
+		}
+	case StateAnnounced:
+		// announce again for the new caller
+	default:
+		return &StateError{Address: cur.address, Op: "enable", State: cur.state}
+	}
+
+	cur.enables++
+	var takeoverErr error
+	if takeover && m.flushNeighbors {
+		takeoverErr = flushNeighbor(cur.ip)
+	}
+	// announcers which failed are tried again for the new caller
+	if e := m.announce(cur); takeoverErr == nil {
+		takeoverErr = e
+	}
+	// an announcement would pull every requester onto this node
+	if m.vipes.balanceRing(cur) == nil {
+		if cur.isIp6 {
+			err = m.l6.gratuitous(cur.ip)
+		} else {
+			err = m.l4.gratuitous(cur.ip)
+		}
+	}
+	if err == nil {
+		err = takeoverErr
 	}
 	return
 }
 
-//Disable vip
+// Disable drops an Enable, the last one stops answering for the vip
 func Disable(address string) (err error) {
-	if err = checkInit(); err != nil {
+	return defaultManager.Disable(address)
+}
+
+func (m *Manager) Disable(address string) (err error) {
+	return m.ns.Do(func() error {
+		return m.disable(address)
+	})
+}
+
+func (m *Manager) disable(address string) (err error) {
+	if err = m.checkInit(); err != nil {
 		return err
 	}
 
@@ -120,10 +476,81 @@ func Disable(address string) (err error) {
 	if err != nil {
 		return
 	}
-	vipes.del(v.address)
+
+	m.opLock.Lock()
+	defer m.opLock.Unlock()
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return ErrNotAdded
+	}
+
+	if cur.state != StateAnnounced {
+		return &StateError{Address: cur.address, Op: "disable", State: cur.state}
+	}
+
+	cur.enables--
+	if cur.enables > 0 {
+		return
+	}
+	return m.withdraw(cur)
+}
+
+// GetState returns the lifecycle state of an added vip
+func GetState(address string) (state State, err error) {
+	return defaultManager.GetState(address)
+}
+
+func (m *Manager) GetState(address string) (state State, err error) {
+	v, err := parseIP(address)
+	if err != nil {
+		return
+	}
+
+	cur := m.vipes.get(v.address)
+	if cur == nil {
+		return StateRemoved, ErrNotAdded
+	}
+	return m.vipes.state(cur), nil
+}
+
+// List returns the added VIPs, sorted
+func List() []string {
+	return defaultManager.List()
+}
+
+func (m *Manager) List() []string {
+	return m.vipes.list()
+}
+
+func (m *Manager) withdraw(v *virtualIpAddress) (err error) {
+	m.vipes.setState(v, StateWithdrawn)
+	// routers stop sending traffic before the address goes
+	err = m.withdrawAnnounced(v)
+	if v.kernelAnswers() {
+		if uerr := m.unsetLookup(v); err == nil {
+			err = uerr
+		}
+	}
 	if v.isIp6 {
-		l6.leaveGroup(v.ip)
+		if lerr := m.l6.leaveGroup(v.ip); err == nil {
+			err = lerr
+		}
+		return
+	}
+	if rerr := m.l4.refreshFilter(); err == nil {
+		err = rerr
+	}
+	return
+}
+
+func (vmap *vipMap) list() (addresses []string) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	for address := range vmap.addresses {
+		addresses = append(addresses, address)
 	}
+	sort.Strings(addresses)
 	return
 }
 
@@ -139,6 +566,79 @@ func (vmap *vipMap) del(addr string) {
 	delete(vmap.addresses, addr)
 }
 
+func (vmap *vipMap) setState(addr *virtualIpAddress, state State) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	addr.state = state
+}
+
+func (vmap *vipMap) state(addr *virtualIpAddress) State {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	return addr.state
+}
+
+// announced reports whether requests for addr are answered
+func (vmap *vipMap) announced(addr string) bool {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	va, ok := vmap.addresses[addr]
+	return ok && va.state == StateAnnounced
+}
+
+func (vmap *vipMap) policy(addr *virtualIpAddress) *vipPolicy {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	return addr.policy
+}
+
+func (vmap *vipMap) setPolicy(addr *virtualIpAddress, p *vipPolicy) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	addr.policy = p
+}
+
+func (vmap *vipMap) balanceRing(addr *virtualIpAddress) *balanceRing {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	return addr.balance
+}
+
+func (vmap *vipMap) setBalance(addr *virtualIpAddress, r *balanceRing) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	addr.balance = r
+}
+
+// all returns the VIPs, in no particular order
+func (vmap *vipMap) all() (vips []*virtualIpAddress) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	for _, v := range vmap.addresses {
+		vips = append(vips, v)
+	}
+	return
+}
+
+func (vmap *vipMap) ip4s() (ips []net.IP) {
+	return vmap.announcedIPs(false)
+}
+
+func (vmap *vipMap) ip6s() (ips []net.IP) {
+	return vmap.announcedIPs(true)
+}
+
+func (vmap *vipMap) announcedIPs(isIp6 bool) (ips []net.IP) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	for _, v := range vmap.addresses {
+		if v.isIp6 == isIp6 && v.state == StateAnnounced {
+			ips = append(ips, v.ip)
+		}
+	}
+	return
+}
+
 func (vmap *vipMap) get(addr string) (va *virtualIpAddress) {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
@@ -161,70 +661,209 @@ func parseIP(addr string) (vip *virtualIpAddress, err error) {
 	}
 
 	vip = &virtualIpAddress{
-		address: ip.String(),
-		isIp6:   len(ip) == net.IPv6len,
-		ip:      ip,
+		address:  ip.String(),
+		isIp6:    len(ip) == net.IPv6len,
+		ip:       ip,
+		bind:     hostBinding(ip),
+		counters: new(Counters),
 	}
 	return
 }
 
-func startListen(l vipListener) {
+func (m *Manager) startListen(l vipListener) {
+	defer m.listeners.Done()
+
+	// replies look up interfaces, which has to happen in the namespace
+	if err := m.ns.Enter(); err != nil {
+		log.Println(err)
+		return
+	}
+
 	for {
 		req, err := l.accept()
+		if isClosed(err) {
+			return
+		}
 		if err != nil {
+			log.Println("listen ", err)
 			continue
 		}
-		if vipes.get(req.target().String()) != nil {
-			if len(vipInterfaces) == 0 {
-				_ = req.reply()
-				continue
-			}
+		_, _ = m.handle(req)
+	}
+}
 
-			for _, ifc := range vipInterfaces {
-				if ifc.Index == req.ifIndex() {
-					_ = req.reply()
-				}
-			}
+// handle answers a request if it is for us, replied tells whether it did
+func (m *Manager) handle(req vipRequest) (replied bool, err error) {
+	if !m.vipes.announced(req.target().String()) && !m.subnets.match(req.target()) {
+		return
+	}
+	if v := m.vipes.get(req.target().String()); v != nil && v.kernelAnswers() {
+		return
+	}
+	if !m.onVipInterface(req.ifIndex()) {
+		return
+	}
+	if !m.owns(req) {
+		return
+	}
+
+	counters, ok := m.admit(req)
+	if !ok {
+		return
+	}
+	if err = req.reply(); err != nil {
+		return
+	}
+	m.countReply(counters)
+	return true, nil
+}
+
+func (m *Manager) onVipInterface(index int) bool {
+	if len(m.vipInterfaces) == 0 {
+		return true
+	}
+	for _, ifc := range m.vipInterfaces {
+		if ifc.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// setLookup binds the vip to its device and tags it so a later process can
+// tell it from addresses others put there, see Leftovers
+func (m *Manager) setLookup(v *virtualIpAddress) (err error) {
+	if v.bind.Mode == BindNone {
+		return
+	}
+	if v.bind.Mode == BindDummy {
+		if err = m.ensureDummy(v.bind.Device); err != nil {
+			return
 		}
 	}
+
+	a := v.ifAddr()
+	a.proto = vipProto
+	switch {
+	case v.isIp6 && v.kernelAnswers():
+		// the VIP moves between nodes, DAD would keep it tentative
+		a.flags = ifaFNodad
+	case !v.isIp6:
+		a.label = ip4Label(v.bind.Device)
+	}
+	return m.addrs.replace(a)
 }
 
-func setLookup(v *virtualIpAddress) {
-	addr := fmt.Sprintf("%s/%d", v.ip, len(v.ip)*8)
-	args := []string{"address", "add", addr, "dev", "lo"}
-	cmd := exec.Command("/usr/sbin/ip", args...)
-	_ = cmd.Run()
+func (m *Manager) unsetLookup(v *virtualIpAddress) (err error) {
+	if v.bind.Mode == BindNone {
+		return
+	}
+	return m.addrs.remove(v.ifAddr())
 }
-func unsetLookup(v *virtualIpAddress) {
-	addr := fmt.Sprintf("%s/%d", v.ip, len(v.ip)*8)
-	args := []string{"address", "del", addr, "dev", "lo"}
-	cmd := exec.Command("/usr/sbin/ip", args...)
-	_ = cmd.Run()
+
+// ifAddr is the address of v's binding
+func (v *virtualIpAddress) ifAddr() ifAddr {
+	return ifAddr{ip: v.ip, prefixLen: v.bind.PrefixLen, device: v.bind.Device}
 }
 
-var initLock sync.Mutex
+// runIP runs an ip command, failures for lack of the tool or of
+// CAP_NET_ADMIN are a *preflight.MissingError
+func runIP(args ...string) (err error) {
+	cmd := exec.Command(ipTool, args...)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		return preflight.MissingTool("ip", ipTool, err)
+	}
+	err = fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	return preflight.Explain("ip", err, preflight.CapNetAdmin)
+}
 
-func checkInit() (err error) {
-	initLock.Lock()
-	defer initLock.Unlock()
-	return initResource()
+// checkInit opens the listeners, failing with a *preflight.MissingError
+// without CAP_NET_RAW
+func (m *Manager) checkInit() (err error) {
+	m.initLock.Lock()
+	defer m.initLock.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	return preflight.Explain("listen", m.initResource(), preflight.CapNetRaw)
 }
 
-func initResource() (err error) {
-	if l6 == nil {
-		l6, err = createListen6()
+func (m *Manager) initResource() (err error) {
+	if m.l6 == nil {
+		m.l6, err = m.createListen6()
 		if err != nil {
 			return
 		}
-		go startListen(l6)
+		m.listeners.Add(1)
+		go m.startListen(m.l6)
 	}
 
-	if l4 == nil {
-		l4, err = newListen4()
+	if m.l4 == nil {
+		m.l4, err = m.newListen4()
 		if err != nil {
 			return
 		}
-		go startListen(l4)
+		m.listeners.Add(1)
+		go m.startListen(m.l4)
+
+		if links, ok := m.links.(*systemLinks); ok {
+			if werr := links.startWatch(); werr != nil {
+				log.Println("link watch ", werr)
+			}
+		}
+	}
+	return
+}
+
+// Close stops the health checks and listeners of m and closes its sockets,
+// the VIPs keep their addresses and can only be looked at afterwards. A
+// Manager has to be closed before its namespace.
+func (m *Manager) Close() (err error) {
+	m.healthLock.Lock()
+	watches := m.healthWatches
+	m.healthWatches = make(map[string]*healthWatch)
+	m.healthLock.Unlock()
+	for _, w := range watches {
+		w.cancel()
+		<-w.done
+	}
+
+	m.opLock.Lock()
+	if m.announceRetry != nil {
+		m.announceRetry.Stop()
+		m.announceRetry = nil
+	}
+	m.opLock.Unlock()
+
+	m.initLock.Lock()
+	defer m.initLock.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+
+	if m.l4 != nil {
+		if e := m.l4.socket.close(); e != nil && err == nil {
+			err = e
+		}
+		if e := m.l4.cooked.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if m.l6 != nil {
+		if e := m.l6.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if links, ok := m.links.(*systemLinks); ok {
+		if e := links.stopWatch(); e != nil && err == nil {
+			err = e
+		}
 	}
+	m.listeners.Wait()
 	return
 }
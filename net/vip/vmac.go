@@ -0,0 +1,100 @@
+package vip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// VirtualMACMode selects how a virtual MAC is put on the wire
+type VirtualMACMode int
+
+const (
+	// VirtualMACMacvlan creates a macvlan child owning the virtual MAC on the
+	// first VIP interface, so the kernel receives traffic sent to it
+	VirtualMACMacvlan VirtualMACMode = iota
+	// VirtualMACSpoof only advertises the virtual MAC, the kernel drops IP
+	// traffic to a MAC no interface owns, so the dataplane has to accept it
+	VirtualMACSpoof
+)
+
+var errNoVipInterface = errors.New("virtual MAC needs a vip interface")
+
+// Option configures a VIP when it is added
+type Option func(v *virtualIpAddress)
+
+// WithVirtualMAC advertises the VRRP virtual MAC 00:00:5e:00:01:vrid, or
+// 00:00:5e:00:02:vrid for IPv6, instead of the interface's one, so on
+// failover only the switch's MAC table entry moves
+func WithVirtualMAC(vrid uint8, mode VirtualMACMode) Option {
+	return func(v *virtualIpAddress) {
+		family := byte(0x01)
+		if v.isIp6 {
+			family = 0x02
+		}
+		v.vmac = net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, family, vrid}
+		v.vmacMode = mode
+	}
+}
+
+// advertisedMAC returns the hardware address to announce for ip on ifc
+func (m *Manager) advertisedMAC(ip net.IP, ifc *net.Interface) net.HardwareAddr {
+	if v := m.vipes.get(ip.String()); v != nil && v.vmac != nil {
+		return v.vmac
+	}
+	return ifc.HardwareAddr
+}
+
+func macvlanName(v *virtualIpAddress) string {
+	if v.isIp6 {
+		return fmt.Sprintf("vmac6.%d", v.vmac[5])
+	}
+	return fmt.Sprintf("vmac4.%d", v.vmac[5])
+}
+
+// setVirtualMAC creates the macvlan child owning the virtual MAC, VIPs of
+// one virtual router share it
+func (m *Manager) setVirtualMAC(v *virtualIpAddress) (err error) {
+	if v.vmac == nil || v.vmacMode != VirtualMACMacvlan {
+		return
+	}
+
+	if len(m.vipInterfaces) == 0 {
+		return errNoVipInterface
+	}
+
+	name := macvlanName(v)
+	if m.vmacLinks[name] > 0 {
+		m.vmacLinks[name]++
+		v.vmacLink = name
+		return
+	}
+
+	args := []string{"link", "add", "link", m.vipInterfaces[0].Name, "name", name,
+		"address", v.vmac.String(), "type", "macvlan", "mode", "private"}
+	if err = m.ip(args...); err != nil {
+		return
+	}
+
+	if err = m.ip("link", "set", name, "up"); err != nil {
+		_ = m.ip("link", "del", name)
+		return
+	}
+	m.vmacLinks[name] = 1
+	v.vmacLink = name
+	return
+}
+
+func (m *Manager) unsetVirtualMAC(v *virtualIpAddress) (err error) {
+	if v.vmacLink == "" {
+		return
+	}
+
+	name := v.vmacLink
+	v.vmacLink = ""
+	if m.vmacLinks[name]--; m.vmacLinks[name] > 0 {
+		return
+	}
+	delete(m.vmacLinks, name)
+	return m.ip("link", "del", name)
+}